@@ -18,20 +18,11 @@ import (
 	"fmt"
 	"os"
 
-	homedir "github.com/mitchellh/go-homedir"
+	"github.com/scribd/fastly-waf-ece/pkg/ece"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var cfgFile string
-var address string
-var ttl int
-var debug bool
-var logFile string
-var maxLogSize int
-var maxLogBackups int
-var maxLogAge int
-var logCompress bool
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -57,46 +48,11 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
-
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ece.yaml)")
 
-	rootCmd.PersistentFlags().StringVarP(&address, "address", "a", "", "address to listen upon")
-	rootCmd.PersistentFlags().IntVarP(&ttl, "ttl", "t", 20, "Time to wait for messages before flushing them downstream")
-	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "Debug.  Echos incoming logs to STEDERR")
-	rootCmd.PersistentFlags().StringVarP(&logFile, "logFile", "l", "/var/log/fastly-waf-ece/events.log", "Log file path")
-	rootCmd.PersistentFlags().IntVarP(&maxLogSize, "logSize", "s", 500, "max log file size")
-	rootCmd.PersistentFlags().IntVarP(&maxLogBackups, "logBackups", "b", 5, "max log file backups")
-	rootCmd.PersistentFlags().IntVarP(&maxLogAge, "logAge", "g", 28, "max log file age")
-	rootCmd.PersistentFlags().BoolVarP(&logCompress, "logCompress", "c", false, "Compress logs")
-
-}
-
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := homedir.Dir()
-		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-
-		// Search config in home directory with name ".ece" (without extension).
-		viper.AddConfigPath(home)
-		viper.SetConfigName(".ece")
-	}
-
-	viper.AutomaticEnv() // read in environment variables that match
-
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
-	}
+	// Every other setting is a flag, a config file key and an ECE_ environment variable.  See ece.LoadConfig.
+	ece.AddFlags(rootCmd.PersistentFlags())
 }
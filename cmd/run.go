@@ -19,8 +19,8 @@ import (
 	"github.com/spf13/cobra"
 	"log"
 	"os"
-	"path"
-	"time"
+	"os/signal"
+	"syscall"
 )
 
 // runCmd represents the run command
@@ -31,27 +31,68 @@ var runCmd = &cobra.Command{
 Runs the ECE on the configured port.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		if _, ok := os.Stat(logFile); os.IsNotExist(ok) {
-			logDir := path.Base(logFile)
-			err := os.MkdirAll(logDir, 0755)
-			if err != nil {
-				log.Fatalf("Could not create log dir %s: %s", logDir, err)
-			}
+		config, err := ece.LoadConfig(cmd.Flags(), cfgFile)
+		if err != nil {
+			log.Fatalf("Invalid config: %s", err)
 		}
 
-		if address == "" {
-			log.Fatalln("Cannot run without a listen address (-a).  Run fastly-waf-ece help for more info.")
+		if config.File != "" {
+			log.Printf("Using config file: %s", config.File)
+		}
+
+		engine, err := config.NewECE()
+		if err != nil {
+			log.Fatalf("failed to set up: %s", err)
 		}
 
-		engine := ece.NewECE(time.Duration(ttl)*time.Second, logFile, maxLogSize, maxLogBackups, maxLogAge, logCompress, address)
-		engine.Debug = debug
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
-		err := engine.Start()
+		err = engine.Start()
 		if err != nil {
 			log.Fatalf("failed to start server: %s", err)
 		}
 
-		engine.Wait()
+		// Should every listener die, shut down rather than linger without them
+		stopped := make(chan struct{})
+		go func() {
+			engine.Wait()
+			close(stopped)
+		}()
+
+		failed := false
+
+	wait:
+		for {
+			select {
+			case sig := <-signals:
+				if sig != syscall.SIGHUP {
+					log.Printf("Received %s.  Flushing pending events and shutting down.", sig)
+					break wait
+				}
+
+				log.Printf("Received %s.  Reloading the config.", sig)
+
+				// Reload logs how it went, and the ECE carries on regardless
+				_ = engine.Reload(func() (ece.Config, error) {
+					return ece.LoadConfig(cmd.Flags(), cfgFile)
+				})
+
+			case <-stopped:
+				log.Printf("Every listener has stopped.  Flushing pending events and shutting down.")
+				failed = true
+				break wait
+			}
+		}
+
+		err = engine.Stop(engine.Config().ShutdownTimeout)
+		if err != nil {
+			log.Fatalf("failed to shut down cleanly: %s", err)
+		}
+
+		if failed {
+			os.Exit(1)
+		}
 	},
 }
 
@@ -1,6 +1,7 @@
 module github.com/scribd/fastly-waf-ece
 
 require (
+	github.com/Shopify/sarama v1.29.0
 	github.com/BurntSushi/toml v0.3.1 // indirect
 	github.com/davecgh/go-spew v1.1.1
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
@@ -8,7 +9,9 @@ require (
 	github.com/mitchellh/go-homedir v1.0.0
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v1.12.2
 	github.com/spf13/cobra v0.0.3
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.3.1
 	github.com/stretchr/testify v1.2.2
 	gopkg.in/mcuadros/go-syslog.v2 v2.2.1
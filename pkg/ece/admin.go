@@ -0,0 +1,296 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ADMIN_EVENTS_LIMIT_DEFAULT the most pending events listed by /events, unless limit says otherwise
+const ADMIN_EVENTS_LIMIT_DEFAULT = 100
+
+// ADMIN_FLUSH_TIMEOUT how long a POST to /flush has to write every pending event
+const ADMIN_FLUSH_TIMEOUT = 30 * time.Second
+
+// ReadySink is implemented by sinks that can tell whether they're able to take events.  Sinks that don't implement it are assumed ready.
+type ReadySink interface {
+	Ready() error
+}
+
+// PendingEvent describes an event waiting to be written, as the admin API shows it
+type PendingEvent struct {
+	RequestId      string         `json:"request_id"`
+	Created        time.Time      `json:"created"`
+	AgeSeconds     float64        `json:"age_seconds"`
+	Bytes          int            `json:"bytes"`
+	WafEntries     []WafEntry     `json:"waf_entries,omitempty"`
+	RequestEntries []RequestEntry `json:"request_entries,omitempty"`
+}
+
+// pendingEvent describes the event, including its entries if asked
+func pendingEvent(reqId string, event *Event, entries bool, now time.Time) PendingEvent {
+	event.mutex.Lock()
+	defer event.mutex.Unlock()
+
+	pending := PendingEvent{
+		RequestId:  reqId,
+		Created:    event.created,
+		AgeSeconds: now.Sub(event.created).Seconds(),
+		Bytes:      event.bytes,
+	}
+
+	if entries {
+		pending.WafEntries = append([]WafEntry{}, event.WafEntries...)
+		pending.RequestEntries = append([]RequestEntry{}, event.RequestEntries...)
+	}
+
+	return pending
+}
+
+// PendingEvents returns up to limit pending events, oldest first, without their entries
+func (ece *ECE) PendingEvents(limit int) []PendingEvent {
+	now := time.Now()
+	events := []PendingEvent{}
+
+	ece.events.Range(func(reqId string, event *Event) bool {
+		events = append(events, pendingEvent(reqId, event, false, now))
+		return true
+	})
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Created.Before(events[j].Created) })
+
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events
+}
+
+// Ready reports why the ECE can't take messages, if it can't: it hasn't started listening, it's stopping, or a sink can't be written to
+func (ece *ECE) Ready() (err error) {
+	if atomic.LoadInt32(&ece.running) == 0 {
+		err = errors.New("not listening")
+		return err
+	}
+
+	failures := []string{}
+
+	ece.settings.RLock()
+	defer ece.settings.RUnlock()
+
+	for _, sink := range ece.Sinks {
+		if ready, ok := sink.(ReadySink); ok {
+			sinkErr := ready.Ready()
+			if sinkErr != nil {
+				failures = append(failures, fmt.Sprintf("%s sink: %s", sinkName(sink), sinkErr))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		err = errors.New(strings.Join(failures, "; "))
+	}
+
+	return err
+}
+
+// FlushEvent writes the pending event for the request id now, regardless of its TTL.  It returns false if there's no such event.
+func (ece *ECE) FlushEvent(reqId string) (ok bool, err error) {
+	if _, exists := ece.events.Get(reqId); !exists {
+		return false, err
+	}
+
+	ece.expiries.Cancel(reqId)
+
+	err = ece.WriteEvent(reqId)
+
+	return true, err
+}
+
+// AdminHandler returns the handler for the admin API:
+//
+//	GET  /healthz               200 as long as the process is serving
+//	GET  /readyz                200 once listening with every sink ready, 503 with the reasons otherwise
+//	GET  /events?limit=n        the pending events, oldest first, with their age
+//	GET  /events/<request id>   a pending event and its entries
+//	POST /flush                 write every pending event now
+//	POST /flush/<request id>    write the pending event now
+//	GET  /reload                the outcome of the config reloads so far
+//	GET  /metrics               as on MetricsAddress
+func (ece *ECE) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", ece.adminHealth)
+	mux.HandleFunc("/readyz", ece.adminReady)
+	mux.HandleFunc("/events", ece.adminEvents)
+	mux.HandleFunc("/events/", ece.adminEvent)
+	mux.HandleFunc("/flush", ece.adminFlush)
+	mux.HandleFunc("/flush/", ece.adminFlush)
+	mux.HandleFunc("/reload", ece.adminReload)
+	mux.Handle(METRICS_PATH, ece.MetricsHandler())
+
+	return mux
+}
+
+// adminJSON writes the value as the JSON response
+func adminJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
+
+// adminMethod checks the request's method, answering 405 if it's wrong
+func adminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	return false
+}
+
+func (ece *ECE) adminHealth(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+func (ece *ECE) adminReady(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	err := ece.Ready()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprintln(w, "ok")
+}
+
+func (ece *ECE) adminEvents(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	limit := ADMIN_EVENTS_LIMIT_DEFAULT
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("limit %q must be a positive integer", value), http.StatusBadRequest)
+			return
+		}
+
+		limit = n
+	}
+
+	adminJSON(w, http.StatusOK, struct {
+		Pending int            `json:"pending"`
+		Events  []PendingEvent `json:"events"`
+	}{
+		Pending: ece.Pending(),
+		Events:  ece.PendingEvents(limit),
+	})
+}
+
+func (ece *ECE) adminEvent(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	reqId := strings.TrimPrefix(r.URL.Path, "/events/")
+
+	event, exists := ece.events.Get(reqId)
+	if !exists {
+		http.Error(w, fmt.Sprintf("no pending event for req id %q", reqId), http.StatusNotFound)
+		return
+	}
+
+	adminJSON(w, http.StatusOK, pendingEvent(reqId, event, true, time.Now()))
+}
+
+func (ece *ECE) adminFlush(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	reqId := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/flush"), "/")
+
+	if reqId == "" {
+		written, err := ece.flush(time.Now().Add(ADMIN_FLUSH_TIMEOUT))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		adminJSON(w, http.StatusOK, map[string]int{"flushed": written})
+		return
+	}
+
+	ok, err := ece.FlushEvent(reqId)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no pending event for req id %q", reqId), http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	adminJSON(w, http.StatusOK, map[string]int{"flushed": 1})
+}
+
+func (ece *ECE) adminReload(w http.ResponseWriter, r *http.Request) {
+	if !adminMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	adminJSON(w, http.StatusOK, ece.ReloadStatus())
+}
+
+// listenAdmin serves the admin API on AdminAddress
+func (ece *ECE) listenAdmin() (err error) {
+	ln, err := net.Listen("tcp", ece.AdminAddress)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to start admin listener on %s", ece.AdminAddress)
+		return err
+	}
+
+	server := &http.Server{
+		Handler: ece.AdminHandler(),
+	}
+
+	ece.httpServers = append(ece.httpServers, server)
+	ece.httpWait.Add(1)
+
+	go func() {
+		defer ece.httpWait.Done()
+
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			_, _ = fmt.Fprintf(os.Stderr, "admin listener on %s failed: %s\n", ece.AdminAddress, err)
+		}
+	}()
+
+	return err
+}
@@ -0,0 +1,145 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminRequest makes a request of the ECE's admin API, returning the status and body
+func adminRequest(ece *ECE, method string, target string) (int, string) {
+	recorder := httptest.NewRecorder()
+	ece.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestAdminHealth(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+
+	status, body := adminRequest(ece, http.MethodGet, "/healthz")
+	assert.Equal(t, status, http.StatusOK, "Healthy.")
+	assert.Equal(t, body, "ok\n", "Health body.")
+
+	status, _ = adminRequest(ece, http.MethodPost, "/healthz")
+	assert.Equal(t, status, http.StatusMethodNotAllowed, "Only GET.")
+}
+
+func TestAdminReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-admin")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	unwritable := filepath.Join(dir, "unwritable")
+	err = os.Mkdir(unwritable, 0500)
+	if err != nil {
+		t.Fatalf("failed creating dir: %s", err)
+	}
+
+	ece := NewECE(time.Hour, filepath.Join(dir, "ece.log"), 0, 0, 0, false, "")
+	ece.Listeners = []Listener{{Network: LISTENER_HTTP, Address: testAddress()}}
+
+	status, body := adminRequest(ece, http.MethodGet, "/readyz")
+	assert.Equal(t, status, http.StatusServiceUnavailable, "Not ready before starting.")
+	assert.Equal(t, body, "not listening\n", "Reason given.")
+
+	err = ece.Start()
+	if err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+
+	status, _ = adminRequest(ece, http.MethodGet, "/readyz")
+	assert.Equal(t, status, http.StatusOK, "Ready once listening.")
+
+	if os.Getuid() != 0 {
+		ece.Sinks = append(ece.Sinks, NewFileSink(filepath.Join(unwritable, "ece.log"), 0, 0, 0, false))
+
+		status, body = adminRequest(ece, http.MethodGet, "/readyz")
+		assert.Equal(t, status, http.StatusServiceUnavailable, "Not ready when a sink can't write.")
+		assert.Equal(t, strings.HasPrefix(body, "file sink: can't write to"), true, fmt.Sprintf("Sink named: %s", body))
+	}
+
+	_ = ece.Shutdown()
+	ece.Wait()
+
+	status, _ = adminRequest(ece, http.MethodGet, "/readyz")
+	assert.Equal(t, status, http.StatusServiceUnavailable, "Not ready once stopped.")
+}
+
+func TestAdminEvents(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{&testSink{}}
+
+	_ = ece.AddEvent(testWafEntryMessageFor("first"))
+	time.Sleep(10 * time.Millisecond)
+	_ = ece.AddEvent(testWafEntryMessage())
+	_ = ece.AddEvent(testWebEntryMessage())
+
+	var list struct {
+		Pending int            `json:"pending"`
+		Events  []PendingEvent `json:"events"`
+	}
+
+	status, body := adminRequest(ece, http.MethodGet, "/events?limit=1")
+	assert.Equal(t, status, http.StatusOK, "Events listed.")
+
+	_ = json.Unmarshal([]byte(body), &list)
+	assert.Equal(t, list.Pending, 2, "Pending count.")
+	assert.Equal(t, len(list.Events), 1, "Limited.")
+	assert.Equal(t, list.Events[0].RequestId, "first", "Oldest first.")
+	assert.Equal(t, list.Events[0].AgeSeconds > 0, true, "Age given.")
+	assert.Equal(t, len(list.Events[0].WafEntries), 0, "Entries left out of the list.")
+
+	status, _ = adminRequest(ece, http.MethodGet, "/events?limit=none")
+	assert.Equal(t, status, http.StatusBadRequest, "Bad limit refused.")
+
+	var event PendingEvent
+
+	status, body = adminRequest(ece, http.MethodGet, "/events/"+testWafEntry().RequestId)
+	assert.Equal(t, status, http.StatusOK, "Event found.")
+
+	_ = json.Unmarshal([]byte(body), &event)
+	assert.Equal(t, event.WafEntries, []WafEntry{testWafEntry()}, "WAF entries shown.")
+	assert.Equal(t, event.RequestEntries, []RequestEntry{testWebEntry()}, "Req entries shown.")
+
+	status, _ = adminRequest(ece, http.MethodGet, "/events/missing")
+	assert.Equal(t, status, http.StatusNotFound, "Unknown event.")
+}
+
+func TestAdminFlush(t *testing.T) {
+	logs := &testSink{}
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs}
+
+	for _, reqId := range []string{"a", "b", "c"} {
+		_ = ece.AddEvent(testWafEntryMessageFor(reqId))
+	}
+
+	status, _ := adminRequest(ece, http.MethodGet, "/flush/a")
+	assert.Equal(t, status, http.StatusMethodNotAllowed, "Only POST.")
+
+	status, body := adminRequest(ece, http.MethodPost, "/flush/a")
+	assert.Equal(t, status, http.StatusOK, "Event flushed.")
+	assert.Equal(t, body, "{\n  \"flushed\": 1\n}\n", "Flushed count.")
+	assert.Equal(t, strings.Contains(logs.String(), `"request_id":"a"`), true, "Event written.")
+	assert.Equal(t, ece.Pending(), 2, "Rest still pending.")
+
+	status, _ = adminRequest(ece, http.MethodPost, "/flush/a")
+	assert.Equal(t, status, http.StatusNotFound, "Already flushed.")
+
+	status, body = adminRequest(ece, http.MethodPost, "/flush")
+	assert.Equal(t, status, http.StatusOK, "All flushed.")
+	assert.Equal(t, body, "{\n  \"flushed\": 2\n}\n", "Flushed count.")
+	assert.Equal(t, ece.Pending(), 0, "Nothing pending.")
+}
@@ -0,0 +1,208 @@
+package ece
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BATCH_QUEUE the number of full batches waiting to be sent before further batches are shelved
+const BATCH_QUEUE = 16
+
+// BACKOFF_MIN the wait before the first retry of a failed send.  It doubles with every retry.
+const BACKOFF_MIN = 100 * time.Millisecond
+
+// batcher collects events into batches for a sink, and sends them on a single goroutine of its own, so writers never wait on the destination.  A batch is sent once it has size events, or interval after the last was cut.
+type batcher struct {
+	size     int
+	interval time.Duration
+
+	// send delivers a batch.  Only ever called from the batcher's goroutine.
+	send func(batch []OutputEvent) error
+
+	// shelve takes batches that can't be sent, either because the queue is full or the batcher is closing.  If nil they're dropped.
+	shelve func(batch []OutputEvent)
+
+	// idle is called on ticks with nothing to send.  May be nil.
+	idle func()
+
+	mutex   sync.Mutex
+	batch   []OutputEvent
+	queue   chan []OutputEvent
+	flushes chan chan error
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newBatcher creates a batcher.  Set shelve and idle if needed, then start it.
+func newBatcher(size int, interval time.Duration, send func(batch []OutputEvent) error) *batcher {
+	if size < 1 {
+		size = 1
+	}
+
+	return &batcher{
+		size:     size,
+		interval: interval,
+		send:     send,
+		queue:    make(chan []OutputEvent, BATCH_QUEUE),
+		flushes:  make(chan chan error),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start starts the sending goroutine
+func (b *batcher) start() {
+	go b.run()
+}
+
+// add adds the event to the current batch, queueing the batch if it's full
+func (b *batcher) add(event OutputEvent) {
+	b.mutex.Lock()
+	b.batch = append(b.batch, event)
+
+	var full []OutputEvent
+	if len(b.batch) >= b.size {
+		full = b.cut()
+	}
+	b.mutex.Unlock()
+
+	if full == nil {
+		return
+	}
+
+	select {
+	case b.queue <- full:
+	default:
+		// The destination isn't keeping up
+		b.shelveBatch(full)
+	}
+}
+
+// flush sends everything queued and the current batch, reporting how many batches failed
+func (b *batcher) flush() error {
+	result := make(chan error)
+
+	select {
+	case b.flushes <- result:
+		return <-result
+	case <-b.done:
+		return fmt.Errorf("sink closed")
+	}
+}
+
+// close stops the sending goroutine.  Anything unsent is shelved.
+func (b *batcher) close() {
+	close(b.stop)
+	<-b.done
+}
+
+// stopping is closed once the batcher starts closing, so senders can cut retries short
+func (b *batcher) stopping() <-chan struct{} {
+	return b.stop
+}
+
+// cut takes the current batch and starts a new one.  Must be called with the lock held.
+func (b *batcher) cut() (batch []OutputEvent) {
+	batch = b.batch
+	b.batch = nil
+
+	return batch
+}
+
+// current takes the current batch
+func (b *batcher) current() []OutputEvent {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.cut()
+}
+
+// queued takes every batch waiting in the queue
+func (b *batcher) queued() (batches [][]OutputEvent) {
+	for {
+		select {
+		case batch := <-b.queue:
+			batches = append(batches, batch)
+		default:
+			return batches
+		}
+	}
+}
+
+func (b *batcher) shelveBatch(batch []OutputEvent) {
+	if b.shelve != nil && len(batch) > 0 {
+		b.shelve(batch)
+	}
+}
+
+// drain sends everything queued and the current batch, and reports how many batches failed
+func (b *batcher) drain() (err error) {
+	failed := 0
+
+	for _, batch := range append(b.queued(), b.current()) {
+		if len(batch) > 0 && b.send(batch) != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		err = fmt.Errorf("%d batches failed", failed)
+	}
+
+	return err
+}
+
+// run sends batches until the batcher is closed
+func (b *batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case batch := <-b.queue:
+			_ = b.send(batch)
+
+		case <-ticker.C:
+			batch := b.current()
+			if len(batch) > 0 {
+				_ = b.send(batch)
+			} else if b.idle != nil {
+				b.idle()
+			}
+
+		case result := <-b.flushes:
+			result <- b.drain()
+
+		case <-b.stop:
+			for _, batch := range append(b.queued(), b.current()) {
+				b.shelveBatch(batch)
+			}
+			return
+		}
+	}
+}
+
+// retry calls attempt until it succeeds, fails for good, or has been retried retries times, backing off exponentially between attempts.  The backoff is cut short once stop is closed, returning the last error.
+func retry(retries int, stop <-chan struct{}, attempt func() (again bool, err error)) (err error) {
+	backoff := BACKOFF_MIN
+
+	for i := 0; ; i++ {
+		var again bool
+
+		again, err = attempt()
+		if err == nil || !again || i >= retries {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return err
+		}
+
+		backoff *= 2
+	}
+}
@@ -0,0 +1,608 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
+	"time"
+)
+
+// CONFIG_ENV_PREFIX prefixes the environment variable for each setting, e.g. ECE_KAFKA_BROKERS for kafka-brokers
+const CONFIG_ENV_PREFIX = "ECE"
+
+// CONFIG_NAME the config file looked for in the home directory when none is given, as .ece.yaml, .ece.toml or .ece.json
+const CONFIG_NAME = ".ece"
+
+// Config every setting of the run command.  Each is a flag of the same name, a key in the config file, and an environment variable named for the key, uppercased with dashes as underscores and prefixed with ECE_, e.g. kafka-brokers and ECE_KAFKA_BROKERS.  A flag given on the command line wins over the environment, which wins over the config file, which wins over the defaults.  See LoadConfig.
+type Config struct {
+	// File the config file read, if any
+	File string `mapstructure:"-"`
+
+	Address      string   `mapstructure:"address"`
+	TTL          int      `mapstructure:"ttl"`
+	Debug        bool     `mapstructure:"debug"`
+	Listen       []string `mapstructure:"listen"`
+	SyslogFormat string   `mapstructure:"syslog-format"`
+
+	// TLSCrtPath and TLSKeyPath the PEM cert and key for TLS and HTTPS listeners.  The address listens over TLS if both are set.
+	TLSCrtPath string `mapstructure:"tls-crt-path"`
+	TLSKeyPath string `mapstructure:"tls-key-path"`
+
+	// TLSCerts further certs and keys, as cert.pem:key.pem, chosen by SNI.  See ECE.TLSCerts.
+	TLSCerts []string `mapstructure:"tls-cert"`
+
+	HTTPServiceIds []string `mapstructure:"http-service-id"`
+	MetricsAddress string   `mapstructure:"metrics-address"`
+	AdminAddress   string   `mapstructure:"admin-address"`
+
+	LogFile      string `mapstructure:"logFile"`
+	LogSize      int    `mapstructure:"logSize"`
+	LogBackups   int    `mapstructure:"logBackups"`
+	LogAge       int    `mapstructure:"logAge"`
+	LogCompress  bool   `mapstructure:"logCompress"`
+	OutputFormat string `mapstructure:"output-format"`
+
+	Completion             string        `mapstructure:"completion"`
+	Grace                  time.Duration `mapstructure:"grace"`
+	MaxEvents              int           `mapstructure:"max-events"`
+	MaxBytes               int64         `mapstructure:"max-bytes"`
+	Overflow               string        `mapstructure:"overflow"`
+	DecodeBase64           []string      `mapstructure:"decode-base64"`
+	ShutdownTimeout        time.Duration `mapstructure:"shutdown-timeout"`
+	Journal                string        `mapstructure:"journal"`
+	JournalCompactInterval time.Duration `mapstructure:"journal-compact-interval"`
+
+	Forward          []string `mapstructure:"forward"`
+	ForwardBuffer    int      `mapstructure:"forward-buffer"`
+	ForwardFormat    string   `mapstructure:"forward-format"`
+	ForwardTLSCAPath string   `mapstructure:"forward-tls-ca-path"`
+
+	WebhookURL           string        `mapstructure:"webhook-url"`
+	WebhookFormat        string        `mapstructure:"webhook-format"`
+	WebhookHeaders       []string      `mapstructure:"webhook-header"`
+	WebhookToken         string        `mapstructure:"webhook-token"`
+	WebhookBatchSize     int           `mapstructure:"webhook-batch-size"`
+	WebhookBatchInterval time.Duration `mapstructure:"webhook-batch-interval"`
+	WebhookRetries       int           `mapstructure:"webhook-retries"`
+	WebhookSpillDir      string        `mapstructure:"webhook-spill-dir"`
+
+	ElasticURL           string        `mapstructure:"elastic-url"`
+	ElasticIndexPrefix   string        `mapstructure:"elastic-index-prefix"`
+	ElasticUsername      string        `mapstructure:"elastic-username"`
+	ElasticPassword      string        `mapstructure:"elastic-password"`
+	ElasticAPIKey        string        `mapstructure:"elastic-api-key"`
+	ElasticBatchSize     int           `mapstructure:"elastic-batch-size"`
+	ElasticBatchInterval time.Duration `mapstructure:"elastic-batch-interval"`
+	ElasticFormat        string        `mapstructure:"elastic-format"`
+
+	SplunkURL        string `mapstructure:"splunk-url"`
+	SplunkToken      string `mapstructure:"splunk-token"`
+	SplunkIndex      string `mapstructure:"splunk-index"`
+	SplunkSourcetype string `mapstructure:"splunk-sourcetype"`
+	SplunkSource     string `mapstructure:"splunk-source"`
+	SplunkGzip       bool   `mapstructure:"splunk-gzip"`
+	SplunkFormat     string `mapstructure:"splunk-format"`
+	SplunkAck        bool   `mapstructure:"splunk-ack"`
+	SplunkBatchSize  int    `mapstructure:"splunk-batch-size"`
+
+	KafkaBrokers     []string `mapstructure:"kafka-brokers"`
+	KafkaTopic       string   `mapstructure:"kafka-topic"`
+	KafkaKey         string   `mapstructure:"kafka-key"`
+	KafkaAcks        string   `mapstructure:"kafka-acks"`
+	KafkaCompression string   `mapstructure:"kafka-compression"`
+	KafkaDeadLetter  string   `mapstructure:"kafka-dead-letter"`
+	KafkaFormat      string   `mapstructure:"kafka-format"`
+}
+
+// DefaultConfig the settings used when nothing else is given
+func DefaultConfig() Config {
+	return Config{
+		TTL:          20,
+		Listen:       []string{},
+		SyslogFormat: SYSLOG_FORMAT_RFC5424,
+		TLSCerts:     []string{},
+
+		HTTPServiceIds: []string{},
+
+		LogFile:      "/var/log/fastly-waf-ece/events.log",
+		LogSize:      500,
+		LogBackups:   5,
+		LogAge:       28,
+		OutputFormat: FORMAT_JSON,
+
+		Completion:             COMPLETION_TTL,
+		Grace:                  time.Second,
+		Overflow:               OVERFLOW_EVICT_OLDEST,
+		DecodeBase64:           []string{},
+		ShutdownTimeout:        10 * time.Second,
+		JournalCompactInterval: time.Minute,
+
+		Forward:       []string{},
+		ForwardBuffer: FORWARD_BUFFER_DEFAULT,
+		ForwardFormat: FORMAT_JSON,
+
+		WebhookFormat:        WEBHOOK_FORMAT_JSON,
+		WebhookHeaders:       []string{},
+		WebhookBatchSize:     WEBHOOK_BATCH_SIZE_DEFAULT,
+		WebhookBatchInterval: WEBHOOK_BATCH_INTERVAL_DEFAULT,
+		WebhookRetries:       WEBHOOK_RETRIES_DEFAULT,
+
+		ElasticIndexPrefix:   ELASTIC_INDEX_PREFIX_DEFAULT,
+		ElasticBatchSize:     ELASTIC_BATCH_SIZE_DEFAULT,
+		ElasticBatchInterval: ELASTIC_BATCH_INTERVAL_DEFAULT,
+		ElasticFormat:        FORMAT_JSON,
+
+		SplunkSourcetype: SPLUNK_SOURCETYPE_DEFAULT,
+		SplunkSource:     SPLUNK_SOURCE_DEFAULT,
+		SplunkBatchSize:  SPLUNK_BATCH_SIZE_DEFAULT,
+		SplunkFormat:     FORMAT_JSON,
+
+		KafkaBrokers:     []string{},
+		KafkaTopic:       KAFKA_TOPIC_DEFAULT,
+		KafkaKey:         KAFKA_KEY_SERVICE_ID,
+		KafkaAcks:        KAFKA_ACKS_ALL,
+		KafkaCompression: "none",
+		KafkaFormat:      FORMAT_JSON,
+	}
+}
+
+// AddFlags defines a flag for every setting, defaulting to DefaultConfig
+func AddFlags(flags *pflag.FlagSet) {
+	d := DefaultConfig()
+
+	flags.StringP("address", "a", d.Address, "address to listen upon")
+	flags.IntP("ttl", "t", d.TTL, "Time to wait for messages before flushing them downstream")
+	flags.BoolP("debug", "d", d.Debug, "Debug.  Echos incoming logs to STEDERR")
+	flags.StringSlice("listen", d.Listen, "additional listeners as network://address, where network is one of tcp, tls, udp, unixgram, http or https.  May be repeated.")
+	flags.String("syslog-format", d.SyslogFormat, "syslog format for listeners that don't set ?format=.  One of rfc5424, rfc3164, rfc6587 (octet counted) or automatic.")
+	flags.String("tls-crt-path", d.TLSCrtPath, "PEM cert for the tls and https listeners.  With tls-key-path, the address listens over TLS too.")
+	flags.String("tls-key-path", d.TLSKeyPath, "PEM key for the tls and https listeners")
+	flags.StringSlice("tls-cert", d.TLSCerts, "Another PEM cert and key for the tls and https listeners, as cert.pem:key.pem, served to clients asking for one of the cert's names by SNI.  May be repeated.")
+	flags.StringSlice("http-service-id", d.HTTPServiceIds, "Fastly service id allowed to log to the http(s) listeners.  May be repeated.  Any service is allowed if unset.")
+	flags.String("metrics-address", d.MetricsAddress, "Address to serve Prometheus metrics on, at /metrics, e.g. :9102.  Disabled if unset.")
+	flags.String("admin-address", d.AdminAddress, "Address to serve the admin API on, e.g. 127.0.0.1:9103: health and readiness checks, pending events and flushing.  Disabled if unset.")
+
+	flags.StringP("logFile", "l", d.LogFile, "Log file path")
+	flags.IntP("logSize", "s", d.LogSize, "max log file size")
+	flags.IntP("logBackups", "b", d.LogBackups, "max log file backups")
+	flags.IntP("logAge", "g", d.LogAge, "max log file age")
+	flags.BoolP("logCompress", "c", d.LogCompress, "Compress logs")
+	flags.String("output-format", d.OutputFormat, "Format of the output log: json, typed, cef, leef, ecs or ocsf")
+
+	flags.String("completion", d.Completion, "When to consider an event complete.  'ttl' waits out the TTL, 'request' flushes a grace period after the req entry arrives.")
+	flags.Duration("grace", d.Grace, "How long to wait for stragglers after the req entry arrives, with --completion request")
+	flags.Int("max-events", d.MaxEvents, "Max events to hold pending at once.  0 is unlimited.")
+	flags.Int64("max-bytes", d.MaxBytes, "Max raw message bytes to hold in pending events at once.  0 is unlimited.")
+	flags.String("overflow", d.Overflow, "What to do with a new event when --max-events or --max-bytes is reached.  One of evict-oldest, drop-new or drop-waf-only.")
+	flags.StringSlice("decode-base64", d.DecodeBase64, "Request fields to base64 decode in the output, keeping the encoded values under originals, e.g. req_uri,req_h_user_agent if the logging VCL encodes them.  None by default.")
+	flags.Duration("shutdown-timeout", d.ShutdownTimeout, "How long to spend flushing pending events on SIGTERM or SIGINT before giving up")
+	flags.String("journal", d.Journal, "Journal accepted messages to this file, so pending events survive a restart or crash.  Disabled if unset.")
+	flags.Duration("journal-compact-interval", d.JournalCompactInterval, "How often to drop written events from the journal")
+
+	flags.StringSlice("forward", d.Forward, "Also forward events to a syslog collector as RFC5424, given as network://host:port where network is one of tcp, tls or udp.  May be repeated.")
+	flags.Int("forward-buffer", d.ForwardBuffer, "Max events to hold per collector while it's unreachable.  The oldest are dropped beyond this.")
+	flags.String("forward-format", d.ForwardFormat, "Format of forwarded messages: json, typed, cef, leef, ecs or ocsf")
+	flags.String("forward-tls-ca-path", d.ForwardTLSCAPath, "PEM bundle of CAs to trust when forwarding over TLS.  The system roots if unset.")
+
+	flags.String("webhook-url", d.WebhookURL, "Also POST events in batches to this URL")
+	flags.String("webhook-format", d.WebhookFormat, "Webhook batch format.  One of json (an array of events), ndjson, or typed, cef, leef, ecs or ocsf, one event per line.")
+	flags.StringSlice("webhook-header", d.WebhookHeaders, "Extra header for webhook requests, as 'Name: value'.  May be repeated.")
+	flags.String("webhook-token", d.WebhookToken, "Bearer token for webhook requests.  Best set in the config file.")
+	flags.Int("webhook-batch-size", d.WebhookBatchSize, "Max events per webhook request")
+	flags.Duration("webhook-batch-interval", d.WebhookBatchInterval, "Max time to hold a partial webhook batch")
+	flags.Int("webhook-retries", d.WebhookRetries, "Times to retry a webhook batch that fails with a 5xx or network error")
+	flags.String("webhook-spill-dir", d.WebhookSpillDir, "Dir to queue webhook batches in while the endpoint is down.  They're dropped if unset.")
+
+	flags.String("elastic-url", d.ElasticURL, "Also index events into the Elasticsearch or OpenSearch cluster at this URL")
+	flags.String("elastic-index-prefix", d.ElasticIndexPrefix, "Events are indexed daily into <prefix>-YYYY.MM.DD")
+	flags.String("elastic-username", d.ElasticUsername, "Username for basic auth to the cluster")
+	flags.String("elastic-password", d.ElasticPassword, "Password for basic auth to the cluster.  Best set in the config file.")
+	flags.String("elastic-api-key", d.ElasticAPIKey, "API key for the cluster, instead of basic auth.  Best set in the config file.")
+	flags.Int("elastic-batch-size", d.ElasticBatchSize, "Max events per bulk request")
+	flags.Duration("elastic-batch-interval", d.ElasticBatchInterval, "Max time to hold a partial bulk request")
+	flags.String("elastic-format", d.ElasticFormat, "Schema of indexed documents: json, typed, ecs or ocsf")
+
+	flags.String("splunk-url", d.SplunkURL, "Also send events to the Splunk HTTP Event Collector at this URL, e.g. https://splunk.example.com:8088")
+	flags.String("splunk-token", d.SplunkToken, "HEC token.  Best set in the config file.")
+	flags.String("splunk-index", d.SplunkIndex, "Splunk index for events.  The token's default index if unset.")
+	flags.String("splunk-sourcetype", d.SplunkSourcetype, "Splunk sourcetype for events")
+	flags.String("splunk-source", d.SplunkSource, "Splunk source for events")
+	flags.Bool("splunk-gzip", d.SplunkGzip, "Gzip requests to the HEC")
+	flags.String("splunk-format", d.SplunkFormat, "Format of HEC events: json, or typed, cef, leef, ecs or ocsf, sent as a string")
+	flags.Bool("splunk-ack", d.SplunkAck, "Wait for Splunk to acknowledge indexing each batch, resending it if it doesn't.  Requires indexer acknowledgement on the token.")
+	flags.Int("splunk-batch-size", d.SplunkBatchSize, "Max events per HEC request")
+
+	flags.StringSlice("kafka-brokers", d.KafkaBrokers, "Also produce events to the Kafka cluster with these brokers, e.g. kafka1:9092,kafka2:9092")
+	flags.String("kafka-topic", d.KafkaTopic, "Kafka topic for events")
+	flags.String("kafka-key", d.KafkaKey, "Event field to key messages by, so partitions keep its events in order: service_id or client_ip")
+	flags.String("kafka-acks", d.KafkaAcks, "Replica acknowledgements required for each message: none, leader or all")
+	flags.String("kafka-compression", d.KafkaCompression, "Message compression: none, gzip, snappy, lz4 or zstd")
+	flags.String("kafka-dead-letter", d.KafkaDeadLetter, "File to append events Kafka couldn't take to, as JSON lines")
+	flags.String("kafka-format", d.KafkaFormat, "Format of Kafka messages: json, typed, cef, leef, ecs or ocsf")
+}
+
+// LoadConfig reads the settings from the flags, the environment and the config file at path, in that order of precedence, and validates them.  If path is empty, ~/.ece.yaml (or .toml, or .json) is read if it exists.
+func LoadConfig(flags *pflag.FlagSet, path string) (config Config, err error) {
+	v := viper.New()
+
+	err = v.BindPFlags(flags)
+	if err != nil {
+		err = errors.Wrap(err, "failed to bind flags")
+		return config, err
+	}
+
+	v.SetEnvPrefix(CONFIG_ENV_PREFIX)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	if path != "" {
+		v.SetConfigFile(path)
+
+		err = v.ReadInConfig()
+		if err != nil {
+			err = errors.Wrapf(err, "failed to read config file %s", path)
+			return config, err
+		}
+	} else if home, homeErr := homedir.Dir(); homeErr == nil {
+		v.AddConfigPath(home)
+		v.SetConfigName(CONFIG_NAME)
+
+		err = v.ReadInConfig()
+		if _, missing := err.(viper.ConfigFileNotFoundError); missing {
+			err = nil
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "failed to read config file %s", v.ConfigFileUsed())
+			return config, err
+		}
+	}
+
+	err = v.Unmarshal(&config)
+	if err != nil {
+		err = errors.Wrap(err, "failed to parse settings")
+		return config, err
+	}
+
+	config.File = v.ConfigFileUsed()
+
+	return config, config.Validate()
+}
+
+// Validate checks every setting, returning an error listing each problem found
+func (c Config) Validate() error {
+	problems := []string{}
+
+	check := func(key string, err error) {
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+
+	positive := func(key string, n int64) {
+		if n <= 0 {
+			check(key, fmt.Errorf("must be more than 0, not %d", n))
+		}
+	}
+
+	notNegative := func(key string, n int64) {
+		if n < 0 {
+			check(key, fmt.Errorf("can't be negative, not %d", n))
+		}
+	}
+
+	file := func(key string, path string) {
+		if path == "" {
+			return
+		}
+
+		_, err := os.Stat(path)
+		check(key, err)
+	}
+
+	oneOf := func(key string, value string, allowed ...string) {
+		for _, a := range allowed {
+			if strings.EqualFold(value, a) {
+				return
+			}
+		}
+
+		check(key, fmt.Errorf("unsupported value %q.  Must be one of %s", value, strings.Join(allowed, ", ")))
+	}
+
+	formatter := func(key string, name string) {
+		_, err := NewFormatter(name)
+		check(key, err)
+	}
+
+	positive("ttl", int64(c.TTL))
+
+	listeners, err := ParseListeners(c.Listen)
+	check("listen", err)
+
+	if c.Address == "" && len(c.Listen) == 0 {
+		check("address", errors.New("either address or listen is needed to receive anything"))
+	}
+
+	_, err = syslogFormat(c.SyslogFormat)
+	check("syslog-format", err)
+
+	if (c.TLSCrtPath == "") != (c.TLSKeyPath == "") {
+		check("tls-crt-path", errors.New("tls-crt-path and tls-key-path must be set together"))
+	}
+	file("tls-crt-path", c.TLSCrtPath)
+	file("tls-key-path", c.TLSKeyPath)
+
+	for _, spec := range c.TLSCerts {
+		pair, err := ParseTLSPair(spec)
+		check("tls-cert", err)
+		file("tls-cert", pair.CrtPath)
+		file("tls-cert", pair.KeyPath)
+	}
+
+	for _, listener := range listeners {
+		if (listener.Network == LISTENER_TLS || listener.Network == LISTENER_HTTPS) && c.TLSCrtPath == "" && len(c.TLSCerts) == 0 {
+			check("listen", fmt.Errorf("%s needs tls-crt-path and tls-key-path, or tls-cert", listener))
+		}
+	}
+
+	notNegative("logSize", int64(c.LogSize))
+	notNegative("logBackups", int64(c.LogBackups))
+	notNegative("logAge", int64(c.LogAge))
+	formatter("output-format", c.OutputFormat)
+
+	oneOf("completion", c.Completion, COMPLETION_TTL, COMPLETION_REQUEST)
+	notNegative("grace", int64(c.Grace))
+	notNegative("max-events", int64(c.MaxEvents))
+	notNegative("max-bytes", c.MaxBytes)
+	check("overflow", validOverflow(c.Overflow))
+	check("decode-base64", validDecodeFields(c.DecodeBase64))
+	positive("shutdown-timeout", int64(c.ShutdownTimeout))
+	positive("journal-compact-interval", int64(c.JournalCompactInterval))
+
+	for _, spec := range c.Forward {
+		_, _, err = ParseForward(spec)
+		check("forward", err)
+	}
+	notNegative("forward-buffer", int64(c.ForwardBuffer))
+	formatter("forward-format", c.ForwardFormat)
+	file("forward-tls-ca-path", c.ForwardTLSCAPath)
+
+	oneOf("webhook-format", c.WebhookFormat, WEBHOOK_FORMAT_JSON, WEBHOOK_FORMAT_NDJSON, FORMAT_TYPED, FORMAT_CEF, FORMAT_LEEF, FORMAT_ECS, FORMAT_OCSF)
+	for _, spec := range c.WebhookHeaders {
+		_, _, err = ParseWebhookHeader(spec)
+		check("webhook-header", err)
+	}
+	positive("webhook-batch-size", int64(c.WebhookBatchSize))
+	positive("webhook-batch-interval", int64(c.WebhookBatchInterval))
+	notNegative("webhook-retries", int64(c.WebhookRetries))
+
+	positive("elastic-batch-size", int64(c.ElasticBatchSize))
+	positive("elastic-batch-interval", int64(c.ElasticBatchInterval))
+	oneOf("elastic-format", c.ElasticFormat, FORMAT_JSON, FORMAT_TYPED, FORMAT_ECS, FORMAT_OCSF)
+
+	if c.SplunkURL != "" && c.SplunkToken == "" {
+		check("splunk-token", errors.New("needed with splunk-url"))
+	}
+	positive("splunk-batch-size", int64(c.SplunkBatchSize))
+	formatter("splunk-format", c.SplunkFormat)
+
+	if len(c.KafkaBrokers) > 0 && c.KafkaTopic == "" {
+		check("kafka-topic", errors.New("needed with kafka-brokers"))
+	}
+	oneOf("kafka-key", c.KafkaKey, KAFKA_KEY_SERVICE_ID, KAFKA_KEY_CLIENT_IP)
+	_, err = ParseKafkaAcks(c.KafkaAcks)
+	check("kafka-acks", err)
+	_, err = ParseKafkaCompression(c.KafkaCompression)
+	check("kafka-compression", err)
+	formatter("kafka-format", c.KafkaFormat)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d problems with the config:\n  %s", len(problems), strings.Join(problems, "\n  "))
+}
+
+// NewECE creates an ECE as configured, with its sinks started.  Start it to begin listening.
+func (c Config) NewECE() (engine *ECE, err error) {
+	err = c.Validate()
+	if err != nil {
+		return engine, err
+	}
+
+	// The sinks, the FileSink among them, are built from the config below
+	engine = newECE(time.Duration(c.TTL)*time.Second, c.Address)
+	engine.Debug = c.Debug
+	engine.Format = c.SyslogFormat
+	engine.TLSCrtPath = c.TLSCrtPath
+	engine.TLSKeyPath = c.TLSKeyPath
+	engine.HTTPServiceIds = c.HTTPServiceIds
+	engine.MetricsAddress = c.MetricsAddress
+	engine.AdminAddress = c.AdminAddress
+	engine.Completion = c.Completion
+	engine.Grace = c.Grace
+	engine.MaxEvents = c.MaxEvents
+	engine.MaxBytes = c.MaxBytes
+	engine.Overflow = c.Overflow
+	engine.DecodeFields = c.DecodeBase64
+	engine.JournalPath = c.Journal
+	engine.JournalCompactInterval = c.JournalCompactInterval
+
+	engine.Listeners, err = ParseListeners(c.Listen)
+	if err != nil {
+		return engine, err
+	}
+
+	for _, spec := range c.TLSCerts {
+		pair, err := ParseTLSPair(spec)
+		if err != nil {
+			return engine, err
+		}
+
+		engine.TLSCerts = append(engine.TLSCerts, pair)
+	}
+
+	engine.Sinks, err = c.sinks()
+	engine.config = &c
+
+	return engine, err
+}
+
+// sinks creates and starts every configured sink.  If one fails, those already started are closed.
+func (c Config) sinks() (sinks []Sink, err error) {
+	defer func() {
+		if err != nil {
+			_ = multiSink(sinks).Close()
+			sinks = nil
+		}
+	}()
+
+	fileSink := NewFileSink(c.LogFile, c.LogSize, c.LogBackups, c.LogAge, c.LogCompress)
+	fileSink.Formatter, err = NewFormatter(c.OutputFormat)
+	if err != nil {
+		return sinks, err
+	}
+	sinks = append(sinks, fileSink)
+
+	if len(c.Forward) > 0 {
+		forwardFormatter, err := NewFormatter(c.ForwardFormat)
+		if err != nil {
+			return sinks, err
+		}
+
+		tlsConfig, err := forwardTLSConfig(c.ForwardTLSCAPath)
+		if err != nil {
+			return sinks, err
+		}
+
+		for _, spec := range c.Forward {
+			network, collector, err := ParseForward(spec)
+			if err != nil {
+				return sinks, err
+			}
+
+			sink, err := NewSyslogSink(network, collector, tlsConfig, c.ForwardBuffer)
+			if err != nil {
+				err = errors.Wrapf(err, "failed to set up forwarding to %s", spec)
+				return sinks, err
+			}
+
+			sink.Formatter = forwardFormatter
+			sinks = append(sinks, sink)
+		}
+	}
+
+	if c.WebhookURL != "" {
+		sink := NewWebhookSink(c.WebhookURL)
+		sink.Format = strings.ToLower(c.WebhookFormat)
+
+		// Any other format is one event per line
+		if sink.Format != WEBHOOK_FORMAT_JSON && sink.Format != WEBHOOK_FORMAT_NDJSON {
+			sink.Format = WEBHOOK_FORMAT_NDJSON
+			sink.Formatter, err = NewFormatter(c.WebhookFormat)
+			if err != nil {
+				return sinks, err
+			}
+		}
+		sink.BearerToken = c.WebhookToken
+		sink.BatchSize = c.WebhookBatchSize
+		sink.BatchInterval = c.WebhookBatchInterval
+		sink.Retries = c.WebhookRetries
+		sink.SpillDir = c.WebhookSpillDir
+
+		for _, spec := range c.WebhookHeaders {
+			name, value, err := ParseWebhookHeader(spec)
+			if err != nil {
+				return sinks, err
+			}
+
+			sink.Header.Add(name, value)
+		}
+
+		err = sink.Start()
+		if err != nil {
+			err = errors.Wrap(err, "failed to start webhook")
+			return sinks, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if c.ElasticURL != "" {
+		sink := NewElasticSink(c.ElasticURL)
+		sink.IndexPrefix = c.ElasticIndexPrefix
+		sink.Username = c.ElasticUsername
+		sink.Password = c.ElasticPassword
+		sink.APIKey = c.ElasticAPIKey
+		sink.BatchSize = c.ElasticBatchSize
+		sink.BatchInterval = c.ElasticBatchInterval
+
+		sink.Formatter, err = NewFormatter(c.ElasticFormat)
+		if err != nil {
+			return sinks, err
+		}
+
+		err = sink.Start()
+		if err != nil {
+			err = errors.Wrap(err, "failed to start elasticsearch output")
+			return sinks, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if c.SplunkURL != "" {
+		sink := NewSplunkSink(c.SplunkURL, c.SplunkToken)
+		sink.Index = c.SplunkIndex
+		sink.Sourcetype = c.SplunkSourcetype
+		sink.Source = c.SplunkSource
+		sink.Gzip = c.SplunkGzip
+		sink.Ack = c.SplunkAck
+		sink.BatchSize = c.SplunkBatchSize
+
+		sink.Formatter, err = NewFormatter(c.SplunkFormat)
+		if err != nil {
+			return sinks, err
+		}
+
+		err = sink.Start()
+		if err != nil {
+			err = errors.Wrap(err, "failed to start splunk output")
+			return sinks, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(c.KafkaBrokers) > 0 {
+		sink := NewKafkaSink(c.KafkaBrokers)
+		sink.Topic = c.KafkaTopic
+		sink.Key = c.KafkaKey
+		sink.DeadLetterPath = c.KafkaDeadLetter
+
+		sink.Formatter, err = NewFormatter(c.KafkaFormat)
+		if err != nil {
+			return sinks, err
+		}
+
+		sink.RequiredAcks, err = ParseKafkaAcks(c.KafkaAcks)
+		if err != nil {
+			return sinks, err
+		}
+
+		sink.Compression, err = ParseKafkaCompression(c.KafkaCompression)
+		if err != nil {
+			return sinks, err
+		}
+
+		err = sink.Start()
+		if err != nil {
+			err = errors.Wrap(err, "failed to start kafka output")
+			return sinks, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, err
+}
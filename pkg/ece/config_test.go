@@ -0,0 +1,239 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFlags the run command's flags, parsed from args
+func testFlags(t *testing.T, args ...string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	AddFlags(flags)
+
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatalf("failed to parse flags: %s", err)
+	}
+
+	return flags
+}
+
+// testConfigFile writes a config file with the given name and contents, returning its path
+func testConfigFile(t *testing.T, dir string, name string, contents string) string {
+	path := filepath.Join(dir, name)
+
+	err := ioutil.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatalf("failed writing %s: %s", path, err)
+	}
+
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-config")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	inputs := []struct {
+		name     string
+		contents string
+	}{
+		{
+			"ece.yaml",
+			`
+address: 127.0.0.1:8514
+ttl: 30
+listen:
+  - udp://:514
+  - http://:8080
+grace: 2s
+kafka-brokers: [kafka1:9092, kafka2:9092]
+logFile: /tmp/ece.log
+`,
+		},
+		{
+			"ece.toml",
+			`
+address = "127.0.0.1:8514"
+ttl = 30
+listen = ["udp://:514", "http://:8080"]
+grace = "2s"
+kafka-brokers = ["kafka1:9092", "kafka2:9092"]
+logFile = "/tmp/ece.log"
+`,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			path := testConfigFile(t, dir, tc.name, tc.contents)
+
+			config, err := LoadConfig(testFlags(t), path)
+			if err != nil {
+				t.Fatalf("failed to load config: %s", err)
+			}
+
+			assert.Equal(t, config.File, path, "Config file recorded.")
+			assert.Equal(t, config.Address, "127.0.0.1:8514", "Address read.")
+			assert.Equal(t, config.TTL, 30, "TTL read.")
+			assert.Equal(t, config.Listen, []string{"udp://:514", "http://:8080"}, "Listeners read.")
+			assert.Equal(t, config.Grace, 2*time.Second, "Grace read.")
+			assert.Equal(t, config.KafkaBrokers, []string{"kafka1:9092", "kafka2:9092"}, "Brokers read.")
+			assert.Equal(t, config.LogFile, "/tmp/ece.log", "Legacy camel case key read.")
+			assert.Equal(t, config.LogSize, DefaultConfig().LogSize, "Default kept.")
+			assert.Equal(t, config.Overflow, OVERFLOW_EVICT_OLDEST, "Default kept.")
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := LoadConfig(testFlags(t), filepath.Join(dir, "missing.yaml"))
+		assert.Equal(t, err != nil, true, "Missing config file refused.")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		path := testConfigFile(t, dir, "invalid.yaml", "address: :8514\noverflow: explode\nttl: 0\n")
+
+		_, err := LoadConfig(testFlags(t), path)
+		assert.Equal(t, err != nil, true, "Invalid config refused.")
+		assert.Equal(t, strings.HasPrefix(err.Error(), "2 problems with the config"), true, fmt.Sprintf("Problems counted: %s", err))
+		assert.Equal(t, strings.Contains(err.Error(), "overflow: "), true, "Overflow named.")
+		assert.Equal(t, strings.Contains(err.Error(), "ttl: "), true, "TTL named.")
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-config")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := testConfigFile(t, dir, "ece.yaml", "address: :1111\nttl: 30\nmax-events: 100\nkafka-topic: from-file\n")
+
+	for name, value := range map[string]string{
+		"ECE_TTL":           "40",
+		"ECE_MAX_EVENTS":    "200",
+		"ECE_KAFKA_BROKERS": "a:9092,b:9092",
+	} {
+		_ = os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	config, err := LoadConfig(testFlags(t, "--ttl", "50"), path)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err)
+	}
+
+	assert.Equal(t, config.TTL, 50, "Flag beats the environment.")
+	assert.Equal(t, config.MaxEvents, 200, "Environment beats the file.")
+	assert.Equal(t, config.KafkaBrokers, []string{"a:9092", "b:9092"}, "Lists split from the environment.")
+	assert.Equal(t, config.KafkaTopic, "from-file", "File beats the defaults.")
+	assert.Equal(t, config.Address, ":1111", "File read.")
+	assert.Equal(t, config.ForwardBuffer, FORWARD_BUFFER_DEFAULT, "Defaults kept.")
+	assert.Equal(t, len(config.DecodeBase64), 0, "Nothing decoded unless asked.")
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := DefaultConfig()
+	valid.Address = ":8514"
+	valid.TLSCrtPath = ""
+	valid.TLSKeyPath = ""
+
+	inputs := []struct {
+		name    string
+		change  func(c *Config)
+		problem string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"no address", func(c *Config) { c.Address = "" }, "address: "},
+		{"listener only", func(c *Config) { c.Address = ""; c.Listen = []string{"udp://:514"} }, ""},
+		{"bad listener", func(c *Config) { c.Listen = []string{"sctp://:514"} }, "listen: "},
+		{"tls without cert", func(c *Config) { c.Listen = []string{"tls://:6514"} }, "listen: "},
+		{"cert without key", func(c *Config) { c.TLSCrtPath = "/etc/ece/cert.pem" }, "tls-crt-path: "},
+		{"missing cert", func(c *Config) { c.TLSCrtPath = "/nonexistent/cert.pem"; c.TLSKeyPath = "/nonexistent/key.pem" }, "tls-key-path: "},
+		{"bad tls cert", func(c *Config) { c.TLSCerts = []string{"/etc/ece/cert.pem"} }, "tls-cert: "},
+		{"missing tls cert", func(c *Config) { c.TLSCerts = []string{"/nonexistent/cert.pem:/nonexistent/key.pem"} }, "tls-cert: "},
+		{"zero ttl", func(c *Config) { c.TTL = 0 }, "ttl: "},
+		{"syslog format", func(c *Config) { c.SyslogFormat = "rfc1" }, "syslog-format: "},
+		{"output format", func(c *Config) { c.OutputFormat = "xml" }, "output-format: "},
+		{"completion", func(c *Config) { c.Completion = "never" }, "completion: "},
+		{"negative grace", func(c *Config) { c.Grace = -time.Second }, "grace: "},
+		{"overflow", func(c *Config) { c.Overflow = "explode" }, "overflow: "},
+		{"decode field", func(c *Config) { c.DecodeBase64 = []string{"nope"} }, "decode-base64: "},
+		{"shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "shutdown-timeout: "},
+		{"forward", func(c *Config) { c.Forward = []string{"tls://collector"} }, "forward: "},
+		{"missing ca", func(c *Config) { c.ForwardTLSCAPath = "/nonexistent/ca.pem" }, "forward-tls-ca-path: "},
+		{"webhook header", func(c *Config) { c.WebhookHeaders = []string{"no colon"} }, "webhook-header: "},
+		{"webhook format", func(c *Config) { c.WebhookFormat = "xml" }, "webhook-format: "},
+		{"webhook cef", func(c *Config) { c.WebhookFormat = FORMAT_CEF }, ""},
+		{"splunk format", func(c *Config) { c.SplunkFormat = "xml" }, "splunk-format: "},
+		{"elastic format", func(c *Config) { c.ElasticFormat = FORMAT_CEF }, "elastic-format: "},
+		{"splunk token", func(c *Config) { c.SplunkURL = "https://splunk:8088" }, "splunk-token: "},
+		{"kafka acks", func(c *Config) { c.KafkaAcks = "some" }, "kafka-acks: "},
+		{"kafka key", func(c *Config) { c.KafkaKey = "host" }, "kafka-key: "},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			config := valid
+			tc.change(&config)
+
+			err := config.Validate()
+			if tc.problem == "" {
+				assert.Equal(t, err, nil, "Config is valid.")
+				return
+			}
+
+			assert.Equal(t, err != nil, true, "Config is invalid.")
+			assert.Equal(t, strings.Contains(err.Error(), tc.problem), true, fmt.Sprintf("Problem named: %s", err))
+		})
+	}
+}
+
+func TestConfigNewECE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-config")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig()
+	config.Address = ":8514"
+	config.TTL = 5
+	config.LogFile = filepath.Join(dir, "ece.log")
+	config.OutputFormat = FORMAT_CEF
+	config.Listen = []string{"udp://:514"}
+	config.MaxEvents = 10
+	config.Forward = []string{"udp://127.0.0.1:5514"}
+
+	engine, err := config.NewECE()
+	if err != nil {
+		t.Fatalf("failed to create ECE: %s", err)
+	}
+	defer multiSink(engine.Sinks).Close()
+
+	assert.Equal(t, engine.Ttl, 5*time.Second, "TTL set.")
+	assert.Equal(t, engine.Listeners, []Listener{{Network: LISTENER_UDP, Address: ":514"}}, "Listeners set.")
+	assert.Equal(t, engine.MaxEvents, 10, "Max events set.")
+	assert.Equal(t, len(engine.Sinks), 2, "File and syslog sinks.")
+	assert.Equal(t, sinkName(engine.Sinks[1]), "syslog", "Forwarding set up.")
+
+	fileSink, ok := engine.Sinks[0].(*FileSink)
+	assert.Equal(t, ok, true, "File sink first.")
+	assert.Equal(t, fileSink.Formatter, Formatter(CEFFormatter{}), "The configured file sink, not a default one.")
+
+	config.TTL = 0
+
+	_, err = config.NewECE()
+	assert.Equal(t, err != nil, true, "Invalid config refused.")
+}
@@ -0,0 +1,92 @@
+package ece
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// DECODE_FIELDS_FASTLY the request fields to decode for a logging VCL that base64 encodes them, as they may hold anything the client sent.  Nothing is decoded unless asked for, as a VCL that doesn't encode them would have values that happen to be valid base64 mangled.
+var DECODE_FIELDS_FASTLY = []string{"req_uri", "req_h_user_agent"}
+
+// decodableFields the index in OutputEvent of each string field taken from the req entry, by JSON name
+var decodableFields = func() map[string]int {
+	fields := make(map[string]int)
+
+	t := reflect.TypeOf(OutputEvent{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+
+		if field.Type.Kind() == reflect.String && name != "request_id" {
+			fields[name] = i
+		}
+	}
+
+	return fields
+}()
+
+// validDecodeFields checks that each field named is a request field that can be decoded
+func validDecodeFields(names []string) error {
+	for _, name := range names {
+		if _, ok := decodableFields[name]; !ok {
+			return fmt.Errorf("can't decode %q.  Must be a string field of the req entry, e.g. %s", name, strings.Join(DECODE_FIELDS_FASTLY, " or "))
+		}
+	}
+
+	return nil
+}
+
+// decodeBase64 decodes the value, padded or not, as long as the result is text
+func decodeBase64(value string) (decoded string, err error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		return value, errors.New("not base64")
+	}
+
+	if !utf8.Valid(b) {
+		return value, errors.New("decodes to binary, not text")
+	}
+
+	return string(b), err
+}
+
+// decodeFields base64 decodes the event's DecodeFields in place, keeping the encoded values in Originals.  A field that won't decode is left as it is, and the reason given in DecodeErrors.
+func (ece *ECE) decodeFields(event *OutputEvent) {
+	v := reflect.ValueOf(event).Elem()
+
+	ece.settings.RLock()
+	names := ece.DecodeFields
+	ece.settings.RUnlock()
+
+	for _, name := range names {
+		field := v.Field(decodableFields[name])
+
+		value := field.String()
+		if value == "" {
+			continue
+		}
+
+		decoded, err := decodeBase64(value)
+		if err != nil {
+			if event.DecodeErrors == nil {
+				event.DecodeErrors = make(map[string]string)
+			}
+			event.DecodeErrors[name] = err.Error()
+			continue
+		}
+
+		if event.Originals == nil {
+			event.Originals = make(map[string]string)
+		}
+		event.Originals[name] = value
+
+		field.SetString(decoded)
+	}
+}
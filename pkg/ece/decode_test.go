@@ -0,0 +1,81 @@
+package ece
+
+import (
+	"encoding/json"
+	"github.com/magiconair/properties/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeBase64(t *testing.T) {
+	inputs := []struct {
+		name    string
+		value   string
+		decoded string
+		ok      bool
+	}{
+		{"padded", "Zm9vLzEuMQo=", "foo/1.1\n", true},
+		{"unpadded", "Zm9vLzEuMQo", "foo/1.1\n", true},
+		{"not base64", "/index.html", "/index.html", false},
+		{"binary", "//79", "//79", false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			decoded, err := decodeBase64(tc.value)
+			assert.Equal(t, err == nil, tc.ok, "Error meets expectations.")
+			assert.Equal(t, decoded, tc.decoded, "Decoded value meets expectations.")
+		})
+	}
+}
+
+func TestValidDecodeFields(t *testing.T) {
+	assert.Equal(t, validDecodeFields(DECODE_FIELDS_FASTLY), nil, "Default fields valid.")
+	assert.Equal(t, validDecodeFields([]string{"req_h_host", "tls_cipher"}), nil, "Any request string field valid.")
+	assert.Equal(t, validDecodeFields([]string{"request_id"}) != nil, true, "Request id can't be decoded, as it's the key.")
+	assert.Equal(t, validDecodeFields([]string{"rule_ids"}) != nil, true, "Non-string fields can't be decoded.")
+}
+
+func TestDecodeFields(t *testing.T) {
+	logs := &testSink{}
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs}
+	ece.DecodeFields = append(DECODE_FIELDS_FASTLY, "req_h_host")
+
+	_ = ece.AddEvent(testWafEntryMessage())
+	_ = ece.AddEvent(testWebEntryMessage())
+
+	err := ece.WriteEvent(testWafEntry().RequestId)
+	if err != nil {
+		t.Fatalf("failed writing event: %s", err)
+	}
+
+	var event OutputEvent
+	_ = json.Unmarshal([]byte(logs.String()), &event)
+
+	assert.Equal(t, event.ReqURI, "/index.html\n", "URI decoded.")
+	assert.Equal(t, event.ReqHUserAgent, "foo/1.1\n", "User agent decoded.")
+	assert.Equal(t, event.Originals, map[string]string{
+		"req_uri":          testWebEntry().ReqURI,
+		"req_h_user_agent": testWebEntry().ReqHUserAgent,
+	}, "Encoded values kept.")
+
+	assert.Equal(t, event.ReqHHost, "api.scribd.com", "Field that isn't base64 left as it was.")
+	assert.Equal(t, event.DecodeErrors, map[string]string{"req_h_host": "not base64"}, "Decode failure reported.")
+	assert.Equal(t, event.ClientIp, testOutputEvent().ClientIp, "Rest of the event intact.")
+}
+
+func TestDecodeFieldsOff(t *testing.T) {
+	logs := &testSink{}
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs}
+
+	_ = ece.AddEvent(testWebEntryMessage())
+	_ = ece.WriteEvent(testWafEntry().RequestId)
+
+	assert.Equal(t, strings.Contains(logs.String(), `"req_uri":"L2luZGV4Lmh0bWwK"`), true, "Nothing decoded by default.")
+	assert.Equal(t, strings.Contains(logs.String(), "originals"), false, "No originals without decoding.")
+}
@@ -7,25 +7,43 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"gopkg.in/mcuadros/go-syslog.v2"
-	"gopkg.in/natefinch/lumberjack.v2"
 	"log"
+	"net/http"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ECE_TLS_CRT_PATH_ENV_VAR and ECE_TLS_KEY_PATH_ENV_VAR name the default TLS cert and key.  See ECE.TLSCrtPath.
 const ECE_TLS_CRT_PATH_ENV_VAR = "ECE_TLS_CRT_PATH"
 const ECE_TLS_KEY_PATH_ENV_VAR = "ECE_TLS_KEY_PATH"
 
+// COMPLETION_TTL holds every event for the full TTL
+const COMPLETION_TTL = "ttl"
+
+// COMPLETION_REQUEST flushes an event a short grace period after its req entry arrives.  Fastly sends the req entry after all of the request's waf entries, so there's nothing more to wait for.  Events that never see a req entry still wait out the TTL.
+const COMPLETION_REQUEST = "request"
+
 // Event Struct representing an entire firewall event, containing generally 1 web event and 0 or more waf events
 type Event struct {
-	mutex sync.Mutex
+	mutex   sync.Mutex
+	created time.Time
+	bytes   int
+	removed bool
 
 	WafEntries     []WafEntry
 	RequestEntries []RequestEntry
 }
 
+// addBytes records the size of a message added to the event, already counted in the ECE's pending bytes when room was made for it.  Must be called with the event's mutex held.
+func (e *Event) addBytes(n int) {
+	e.bytes += n
+}
+
 // WafEntry  a struct representing a Waf Log Entry
 type WafEntry struct {
 	EventType    string `json:"event_type"`
@@ -91,6 +109,7 @@ type OutputEvent struct {
 	ReqHeaderBytes       string      `json:"req_header_bytes"`
 	ReqBodyBytes         string      `json:"req_body_bytes"`
 	RuleIds              []int       `json:"rule_ids"`
+	InvalidRuleIds       []string    `json:"invalid_rule_ids,omitempty"`
 	WafLogged            string      `json:"waf_logged"`
 	WafBlocked           string      `json:"waf_blocked"`
 	WafFailures          string      `json:"waf_failures"`
@@ -113,6 +132,12 @@ type OutputEvent struct {
 	Throttled            int         `json:"throttled"`
 	TlsProtocol          string      `json:"tls_protocol"`
 	TlsCipher            string      `json:"tls_cipher"`
+
+	// Originals the base64 encoded values of fields that were decoded, by field
+	Originals map[string]string `json:"originals,omitempty"`
+
+	// DecodeErrors why fields that should have been decoded weren't, by field
+	DecodeErrors map[string]string `json:"decode_errors,omitempty"`
 }
 
 // OutputWaf is the output format for the waf event
@@ -126,73 +151,180 @@ type OutputWaf struct {
 
 // ECE The Event Correlation Engine itself
 type ECE struct {
-	sync.RWMutex
-	Events  map[string]*Event
-	logger  *log.Logger
+	// accessed atomically, and kept first for alignment
+	pendingBytes   int64
+	slots          int64
+	evicted        uint64
+	dropped        uint64
+	invalidRuleIds uint64
+	running        int32
+
+	events  *store
 	Ttl     time.Duration
 	Debug   bool
 	Address string
 
-	server *syslog.Server
+	// Completion the policy deciding when an event is complete.  One of COMPLETION_TTL (the default) or COMPLETION_REQUEST.
+	Completion string
+
+	// Grace how long to wait for stragglers once an event is complete, under COMPLETION_REQUEST
+	Grace time.Duration
+
+	// MaxEvents the most events to hold pending at once.  0 means no limit.
+	MaxEvents int
+
+	// MaxBytes the most raw message bytes to hold in pending events at once.  0 means no limit.
+	MaxBytes int64
+
+	// Overflow the policy applied when a message would take the pending events past MaxEvents or MaxBytes.  One of OVERFLOW_EVICT_OLDEST (the default), OVERFLOW_DROP_NEW or OVERFLOW_DROP_WAF_ONLY.
+	Overflow string
+
+	// Workers the number of goroutines correlating syslog messages.  Defaults to the number of CPUs.
+	Workers int
+
+	// JournalPath where to journal accepted messages, so pending events survive a restart.  Empty disables the journal.
+	JournalPath string
+
+	// JournalCompactInterval how often to drop written events from the journal.  Defaults to a minute.
+	JournalCompactInterval time.Duration
+
+	// Sinks where correlated events are written.  Each event goes to every sink.  NewECE sets up a FileSink; replace or add to it before Start.
+	Sinks []Sink
+
+	// DecodeFields the request fields to base64 decode in the output, by JSON name, e.g. DECODE_FIELDS_FASTLY.  The encoded values are kept under originals.
+	DecodeFields []string
+
+	// Format the syslog format expected on listeners that don't specify their own.  Defaults to RFC5424.
+	Format string
+
+	// Listeners additional syslog endpoints to receive on, alongside the TCP (or TLS) listener on Address if one is set.
+	Listeners []Listener
+
+	// TLSCrtPath and TLSKeyPath the PEM cert and key for the TLS and HTTPS listeners, served to clients whose SNI matches none of TLSCerts.  They default to ECE_TLS_CRT_PATH and ECE_TLS_KEY_PATH.
+	TLSCrtPath string
+	TLSKeyPath string
+
+	// TLSCerts further certs and keys for the TLS and HTTPS listeners, each served to clients asking for one of its names by SNI.  If any cert is set, the listener on Address uses TLS.
+	TLSCerts []TLSPair
+
+	// TLSReloadInterval how often to check the certs and keys for changes, reloading them if they have.  Defaults to TLS_RELOAD_INTERVAL.
+	TLSReloadInterval time.Duration
+
+	// HTTPServiceIds the Fastly service ids allowed to log to the HTTP(S) listeners, as proven by the ownership challenge.  If empty, any service may log.
+	HTTPServiceIds []string
+
+	// AdminAddress where to serve the admin API, e.g. 127.0.0.1:9103.  Empty disables it.  See AdminHandler.
+	AdminAddress string
+
+	// MetricsAddress where to serve Prometheus metrics on METRICS_PATH, e.g. :9102.  Empty disables the listener, though MetricsHandler can still be mounted elsewhere.
+	MetricsAddress string
+
+	// settings guards Ttl, Sinks, DecodeFields and config, which Reload swaps while running
+	settings sync.RWMutex
+	config   *Config
+	reload   reloadState
+	retiring sync.WaitGroup
+	certs    *certificates
+
+	metrics     *metrics
+	expiries    *scheduler
+	wafOnly     *wafOnlyIndex
+	journal     *journal
+	journalStop chan struct{}
+	journalWait sync.WaitGroup
+	channel     syslog.LogPartsChannel
+	workerWait  sync.WaitGroup
+	servers     []*syslog.Server
+	httpServers []*http.Server
+	httpWait    sync.WaitGroup
 }
 
 // NewECE  Creates a new ECE.
 func NewECE(maxAge time.Duration, logFile string, maxLogSize int, maxLogBackups int, maxLogAge int, logCompress bool, address string) *ECE {
-	logObj := log.New(os.Stdout, "", 0)
-
-	logObj.SetOutput(&lumberjack.Logger{
-		Filename:   logFile,
-		MaxSize:    maxLogSize,
-		MaxBackups: maxLogBackups,
-		MaxAge:     maxLogAge,
-		Compress:   logCompress,
-	})
+	ece := newECE(maxAge, address)
+	ece.Sinks = []Sink{NewFileSink(logFile, maxLogSize, maxLogBackups, maxLogAge, logCompress)}
+
+	return ece
+}
 
+// newECE creates an ECE without any sinks, for callers that set up their own
+func newECE(maxAge time.Duration, address string) *ECE {
 	ece := &ECE{
 		Ttl:     maxAge,
-		logger:  logObj,
-		Events:  make(map[string]*Event),
+		events:  newStore(STORE_SHARDS),
 		Address: address,
+
+		TLSCrtPath: os.Getenv(ECE_TLS_CRT_PATH_ENV_VAR),
+		TLSKeyPath: os.Getenv(ECE_TLS_KEY_PATH_ENV_VAR),
 	}
 
+	ece.expiries = newScheduler(STORE_SHARDS, ece.expire)
+	ece.wafOnly = newWafOnlyIndex()
+	ece.metrics = newMetrics(ece)
+
 	return ece
 }
 
-// RetrieveEvent returns the event for the request id, or nil if it doesn't exist
+// RetrieveEvent returns the event for the request id, creating it if it doesn't exist.  Returns nil if the overflow policy refuses a new event.
 func (ece *ECE) RetrieveEvent(reqId string) *Event {
-	ece.RLock()
-	event, exists := ece.Events[reqId]
-	ece.RUnlock()
-
-	if !exists {
-		ece.Lock()
-		// Double check that someone hasn't inserted the event,
-		// while we didn't hold a lock
-		event, exists = ece.Events[reqId]
-		if exists {
-			ece.Unlock()
-			// Other thread beat us to it, bail out
-			return event
-		}
+	return ece.retrieveEvent(reqId, time.Now(), 0)
+}
 
-		// New event, insert an empty record and schedule a write
-		event = &Event{}
+// retrieveEvent is RetrieveEvent for a message of size bytes received at the given time, reserving room for it under the overflow policy.  Returns nil if the policy refuses the message.  A new event expires a TTL after it.
+func (ece *ECE) retrieveEvent(reqId string, received time.Time, size int) *Event {
+	event, exists := ece.events.Get(reqId)
+	if !ece.makeRoom(!exists, size) {
+		return nil
+	}
 
-		ece.Events[reqId] = event
-		ece.Unlock()
+	if exists {
+		return event
+	}
 
-		go ece.DelayNotify(reqId)
+	event, created := ece.events.GetOrCreate(reqId, received)
+	if !created {
+		// Someone else created it in the meantime, so give back the slot makeRoom reserved
+		atomic.AddInt64(&ece.slots, -1)
+	}
+
+	if created {
+		// New event, schedule a write
+		ece.settings.RLock()
+		ttl := ece.Ttl
+		ece.settings.RUnlock()
+
+		ece.expiries.Schedule(reqId, received.Add(ttl))
 	}
 
 	return event
 }
 
-// WriteEvent writes the event to the log
+// Pending returns the number of events waiting to be written
+func (ece *ECE) Pending() int {
+	return ece.events.Len()
+}
+
+// InvalidRuleIds returns the number of rule ids that weren't numbers, and so were written under invalid_rule_ids rather than rule_ids
+func (ece *ECE) InvalidRuleIds() uint64 {
+	return atomic.LoadUint64(&ece.invalidRuleIds)
+}
+
+// WriteEvent writes the event to every sink
 func (ece *ECE) WriteEvent(reqId string) (err error) {
 	event := ece.RemoveEvent(reqId)
+	if event == nil {
+		// Already written
+		return err
+	}
 
-	// Lock, to prevent any modification, but no real need to unlock
+	return ece.writeEvent(reqId, event)
+}
+
+// writeEvent is WriteEvent for an event already removed
+func (ece *ECE) writeEvent(reqId string, event *Event) (err error) {
+	// Already removed, so nothing can add to it, but lock for a consistent view of anything added in the meantime
 	event.mutex.Lock()
+	defer event.mutex.Unlock()
 
 	var outputEvent OutputEvent
 
@@ -238,6 +370,8 @@ func (ece *ECE) WriteEvent(reqId string) (err error) {
 		}
 	}
 
+	ece.decodeFields(&outputEvent)
+
 	// map to hold unique violated rule ids
 	ruleIds := make(map[string]int)
 
@@ -261,49 +395,87 @@ func (ece *ECE) WriteEvent(reqId string) (err error) {
 		ruleIds[wafEvent.RuleId] = 1
 	}
 
-	// make a list from the keys
-	ids := make([]int, len(ruleIds))
+	// make a list from the keys.  Ids that aren't numbers are kept apart, so the rest of the event isn't lost over them.
+	ids := make([]int, 0, len(ruleIds))
 
-	i := 0
 	for id := range ruleIds {
 		number, err := strconv.Atoi(id)
 		if err != nil {
-			err = errors.Wrapf(err, "error converting %s to integer", id)
-			return err
+			outputEvent.InvalidRuleIds = append(outputEvent.InvalidRuleIds, id)
+			continue
 		}
 
-		ids[i] = number
-		i++
+		ids = append(ids, number)
 	}
 
 	outputEvent.RuleIds = ids
 
+	if len(outputEvent.InvalidRuleIds) > 0 {
+		sort.Strings(outputEvent.InvalidRuleIds)
+		atomic.AddUint64(&ece.invalidRuleIds, uint64(len(outputEvent.InvalidRuleIds)))
+		_, _ = fmt.Fprintf(os.Stderr, "warning: invalid rule ids req_id=%q rule_ids=%q\n", reqId, outputEvent.InvalidRuleIds)
+	}
+
 	if outputEvent.ThrottlingRule != "" {
 		outputEvent.Throttled = 1
 	}
 
-	outputBytes, err := json.Marshal(outputEvent)
+	// Hold off Reload until every sink has the event, so none is closed mid write
+	ece.settings.RLock()
+	defer ece.settings.RUnlock()
 
-	if err != nil {
-		err = errors.Wrapf(err, "failed to marshall output for req id %q", reqId)
+	written := 0
+	err = multiSink(ece.Sinks).each(func(sink Sink) error {
+		err := sink.Write(outputEvent)
+		if err != nil {
+			ece.metrics.sinkErrors.WithLabelValues(sinkName(sink)).Inc()
+			return err
+		}
+
+		written++
 		return err
+	})
+
+	if written > 0 {
+		ece.metrics.observeWrite(event, outputEvent)
 	}
 
-	ece.logger.Println(string(outputBytes))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write req id %q", reqId)
+	}
 
 	return err
 }
 
 // RemoveEvent removes the event from the internal cache
 func (ece *ECE) RemoveEvent(reqId string) *Event {
-	ece.Lock()
-	e := ece.Events[reqId]
-	delete(ece.Events, reqId)
-	ece.Unlock()
+	e := ece.events.Remove(reqId)
+
+	if e != nil {
+		e.mutex.Lock()
+		ece.retire(reqId, e)
+		e.mutex.Unlock()
+	}
 
 	return e
 }
 
+// retire gives back the room held by an event just taken out of the store, and journals that it's done with.  Must be called with the event's mutex held.
+func (ece *ECE) retire(reqId string, e *Event) {
+	atomic.AddInt64(&ece.slots, -1)
+	ece.wafOnly.remove(reqId)
+
+	e.removed = true
+	atomic.AddInt64(&ece.pendingBytes, -int64(e.bytes))
+
+	if ece.journal != nil {
+		err := ece.journal.Done(reqId)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error journaling removal of %q: %s\n", reqId, err)
+		}
+	}
+}
+
 // AddEvent parses the event text, then looks it up in the internal cache.  If it's there, it adds the appropriate record to the existing event.  If not, it creates one and sets it's timeout.
 func (ece *ECE) AddEvent(message string) (err error) {
 	waf, err := UnmarshalWaf(message) // Try to unmarshal the message into a WAF event
@@ -312,17 +484,50 @@ func (ece *ECE) AddEvent(message string) (err error) {
 	}
 
 	// Ok, it's a Waf event.  Process it as such.
-	event := ece.RetrieveEvent(waf.RequestId)
-
-	// it does exist, add to it's waf list
 	//fmt.Printf("\tAdding Waf to %q\n", waf.RequestId)
-	event.mutex.Lock()
-	event.WafEntries = append(event.WafEntries, waf)
-	event.mutex.Unlock()
+	ece.addToEvent(waf.RequestId, time.Now(), message, len(message), func(event *Event) {
+		event.WafEntries = append(event.WafEntries, waf)
+	})
 
 	return err
 }
 
+// addToEvent applies add to the event for the request id, creating the event if need be.  The message, if any, is journaled along with the addition.  size is the number of raw bytes being added.  Returns false if the overflow policy refused the message, in which case it's already been counted as dropped.
+func (ece *ECE) addToEvent(reqId string, received time.Time, message string, size int, add func(event *Event)) bool {
+	for {
+		event := ece.retrieveEvent(reqId, received, size)
+		if event == nil {
+			return false
+		}
+
+		event.mutex.Lock()
+		if event.removed {
+			// Written out between retrieving and locking it, so give back the room taken for the message and start afresh
+			event.mutex.Unlock()
+			atomic.AddInt64(&ece.pendingBytes, -int64(size))
+			continue
+		}
+
+		add(event)
+		event.addBytes(size)
+
+		if ece.Overflow == OVERFLOW_DROP_WAF_ONLY {
+			ece.wafOnly.update(reqId, event)
+		}
+
+		// Journaled under the event's lock, so the journal can't record the event as done before this message
+		if message != "" && ece.journal != nil {
+			err := ece.journal.Append(reqId, received, message)
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "error journaling message for %q: %s\n", reqId, err)
+			}
+		}
+		event.mutex.Unlock()
+
+		return true
+	}
+}
+
 func (ece *ECE) addWebEvent(message string) (err error) {
 	req, err := UnmarshalWeb(message)
 
@@ -335,110 +540,292 @@ func (ece *ECE) addWebEvent(message string) (err error) {
 		_, _ = fmt.Fprintf(os.Stderr, "Web Event ID: %q\n", req.RequestId)
 	}
 
-	event := ece.RetrieveEvent(req.RequestId)
+	ok := ece.addToEvent(req.RequestId, time.Now(), message, len(message), func(event *Event) {
+		if ece.Debug {
+			_, _ = fmt.Fprintf(os.Stderr, "\tAdding Web to %q\n", req.RequestId)
+		}
 
-	// it does exist, add to it's req list
-	event.mutex.Lock()
+		event.RequestEntries = append(event.RequestEntries, req)
+	})
+	if !ok {
+		// No room, and already counted as dropped
+		return err
+	}
 
-	if ece.Debug {
-		_, _ = fmt.Fprintf(os.Stderr, "\tAdding Web to %q\n", req.RequestId)
+	if ece.Completion == COMPLETION_REQUEST {
+		ece.expiries.Expedite(req.RequestId, time.Now().Add(ece.Grace))
 	}
-	event.RequestEntries = append(event.RequestEntries, req)
-	event.mutex.Unlock()
 
 	return err
 }
 
 func (ece *ECE) Start() (err error) {
+	_, err = syslogFormat(ece.Format)
+	if err != nil {
+		return err
+	}
+
+	err = validOverflow(ece.Overflow)
+	if err != nil {
+		return err
+	}
+
+	err = validDecodeFields(ece.DecodeFields)
+	if err != nil {
+		return err
+	}
+
+	switch ece.Completion {
+	case "", COMPLETION_TTL, COMPLETION_REQUEST:
+	default:
+		err = fmt.Errorf("unsupported completion policy %q.  Must be one of %s or %s", ece.Completion, COMPLETION_TTL, COMPLETION_REQUEST)
+		return err
+	}
+
+	ece.settings.RLock()
+	ece.metrics.reportSinkFailures(ece.Sinks)
+	ece.settings.RUnlock()
+
+	// Rebuild whatever was pending when we last stopped, before accepting anything new
+	if ece.JournalPath != "" {
+		err = ece.openJournal()
+		if err != nil {
+			return err
+		}
+	}
+
 	channel := make(syslog.LogPartsChannel)
-	handler := syslog.NewChannelHandler(channel)
+	ece.channel = channel
 
-	go func(channel syslog.LogPartsChannel) {
-		for logParts := range channel {
-			message := logParts["message"].(string)
-			if ece.Debug {
-				_, _ = fmt.Fprintf(os.Stderr, "Message Received: %s", message)
+	workers := ece.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	for i := 0; i < workers; i++ {
+		ece.workerWait.Add(1)
+		go func(channel syslog.LogPartsChannel) {
+			defer ece.workerWait.Done()
+
+			for logParts := range channel {
+				message, ok := logMessage(logParts)
+				if !ok {
+					ece.metrics.parseFailures.WithLabelValues(PARSE_FAILURE_NO_MESSAGE).Inc()
+					log.Printf("Error: no message in syslog entry received on %s", logParts["listener"])
+					continue
+				}
+
+				ece.handleMessage(fmt.Sprint(logParts["listener"]), message)
 			}
-			err := ece.AddEvent(message)
+		}(channel)
+	}
+
+	listeners := ece.Listeners
+	if ece.Address != "" {
+		listeners = append([]Listener{ece.defaultListener()}, listeners...)
+	}
+
+	if len(listeners) == 0 {
+		err = errors.New("no listeners configured")
+		return err
+	}
+
+	// Each listener gets a server of its own, all of them feeding the same channel
+	for _, listener := range listeners {
+		if listener.Network == LISTENER_HTTP || listener.Network == LISTENER_HTTPS {
+			err = ece.listenHTTP(listener)
 			if err != nil {
-				log.Printf("Error: %s", err)
+				_ = ece.Shutdown()
+				return err
 			}
+
+			continue
 		}
-	}(channel)
 
-	server := syslog.NewServer()
-	server.SetFormat(syslog.RFC5424)
-	server.SetHandler(handler)
+		name := listener.Format
+		if name == "" {
+			name = ece.Format
+		}
+
+		// already validated, either above or by ParseListener
+		f, err := syslogFormat(name)
+		if err != nil {
+			_ = ece.Shutdown()
+			return err
+		}
 
-	// The syslog server package github.com/mcuardros/go-syslog appears to expect that if you use TLS at all, you're using it both in the Server sense, i.e. the Syslog server has a TLS cert on it and we have an encrypted tunnel between the client and the server, and also in that you're using TLS Client certs.  These are, unfortunately, 2 different things.
-	// The only way to use TLS on the server and encrypt the channel and NOT use client certs (Not sure that Fastly supports this) is to set this SetTlsPeerNameFunc to nil (or alternately make a function always return true)
-	server.SetTlsPeerNameFunc(nil)
-	//server.SetTlsPeerNameFunc(func(tlsConn *tls.Conn)(tlsPeer string, ok bool){
-	//	return "", true
-	//})
+		server := syslog.NewServer()
+		server.SetFormat(f)
+		server.SetHandler(&listenerHandler{channel: channel, listener: listener})
 
-	if os.Getenv(ECE_TLS_CRT_PATH_ENV_VAR) != "" && os.Getenv(ECE_TLS_KEY_PATH_ENV_VAR) != "" {
-		_, _ = fmt.Fprintf(os.Stderr, "TLS Enabled.  Key: %s  Cert: %s\n", os.Getenv(ECE_TLS_CRT_PATH_ENV_VAR), os.Getenv(ECE_TLS_KEY_PATH_ENV_VAR))
+		// The syslog server package github.com/mcuardros/go-syslog appears to expect that if you use TLS at all, you're using it both in the Server sense, i.e. the Syslog server has a TLS cert on it and we have an encrypted tunnel between the client and the server, and also in that you're using TLS Client certs.  These are, unfortunately, 2 different things.
+		// The only way to use TLS on the server and encrypt the channel and NOT use client certs (Not sure that Fastly supports this) is to set this SetTlsPeerNameFunc to nil (or alternately make a function always return true)
+		server.SetTlsPeerNameFunc(nil)
+		//server.SetTlsPeerNameFunc(func(tlsConn *tls.Conn)(tlsPeer string, ok bool){
+		//	return "", true
+		//})
 
-		keypair, err := tls.LoadX509KeyPair(os.Getenv(ECE_TLS_CRT_PATH_ENV_VAR), os.Getenv(ECE_TLS_KEY_PATH_ENV_VAR))
+		err = ece.listen(server, listener)
 		if err != nil {
-			err = errors.Wrapf(err, "failed to load TLS Cert and Key from %s and %s", ECE_TLS_KEY_PATH_ENV_VAR, ECE_TLS_KEY_PATH_ENV_VAR)
+			_ = ece.Shutdown()
 			return err
 		}
 
-		config := tls.Config{
-			Certificates: []tls.Certificate{keypair},
+		err = server.Boot()
+		if err != nil {
+			_ = server.Kill()
+			_ = ece.Shutdown()
+			err = errors.Wrapf(err, "server for %s failed to boot", listener)
+			return err
 		}
 
-		err = server.ListenTCPTLS(ece.Address, &config)
+		ece.servers = append(ece.servers, server)
+	}
+
+	if ece.MetricsAddress != "" {
+		err = ece.listenMetrics()
 		if err != nil {
-			err = errors.Wrapf(err, "failed to start TLS TCP listener")
+			_ = ece.Shutdown()
 			return err
 		}
+	}
 
-	} else {
-		err := server.ListenTCP(ece.Address)
+	if ece.AdminAddress != "" {
+		err = ece.listenAdmin()
 		if err != nil {
-			err = errors.Wrapf(err, "failed to start TCP listener")
+			_ = ece.Shutdown()
 			return err
 		}
 	}
 
-	err = server.Boot()
-	if err != nil {
-		err = errors.Wrapf(err, "server failed to boot")
-		return err
+	_, _ = fmt.Fprint(os.Stderr, "Fastly WAF Event Correlation Engine starting!\n")
+	for _, listener := range listeners {
+		_, _ = fmt.Fprintf(os.Stderr, "Listening on %s\n", listener)
+	}
+	if ece.MetricsAddress != "" {
+		_, _ = fmt.Fprintf(os.Stderr, "Serving metrics on %s%s\n", ece.MetricsAddress, METRICS_PATH)
+	}
+	if ece.AdminAddress != "" {
+		_, _ = fmt.Fprintf(os.Stderr, "Serving the admin API on %s\n", ece.AdminAddress)
 	}
 
-	ece.server = server
-
-	_, _ = fmt.Fprint(os.Stderr, "Fastly WAF Event Correlation Engine starting!\n")
-	_, _ = fmt.Fprintf(os.Stderr, "Listening on %s\n", ece.Address)
+	atomic.StoreInt32(&ece.running, 1)
 	_, _ = fmt.Fprintf(os.Stderr, "TTL: %f seconds\n", ece.Ttl.Seconds())
+	if ece.Completion == COMPLETION_REQUEST {
+		_, _ = fmt.Fprintf(os.Stderr, "Flushing %f seconds after the req entry arrives\n", ece.Grace.Seconds())
+	}
+	if ece.MaxEvents > 0 || ece.MaxBytes > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "Holding at most %d events and %d bytes pending (0 is unlimited).  Overflow: %s\n", ece.MaxEvents, ece.MaxBytes, ece.Overflow)
+	}
 
 	return err
 }
 
-func (ece *ECE) Shutdown() (err error) {
-	err = ece.server.Kill()
+// handleMessage feeds a single message received on the named listener into the correlation engine
+func (ece *ECE) handleMessage(listener string, message string) {
+	if ece.Debug {
+		_, _ = fmt.Fprintf(os.Stderr, "Message Received on %s: %s", listener, message)
+	}
+
+	ece.metrics.received.WithLabelValues(listener).Inc()
+
+	err := ece.AddEvent(message)
 	if err != nil {
-		err = errors.Wrapf(err, "failed to kill server")
+		ece.metrics.parseFailures.WithLabelValues(parseFailure(message)).Inc()
+		log.Printf("Error: %s", err)
+	}
+}
+
+// defaultListener is the listener for ece.Address.  It uses TLS if a cert and key have been provided.
+func (ece *ECE) defaultListener() Listener {
+	if len(ece.tlsPairs()) > 0 {
+		return Listener{Network: LISTENER_TLS, Address: ece.Address}
+	}
+
+	return Listener{Network: LISTENER_TCP, Address: ece.Address}
+}
+
+// tlsPairs the certs and keys to serve, the default first
+func (ece *ECE) tlsPairs() (pairs []TLSPair) {
+	if ece.TLSCrtPath != "" && ece.TLSKeyPath != "" {
+		pairs = append(pairs, TLSPair{CrtPath: ece.TLSCrtPath, KeyPath: ece.TLSKeyPath})
+	}
+
+	return append(pairs, ece.TLSCerts...)
+}
+
+// tlsConfig the TLS config shared by every TLS and HTTPS listener.  The certs are loaded the first time it's called, then reloaded as they change until Shutdown.
+func (ece *ECE) tlsConfig() (config *tls.Config, err error) {
+	if ece.certs == nil {
+		ece.certs, err = newCertificates(ece.tlsPairs(), ece.metrics.certExpiry)
+		if err != nil {
+			ece.certs = nil
+			return config, err
+		}
+
+		ece.certs.watch(ece.TLSReloadInterval)
+	}
+
+	config = &tls.Config{
+		GetCertificate: ece.certs.GetCertificate,
+	}
+
+	return config, err
+}
+
+// Shutdown stops every listener immediately.  Pending events are left to expire as usual.  See Stop for a graceful shutdown.
+func (ece *ECE) Shutdown() (err error) {
+	atomic.StoreInt32(&ece.running, 0)
+
+	err = ece.killSyslog()
+
+	for _, server := range ece.httpServers {
+		closeErr := server.Close()
+		if closeErr != nil && err == nil {
+			err = errors.Wrapf(closeErr, "failed to close http server")
+		}
+	}
+
+	if ece.certs != nil {
+		ece.certs.close()
+		ece.certs = nil
 	}
 
 	return err
 }
 
-func (ece *ECE) Wait() {
-	ece.server.Wait()
+// killSyslog stops the syslog listeners, and cleans up after unixgram ones
+func (ece *ECE) killSyslog() (err error) {
+	for _, server := range ece.servers {
+		killErr := server.Kill()
+		if killErr != nil && err == nil {
+			err = errors.Wrapf(killErr, "failed to kill server")
+		}
+	}
+
+	for _, listener := range ece.Listeners {
+		if listener.Network == LISTENER_UNIXGRAM {
+			_ = os.Remove(listener.Address)
+		}
+	}
+
+	return err
 }
 
-//DelayNotify is intended to run from a goroutine.  It sets a timer equal to the ttl, and then writes the event after the timer expires.
-func (ece *ECE) DelayNotify(reqId string) {
-	time.Sleep(ece.Ttl)
+// Wait blocks until every listener has stopped
+func (ece *ECE) Wait() {
+	for _, server := range ece.servers {
+		server.Wait()
+	}
+
+	ece.httpWait.Wait()
+}
 
+// expire is called by the scheduler once the TTL for a request id is up, and writes the event.
+func (ece *ECE) expire(reqId string) {
 	err := ece.WriteEvent(reqId)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "error in DelayNotify: %s\n", err)
+		_, _ = fmt.Fprintf(os.Stderr, "error writing expired event: %s\n", err)
 	}
 }
 
@@ -3,11 +3,13 @@ package ece
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/magiconair/properties/assert"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -208,3 +210,256 @@ func TestTTL(t *testing.T) {
 	_ = ece.Shutdown()
 	ece.Wait()
 }
+
+// TestEarlyFlush checks that a completed event is flushed within the grace period rather than the TTL, while a waf-only event still waits out the TTL
+func TestEarlyFlush(t *testing.T) {
+	logs := &testSink{}
+	ece := NewECE(500*time.Millisecond, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs}
+	ece.Completion = COMPLETION_REQUEST
+	ece.Grace = 10 * time.Millisecond
+
+	start := time.Now()
+
+	for _, message := range []string{testWafEntryMessageFor("orphan"), testWafEntryMessage(), testWebEntryMessage()} {
+		err := ece.AddEvent(message)
+		if err != nil {
+			t.Fatalf("failed adding event: %s", err)
+		}
+	}
+
+	ok, message := within(200*time.Millisecond, func() (bool, string) {
+		return compareOutput(logs.String(), []OutputEvent{testOutputEvent()})
+	})
+	if !ok {
+		t.Errorf("complete event not flushed early: %s", message)
+	}
+
+	orphan := OutputEvent{
+		RequestId: "orphan",
+		RuleIds:   []int{0},
+		WafEvents: []OutputWaf{{RuleId: "0", Severity: "99", AnomalyScore: "0"}},
+	}
+
+	ok, message = within(time.Second, func() (bool, string) {
+		return compareOutput(logs.String(), []OutputEvent{testOutputEvent(), orphan})
+	})
+	if !ok {
+		t.Errorf("orphaned waf event not flushed: %s", message)
+	}
+
+	if time.Since(start) < ece.Ttl {
+		t.Errorf("orphaned waf event flushed after %s, before the %s TTL", time.Since(start), ece.Ttl)
+	}
+}
+
+func TestParseListener(t *testing.T) {
+	inputs := []struct {
+		spec     string
+		listener Listener
+		ok       bool
+	}{
+		{"127.0.0.1:514", Listener{Network: LISTENER_TCP, Address: "127.0.0.1:514"}, true},
+		{"tcp://127.0.0.1:514", Listener{Network: LISTENER_TCP, Address: "127.0.0.1:514"}, true},
+		{"TLS://:6514", Listener{Network: LISTENER_TLS, Address: ":6514"}, true},
+		{"udp://0.0.0.0:514", Listener{Network: LISTENER_UDP, Address: "0.0.0.0:514"}, true},
+		{"unixgram:///var/run/ece.sock", Listener{Network: LISTENER_UNIXGRAM, Address: "/var/run/ece.sock"}, true},
+		{"sctp://127.0.0.1:514", Listener{}, false},
+		{"udp://0.0.0.0:514?format=RFC3164", Listener{Network: LISTENER_UDP, Address: "0.0.0.0:514", Format: SYSLOG_FORMAT_RFC3164}, true},
+		{"unixgram:///var/run/ece.sock?format=automatic", Listener{Network: LISTENER_UNIXGRAM, Address: "/var/run/ece.sock", Format: SYSLOG_FORMAT_AUTOMATIC}, true},
+		{"udp://", Listener{}, false},
+		{"udp://0.0.0.0:514?format=cef", Listener{}, false},
+		{"udp://0.0.0.0:514?framing=lf", Listener{}, false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.spec, func(t *testing.T) {
+			listener, err := ParseListener(tc.spec)
+			if !tc.ok {
+				if err == nil {
+					t.Errorf("expected an error parsing %q", tc.spec)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("failed parsing %q: %s", tc.spec, err)
+			}
+
+			assert.Equal(t, listener, tc.listener, "Parsed listener meets expectations.")
+		})
+	}
+}
+
+// TestListeners sends the same event over every supported transport, with all the listeners running at once
+func TestListeners(t *testing.T) {
+	listeners := []Listener{
+		{Network: LISTENER_TCP, Address: testAddress()},
+		{Network: LISTENER_UDP, Address: testAddress()},
+		{Network: LISTENER_UNIXGRAM, Address: fmt.Sprintf("%s/ece.sock", tmpDir)},
+	}
+
+	if useTls {
+		listeners = append(listeners, Listener{Network: LISTENER_TLS, Address: testAddress()})
+	}
+
+	ece, logs := testServerWithListeners(listeners)
+
+	for _, listener := range listeners {
+		t.Run(listener.Network, func(t *testing.T) {
+			logs.Reset()
+
+			err := sendSyslogListener("", []string{testWebEntryMessage(), testWafEntryMessage()}, listener, tlsConfig)
+			if err != nil {
+				t.Errorf("failed sending syslog data: %s", err)
+			}
+
+			ok, message := within(time.Second, func() (bool, string) {
+				return compareOutput(logs.String(), []OutputEvent{testOutputEvent()})
+			})
+			if !ok {
+				t.Error(message)
+			}
+		})
+	}
+
+	err := ece.Shutdown()
+	if err != nil {
+		log.Printf("Error shutting down server: %s", err)
+	}
+	ece.Wait()
+}
+
+// TestSyslogFormats sends the same event framed in each supported syslog format
+func TestSyslogFormats(t *testing.T) {
+	inputs := []struct {
+		name   string
+		format string
+		frames []string
+	}{
+		{
+			"rfc3164",
+			SYSLOG_FORMAT_RFC3164,
+			[]string{rfc3164Frame(testWebEntryMessage()), rfc3164Frame(testWafEntryMessage())},
+		},
+		{
+			"rfc6587",
+			SYSLOG_FORMAT_RFC6587,
+			[]string{rfc6587Frame(testWebEntryMessage()), rfc6587Frame(testWafEntryMessage())},
+		},
+		{
+			"automatic-mixed",
+			SYSLOG_FORMAT_AUTOMATIC,
+			[]string{rfc3164Frame(testWebEntryMessage()), rfc6587Frame(testWafEntryMessage())},
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			listener := Listener{Network: LISTENER_TCP, Address: testAddress(), Format: tc.format}
+			ece, logs := testServerWithListeners([]Listener{listener})
+
+			err := sendFrames(tc.frames, listener, tlsConfig)
+			if err != nil {
+				t.Errorf("failed sending syslog data: %s", err)
+			}
+
+			ok, message := within(time.Second, func() (bool, string) {
+				return compareOutput(logs.String(), []OutputEvent{testOutputEvent()})
+			})
+			if !ok {
+				t.Error(message)
+			}
+
+			_ = ece.Shutdown()
+			ece.Wait()
+		})
+	}
+}
+
+// TestStop checks that a graceful stop writes pending events without waiting for their TTL
+func TestStop(t *testing.T) {
+	ece, logs := testServer()
+	ece.Ttl = time.Hour
+
+	err := sendSyslog("", []string{testWebEntryMessage(), testWafEntryMessage()}, ece.Address, tlsConfig)
+	if err != nil {
+		t.Errorf("failed sending syslog data: %s", err)
+	}
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return ece.Pending() == 1, fmt.Sprintf("%d events pending", ece.Pending())
+	})
+	if !ok {
+		t.Fatal(message)
+	}
+
+	err = ece.Stop(time.Second)
+	if err != nil {
+		t.Errorf("failed stopping: %s", err)
+	}
+
+	ok, message = compareOutput(logs.String(), []OutputEvent{testOutputEvent()})
+	if !ok {
+		t.Error(message)
+	}
+
+	assert.Equal(t, ece.Pending(), 0, "Nothing left pending.")
+
+	logs.Reset()
+	ece.Ttl = time.Millisecond
+	_ = ece.AddEvent(testWafEntryMessage())
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, logs.String(), "", "Nothing expires into the closed sinks.")
+}
+
+// TestStopSlowSink checks that a sink still sending doesn't hold a graceful stop past its timeout
+func TestStopSlowSink(t *testing.T) {
+	ece, _ := testServer()
+
+	slow := &testSlowSink{release: make(chan struct{})}
+	defer close(slow.release)
+	ece.Sinks = append(ece.Sinks, slow)
+
+	start := time.Now()
+	err := ece.Stop(100 * time.Millisecond)
+
+	assert.Equal(t, time.Since(start) < time.Second, true, "Stopped within the timeout.")
+	assert.Equal(t, err != nil && strings.Contains(err.Error(), "*ece.testSlowSink"), true, fmt.Sprintf("Slow sink reported: %v", err))
+}
+
+// TestInvalidRuleIds checks that rule ids that aren't numbers are kept apart and counted, rather than costing the whole event
+func TestInvalidRuleIds(t *testing.T) {
+	logs := &testSink{}
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs}
+
+	reqId := testWafEntry().RequestId
+
+	_ = ece.AddEvent(testWebEntryMessage())
+	_ = ece.AddEvent(testWafEntryMessage())
+	_ = ece.AddEvent(strings.Replace(testWafEntryMessage(), `"rule_id":"0"`, `"rule_id":"9421OO"`, 1))
+	_ = ece.AddEvent(strings.Replace(testWafEntryMessage(), `"rule_id":"0"`, `"rule_id":""`, 1))
+
+	err := ece.WriteEvent(reqId)
+	if err != nil {
+		t.Fatalf("failed writing event: %s", err)
+	}
+
+	var event OutputEvent
+	_ = json.Unmarshal([]byte(logs.String()), &event)
+
+	assert.Equal(t, event.RequestId, reqId, "Event written.")
+	assert.Equal(t, event.RuleIds, []int{0}, "Numeric rule id kept.")
+	assert.Equal(t, event.InvalidRuleIds, []string{"", "9421OO"}, "Invalid rule ids kept as strings.")
+	assert.Equal(t, len(event.WafEvents), 3, "Every WAF event kept.")
+	assert.Equal(t, ece.InvalidRuleIds(), uint64(2), "Invalid rule ids counted.")
+
+	logs.Reset()
+	_ = ece.AddEvent(testWafEntryMessage())
+	_ = ece.WriteEvent(reqId)
+
+	assert.Equal(t, strings.Contains(logs.String(), "invalid_rule_ids"), false, "No invalid rule ids, no field.")
+}
@@ -0,0 +1,289 @@
+package ece
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const FORMAT_ECS = "ecs"
+
+// ECS_VERSION the version of the Elastic Common Schema events are mapped to
+const ECS_VERSION = "8.11.0"
+
+// ECS_DATASET the event.dataset of every event
+const ECS_DATASET = "fastly.waf"
+
+// ECSFormatter renders events as JSON in the Elastic Common Schema.  Standard fields are used wherever ECS has them, e.g. source.ip, url.original, http.request.method, rule.id and event.action, and everything Fastly specific goes under fastly.
+type ECSFormatter struct{}
+
+type ecsEvent struct {
+	Timestamp string        `json:"@timestamp,omitempty"`
+	ECS       ecsVersion    `json:"ecs"`
+	Event     ecsEventMeta  `json:"event"`
+	Observer  ecsObserver   `json:"observer"`
+	Source    *ecsSource    `json:"source,omitempty"`
+	URL       ecsURL        `json:"url"`
+	HTTP      ecsHTTP       `json:"http"`
+	UserAgent *ecsUserAgent `json:"user_agent,omitempty"`
+	Rule      *ecsRule      `json:"rule,omitempty"`
+	TLS       *ecsTLS       `json:"tls,omitempty"`
+	Fastly    ecsFastly     `json:"fastly"`
+}
+
+type ecsVersion struct {
+	Version string `json:"version"`
+}
+
+type ecsEventMeta struct {
+	Kind      string   `json:"kind"`
+	Category  []string `json:"category"`
+	Type      []string `json:"type"`
+	Action    string   `json:"action"`
+	Outcome   string   `json:"outcome,omitempty"`
+	Id        string   `json:"id"`
+	Dataset   string   `json:"dataset"`
+	Severity  int      `json:"severity"`
+	RiskScore *int     `json:"risk_score,omitempty"`
+}
+
+type ecsObserver struct {
+	Vendor  string `json:"vendor"`
+	Product string `json:"product"`
+	Type    string `json:"type"`
+}
+
+type ecsSource struct {
+	IP      string `json:"ip"`
+	Address string `json:"address"`
+}
+
+type ecsURL struct {
+	Original string `json:"original,omitempty"`
+	Full     string `json:"full,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Scheme   string `json:"scheme,omitempty"`
+}
+
+type ecsHTTP struct {
+	Request  ecsHTTPRequest   `json:"request"`
+	Response *ecsHTTPResponse `json:"response,omitempty"`
+}
+
+type ecsHTTPRequest struct {
+	Id     string   `json:"id"`
+	Method string   `json:"method,omitempty"`
+	Bytes  *int     `json:"bytes,omitempty"`
+	Body   *ecsBody `json:"body,omitempty"`
+}
+
+type ecsHTTPResponse struct {
+	StatusCode *int     `json:"status_code,omitempty"`
+	Bytes      *int     `json:"bytes,omitempty"`
+	Body       *ecsBody `json:"body,omitempty"`
+}
+
+type ecsBody struct {
+	Bytes *int `json:"bytes,omitempty"`
+}
+
+type ecsUserAgent struct {
+	Original string `json:"original"`
+}
+
+type ecsRule struct {
+	Id []string `json:"id"`
+}
+
+type ecsTLS struct {
+	Version         string `json:"version,omitempty"`
+	VersionProtocol string `json:"version_protocol,omitempty"`
+	Cipher          string `json:"cipher,omitempty"`
+}
+
+// ecsFastly the fields ECS has no place for
+type ecsFastly struct {
+	ServiceId      string       `json:"service_id,omitempty"`
+	Datacenter     string       `json:"datacenter,omitempty"`
+	Info           string       `json:"info,omitempty"`
+	ThrottlingRule string       `json:"throttling_rule,omitempty"`
+	Throttled      int          `json:"throttled"`
+	Waf            ecsFastlyWaf `json:"waf"`
+}
+
+type ecsFastlyWaf struct {
+	Logged         string         `json:"logged,omitempty"`
+	Blocked        string         `json:"blocked,omitempty"`
+	Failures       string         `json:"failures,omitempty"`
+	Executed       string         `json:"executed,omitempty"`
+	Scores         map[string]int `json:"scores,omitempty"`
+	Events         []OutputWaf    `json:"events"`
+	InvalidRuleIds []string       `json:"invalid_rule_ids,omitempty"`
+}
+
+// optionalInt parses s, returning nil if it isn't a number, so the field is left out rather than zeroed
+func optionalInt(s string) *int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil
+	}
+
+	return &n
+}
+
+// sumInts adds the numbers, returning nil unless they all parse
+func sumInts(values ...string) *int {
+	total := 0
+	for _, s := range values {
+		n := optionalInt(s)
+		if n == nil {
+			return nil
+		}
+		total += *n
+	}
+
+	return &total
+}
+
+// tlsVersion splits a protocol as Fastly gives it, e.g. TLSv1.2, into the protocol and version
+func tlsVersion(protocol string) (name string, version string) {
+	i := strings.IndexAny(protocol, "v0123456789")
+	if i < 0 {
+		return strings.ToLower(protocol), version
+	}
+
+	return strings.ToLower(protocol[:i]), strings.TrimPrefix(protocol[i:], "v")
+}
+
+// wafScores the event's per category WAF scores, keyed by name, leaving out any that aren't numbers
+func wafScores(event OutputEvent) map[string]int {
+	named := map[string]string{
+		"anomaly":          event.AnomalyScore,
+		"sql_injection":    event.SqlInjectionScore,
+		"rfi":              event.RfiScore,
+		"lfi":              event.LfiScore,
+		"rce":              event.RceScore,
+		"php_injection":    event.PhpInjectionScore,
+		"session_fixation": event.SessionFixationScore,
+		"http_violation":   event.HTTPViolationScore,
+		"xss":              event.XSSScore,
+	}
+
+	scores := make(map[string]int)
+	for name, value := range named {
+		if n := optionalInt(value); n != nil {
+			scores[name] = *n
+		}
+	}
+
+	return scores
+}
+
+func (f ECSFormatter) Format(event OutputEvent) (line []byte, err error) {
+	severity, _ := Severity(event)
+	action := Action(event)
+
+	doc := ecsEvent{
+		ECS: ecsVersion{Version: ECS_VERSION},
+		Event: ecsEventMeta{
+			Kind:      "event",
+			Category:  []string{"web", "network"},
+			Type:      []string{"access"},
+			Action:    action,
+			Id:        event.RequestId,
+			Dataset:   ECS_DATASET,
+			Severity:  severity,
+			RiskScore: optionalInt(event.AnomalyScore),
+		},
+		Observer: ecsObserver{Vendor: FORMAT_VENDOR, Product: FORMAT_PRODUCT, Type: "waf"},
+		URL: ecsURL{
+			Original: event.ReqURI,
+			Domain:   event.ReqHHost,
+		},
+		HTTP: ecsHTTP{
+			Request: ecsHTTPRequest{
+				Id:     event.RequestId,
+				Method: event.ReqMethod,
+				Bytes:  sumInts(event.ReqHeaderBytes, event.ReqBodyBytes),
+			},
+		},
+		Fastly: ecsFastly{
+			ServiceId:      event.ServiceId,
+			Datacenter:     event.Datacenter,
+			Info:           event.FastlyInfo,
+			ThrottlingRule: event.ThrottlingRule,
+			Throttled:      event.Throttled,
+			Waf: ecsFastlyWaf{
+				Logged:   event.WafLogged,
+				Blocked:  event.WafBlocked,
+				Failures: event.WafFailures,
+				Executed: event.WafExecuted,
+				Scores:   wafScores(event),
+				Events:   event.WafEvents,
+
+				InvalidRuleIds: event.InvalidRuleIds,
+			},
+		},
+	}
+
+	if when, ok := startTime(event); ok {
+		doc.Timestamp = when.UTC().Format(time.RFC3339Nano)
+	}
+
+	switch action {
+	case ACTION_BLOCKED:
+		doc.Event.Type = append(doc.Event.Type, "denied")
+		doc.Event.Outcome = "failure"
+	case ACTION_ALLOWED, ACTION_LOGGED:
+		doc.Event.Type = append(doc.Event.Type, "allowed")
+		doc.Event.Outcome = "success"
+	}
+
+	if event.ClientIp != "" {
+		doc.Source = &ecsSource{IP: event.ClientIp, Address: event.ClientIp}
+	}
+
+	if event.ReqHHost != "" {
+		doc.URL.Full = requestURL(event)
+		doc.URL.Scheme = strings.SplitN(doc.URL.Full, ":", 2)[0]
+	}
+
+	if n := optionalInt(event.ReqBodyBytes); n != nil {
+		doc.HTTP.Request.Body = &ecsBody{Bytes: n}
+	}
+
+	if event.RespStatus != "" || event.RespBytes != "" {
+		doc.HTTP.Response = &ecsHTTPResponse{
+			StatusCode: optionalInt(event.RespStatus),
+			Bytes:      optionalInt(event.RespBytes),
+		}
+		if n := optionalInt(event.RespBodyBytes); n != nil {
+			doc.HTTP.Response.Body = &ecsBody{Bytes: n}
+		}
+	}
+
+	if event.ReqHUserAgent != "" {
+		doc.UserAgent = &ecsUserAgent{Original: event.ReqHUserAgent}
+	}
+
+	if len(event.WafEvents) > 0 {
+		doc.Rule = &ecsRule{}
+		for _, waf := range event.WafEvents {
+			doc.Rule.Id = append(doc.Rule.Id, waf.RuleId)
+		}
+	}
+
+	if event.TlsProtocol != "" || event.TlsCipher != "" {
+		protocol, version := tlsVersion(event.TlsProtocol)
+		doc.TLS = &ecsTLS{Version: version, VersionProtocol: protocol, Cipher: event.TlsCipher}
+	}
+
+	line, err = json.Marshal(doc)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshall req id %q as ECS", event.RequestId)
+	}
+
+	return line, err
+}
@@ -0,0 +1,339 @@
+package ece
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ELASTIC_INDEX_PREFIX_DEFAULT = "fastly-waf"
+const ELASTIC_BATCH_SIZE_DEFAULT = 500
+const ELASTIC_BATCH_INTERVAL_DEFAULT = time.Second
+const ELASTIC_RETRIES_DEFAULT = 5
+const ELASTIC_TIMEOUT = 30 * time.Second
+
+// ELASTIC_INDEX_DATE_LAYOUT the date suffix of daily indexes, as used by Beats and Logstash
+const ELASTIC_INDEX_DATE_LAYOUT = "2006.01.02"
+
+// ElasticSink indexes events into Elasticsearch or OpenSearch through the _bulk API.  Each event goes to a daily index named for its StartTime, e.g. fastly-waf-2018.03.15, with its RequestId as the document id, so an event written twice is indexed once.  Items the cluster is too busy to take (429 or 5xx) are retried with exponential backoff; items it rejects outright, e.g. for a mapping conflict, are reported and dropped.
+type ElasticSink struct {
+	// URL the base URL of the cluster, e.g. https://opensearch.example.com:9200
+	URL string
+
+	// IndexPrefix the daily index names are this, a dash, and the date
+	IndexPrefix string
+
+	// Username and Password for basic auth, if set
+	Username string
+	Password string
+
+	// APIKey an Elasticsearch API key, sent as an Authorization: ApiKey header, if set
+	APIKey string
+
+	// Formatter renders each document.  JSON if unset.  It must render JSON objects, e.g. ECSFormatter.
+	Formatter Formatter
+
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// Retries how many times to retry items that failed for want of capacity
+	Retries int
+
+	// Client the HTTP client to index with.  Defaults to one with an ELASTIC_TIMEOUT timeout.
+	Client *http.Client
+
+	batcher  *batcher
+	mutex    sync.Mutex
+	indexed  uint64
+	rejected uint64
+
+	failureReporter
+}
+
+// elasticAction the action line preceding each document in a bulk request
+type elasticAction struct {
+	Index elasticTarget `json:"index"`
+}
+
+type elasticTarget struct {
+	Index string `json:"_index"`
+	Id    string `json:"_id"`
+}
+
+// elasticBulkResponse the parts of the _bulk response needed to tell which items failed
+type elasticBulkResponse struct {
+	Errors bool                         `json:"errors"`
+	Items  []map[string]elasticBulkItem `json:"items"`
+}
+
+type elasticBulkItem struct {
+	Index  string             `json:"_index"`
+	Id     string             `json:"_id"`
+	Status int                `json:"status"`
+	Error  *elasticBulkReason `json:"error"`
+}
+
+type elasticBulkReason struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// NewElasticSink creates an ElasticSink for the cluster at url, with default settings.  Adjust them, then call Start.
+func NewElasticSink(url string) *ElasticSink {
+	return &ElasticSink{
+		URL:           strings.TrimRight(url, "/"),
+		IndexPrefix:   ELASTIC_INDEX_PREFIX_DEFAULT,
+		BatchSize:     ELASTIC_BATCH_SIZE_DEFAULT,
+		BatchInterval: ELASTIC_BATCH_INTERVAL_DEFAULT,
+		Retries:       ELASTIC_RETRIES_DEFAULT,
+	}
+}
+
+// Start starts indexing
+func (s *ElasticSink) Start() (err error) {
+	if s.URL == "" {
+		err = errors.New("elasticsearch sink needs a URL")
+		return err
+	}
+
+	if s.BatchInterval <= 0 {
+		s.BatchInterval = ELASTIC_BATCH_INTERVAL_DEFAULT
+	}
+
+	if s.Client == nil {
+		s.Client = &http.Client{Timeout: ELASTIC_TIMEOUT}
+	}
+
+	s.batcher = newBatcher(s.BatchSize, s.BatchInterval, s.index)
+	s.batcher.shelve = func(batch []OutputEvent) {
+		s.reject(len(batch))
+		_, _ = fmt.Fprintf(os.Stderr, "dropped %d events, as %s isn't keeping up\n", len(batch), s.URL)
+	}
+	s.batcher.start()
+
+	return err
+}
+
+// Write adds the event to the current bulk request.  It never waits on the cluster, but fails if the sink hasn't been started.
+func (s *ElasticSink) Write(event OutputEvent) (err error) {
+	if s.batcher == nil {
+		err = fmt.Errorf("elasticsearch %s not started, req id %q not written", s.URL, event.RequestId)
+		return err
+	}
+
+	s.batcher.add(event)
+
+	return err
+}
+
+// Flush indexes every event written so far
+func (s *ElasticSink) Flush() (err error) {
+	if s.batcher == nil {
+		return err
+	}
+
+	err = s.batcher.flush()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to flush to %s", s.URL)
+	}
+
+	return err
+}
+
+// Close stops indexing.  Anything not yet indexed is dropped, so Flush first.
+func (s *ElasticSink) Close() error {
+	if s.batcher == nil {
+		return nil
+	}
+
+	s.batcher.close()
+
+	return nil
+}
+
+// Indexed returns the number of events the cluster has accepted
+func (s *ElasticSink) Indexed() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.indexed
+}
+
+// Rejected returns the number of events given up on
+func (s *ElasticSink) Rejected() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.rejected
+}
+
+func (s *ElasticSink) accept(n int) {
+	s.mutex.Lock()
+	s.indexed += uint64(n)
+	s.mutex.Unlock()
+}
+
+func (s *ElasticSink) reject(n int) {
+	s.mutex.Lock()
+	s.rejected += uint64(n)
+	s.mutex.Unlock()
+
+	s.gaveUp(n)
+}
+
+// IndexName returns the daily index for the event.  Events without a usable StartTime, such as those that never got a req entry, go in today's index.
+func (s *ElasticSink) IndexName(event OutputEvent) string {
+	when, ok := startTime(event)
+	if !ok {
+		when = time.Now()
+	}
+
+	return fmt.Sprintf("%s-%s", s.IndexPrefix, when.UTC().Format(ELASTIC_INDEX_DATE_LAYOUT))
+}
+
+// encode renders the events as a bulk request body
+func (s *ElasticSink) encode(events []OutputEvent) (body []byte, err error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+
+	for _, event := range events {
+		var doc []byte
+
+		err = encoder.Encode(elasticAction{Index: elasticTarget{Index: s.IndexName(event), Id: event.RequestId}})
+		if err == nil {
+			doc, err = formatOrJSON(s.Formatter, event)
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "failed to marshall req id %q for bulk indexing", event.RequestId)
+			return body, err
+		}
+
+		buf.Write(doc)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), err
+}
+
+// bulk makes a single _bulk request, returning the events worth retrying, as they failed for want of capacity, and the number rejected outright
+func (s *ElasticSink) bulk(events []OutputEvent) (retry []OutputEvent, rejected int, err error) {
+	body, err := s.encode(events)
+	if err != nil {
+		return retry, len(events), err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.URL+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create bulk request for %s", s.URL)
+		return retry, len(events), err
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.APIKey)
+	} else if s.Username != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to post to %s", s.URL)
+		return events, rejected, err
+	}
+
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read bulk response from %s", s.URL)
+		return events, rejected, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		err = fmt.Errorf("%s responded %s", s.URL, resp.Status)
+		return events, rejected, err
+	case resp.StatusCode >= 300:
+		err = fmt.Errorf("%s rejected bulk request: %s: %s", s.URL, resp.Status, respBody)
+		return retry, len(events), err
+	}
+
+	var bulkResp elasticBulkResponse
+	err = json.Unmarshal(respBody, &bulkResp)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse bulk response from %s", s.URL)
+		return retry, len(events), err
+	}
+
+	if !bulkResp.Errors {
+		s.accept(len(events))
+		return retry, rejected, err
+	}
+
+	// Items are in the same order as the request
+	if len(bulkResp.Items) != len(events) {
+		err = fmt.Errorf("bulk response from %s has %d items for %d events", s.URL, len(bulkResp.Items), len(events))
+		return retry, len(events), err
+	}
+
+	failures := []string{}
+	for i, actions := range bulkResp.Items {
+		for _, item := range actions {
+			switch {
+			case item.Error == nil:
+				s.accept(1)
+			case item.Status == http.StatusTooManyRequests || item.Status >= 500:
+				retry = append(retry, events[i])
+			default:
+				failures = append(failures, fmt.Sprintf("%s/%s: %s: %s", item.Index, item.Id, item.Error.Type, item.Error.Reason))
+			}
+		}
+	}
+
+	if len(failures) > 0 {
+		err = fmt.Errorf("%s rejected %d events: %s", s.URL, len(failures), strings.Join(failures, "; "))
+	} else if len(retry) > 0 {
+		err = fmt.Errorf("%s couldn't take %d events", s.URL, len(retry))
+	}
+
+	return retry, len(failures), err
+}
+
+// index bulk indexes the events, retrying whatever failed for want of capacity.  Returns an error if any event couldn't be indexed.
+func (s *ElasticSink) index(events []OutputEvent) (err error) {
+	pending := events
+	rejected := 0
+
+	err = retry(s.Retries, s.batcher.stopping(), func() (again bool, err error) {
+		var n int
+
+		pending, n, err = s.bulk(pending)
+		rejected += n
+
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+
+		return len(pending) > 0, err
+	})
+
+	// Give up on whatever is left
+	rejected += len(pending)
+	if rejected == 0 {
+		return nil
+	}
+
+	s.reject(rejected)
+
+	err = fmt.Errorf("failed to index %d of %d events", rejected, len(events))
+
+	return err
+}
@@ -0,0 +1,232 @@
+package ece
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testElasticDoc a document as received by the fake cluster
+type testElasticDoc struct {
+	Index string
+	Id    string
+	Event OutputEvent
+}
+
+// testElastic a fake _bulk endpoint.  Documents are accepted unless the failures map says otherwise for their id, in which case the listed statuses are answered in turn.
+type testElastic struct {
+	sync.Mutex
+	server   *httptest.Server
+	status   []int
+	failures map[string][]int
+	requests int
+	auth     string
+	docs     []testElasticDoc
+}
+
+func newTestElastic() *testElastic {
+	es := &testElastic{failures: make(map[string][]int)}
+
+	es.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		es.Lock()
+		defer es.Unlock()
+
+		es.requests++
+		es.auth = r.Header.Get("Authorization")
+
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if len(es.status) > 0 {
+			status := es.status[0]
+			es.status = es.status[1:]
+			w.WriteHeader(status)
+			return
+		}
+
+		resp := elasticBulkResponse{}
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var action elasticAction
+			_ = json.Unmarshal(scanner.Bytes(), &action)
+
+			scanner.Scan()
+			var event OutputEvent
+			_ = json.Unmarshal(scanner.Bytes(), &event)
+
+			item := elasticBulkItem{Index: action.Index.Index, Id: action.Index.Id, Status: http.StatusCreated}
+
+			if statuses := es.failures[action.Index.Id]; len(statuses) > 0 {
+				item.Status = statuses[0]
+				item.Error = &elasticBulkReason{Type: "some_exception", Reason: "it failed"}
+				es.failures[action.Index.Id] = statuses[1:]
+				resp.Errors = true
+			} else {
+				es.docs = append(es.docs, testElasticDoc{Index: action.Index.Index, Id: action.Index.Id, Event: event})
+			}
+
+			resp.Items = append(resp.Items, map[string]elasticBulkItem{"index": item})
+		}
+
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+
+	return es
+}
+
+func TestElasticIndexName(t *testing.T) {
+	sink := NewElasticSink("http://localhost:9200")
+	today := fmt.Sprintf("fastly-waf-%s", time.Now().UTC().Format("2006.01.02"))
+
+	inputs := []struct {
+		startTime string
+		index     string
+	}{
+		{"1521150005", "fastly-waf-2018.03.15"},
+		{"2019-12-31T23:59:59-01:00", "fastly-waf-2020.01.01"},
+		{"", today},
+		{"yesterday", today},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.startTime, func(t *testing.T) {
+			assert.Equal(t, sink.IndexName(OutputEvent{StartTime: tc.startTime}), tc.index, "Index meets expectations.")
+		})
+	}
+}
+
+func TestElastic(t *testing.T) {
+	es := newTestElastic()
+	defer es.server.Close()
+
+	sink := NewElasticSink(es.server.URL + "/")
+	sink.Username = "ece"
+	sink.Password = "hunter2"
+	sink.BatchInterval = time.Hour
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+
+	events := []OutputEvent{testOutputEvent(), {RequestId: "orphan"}}
+	for _, event := range events {
+		_ = sink.Write(event)
+	}
+
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("failed flushing: %s", err)
+	}
+
+	_ = sink.Close()
+
+	today := fmt.Sprintf("fastly-waf-%s", time.Now().UTC().Format("2006.01.02"))
+
+	assert.Equal(t, es.docs, []testElasticDoc{
+		{Index: "fastly-waf-2018.03.15", Id: testOutputEvent().RequestId, Event: testOutputEvent()},
+		{Index: today, Id: "orphan", Event: OutputEvent{RequestId: "orphan"}},
+	}, "Events indexed daily by start time, with request ids as document ids.")
+
+	assert.Equal(t, strings.HasPrefix(es.auth, "Basic "), true, "Basic auth sent.")
+	assert.Equal(t, sink.Indexed(), uint64(2), "Indexed count meets expectations.")
+}
+
+// TestElasticItemErrors checks that items the cluster is too busy for are retried alone, while items it rejects are dropped
+func TestElasticItemErrors(t *testing.T) {
+	es := newTestElastic()
+	defer es.server.Close()
+
+	es.failures["busy"] = []int{http.StatusTooManyRequests}
+	es.failures["bad"] = []int{http.StatusBadRequest}
+
+	sink := NewElasticSink(es.server.URL)
+	sink.BatchInterval = time.Hour
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+	defer sink.Close()
+
+	for _, reqId := range []string{"ok", "busy", "bad"} {
+		_ = sink.Write(OutputEvent{RequestId: reqId})
+	}
+
+	err = sink.Flush()
+	if err == nil {
+		t.Error("rejected item not reported")
+	}
+
+	ids := []string{}
+	for _, doc := range es.docs {
+		ids = append(ids, doc.Id)
+	}
+
+	assert.Equal(t, ids, []string{"ok", "busy"}, "Busy item retried, bad item dropped.")
+	assert.Equal(t, es.requests, 2, "Only one retry needed.")
+	assert.Equal(t, sink.Indexed(), uint64(2), "Indexed count meets expectations.")
+	assert.Equal(t, sink.Rejected(), uint64(1), "Rejected count meets expectations.")
+}
+
+func TestElasticRetry(t *testing.T) {
+	inputs := []struct {
+		name     string
+		status   []int
+		requests int
+		indexed  uint64
+		rejected uint64
+	}{
+		{"unavailable", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, 1, 0},
+		{"down", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, 3, 0, 1},
+		{"bad request", []int{http.StatusBadRequest}, 1, 0, 1},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			es := newTestElastic()
+			defer es.server.Close()
+			es.status = tc.status
+
+			sink := NewElasticSink(es.server.URL)
+			sink.BatchInterval = time.Hour
+			sink.Retries = 2
+
+			err := sink.Start()
+			if err != nil {
+				t.Fatalf("failed starting sink: %s", err)
+			}
+			defer sink.Close()
+
+			_ = sink.Write(OutputEvent{RequestId: "a"})
+
+			err = sink.Flush()
+			assert.Equal(t, err != nil, tc.rejected > 0, fmt.Sprintf("Flush error meets expectations: %v", err))
+
+			assert.Equal(t, es.requests, tc.requests, "Requests meet expectations.")
+			assert.Equal(t, sink.Indexed(), tc.indexed, "Indexed count meets expectations.")
+			assert.Equal(t, sink.Rejected(), tc.rejected, "Rejected count meets expectations.")
+		})
+	}
+}
+
+// TestElasticNotStarted checks that a sink used before Start refuses events rather than panicking
+func TestElasticNotStarted(t *testing.T) {
+	sink := NewElasticSink("http://127.0.0.1:9200/")
+
+	err := sink.Write(testOutputEvent())
+	assert.Equal(t, err != nil, true, "Write refused.")
+	assert.Equal(t, sink.Flush(), nil, "Nothing to flush.")
+	assert.Equal(t, sink.Close(), nil, "Nothing to close.")
+}
@@ -0,0 +1,295 @@
+package ece
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expiry a pending deadline for a single request id
+type expiry struct {
+	reqId    string
+	deadline time.Time
+	index    int
+}
+
+// expiryHeap a min-heap of expiries ordered by deadline.  Implements heap.Interface.
+type expiryHeap []*expiry
+
+func (h expiryHeap) Len() int { return len(h) }
+
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*expiry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+
+	return e
+}
+
+// EXPIRERS how many expiring events are written at once
+const EXPIRERS = 4
+
+// EXPIRY_QUEUE how many due request ids can wait for an expirer before the shards stop popping more
+const EXPIRY_QUEUE = 1024
+
+// scheduler calls expire for each request id once its deadline has passed.  The deadlines are hash-sharded like the store, each shard a heap with its own lock and a goroutine sleeping until its earliest deadline, so scheduling new request ids rarely contends, and the cost of a pending request is one heap entry rather than one parked goroutine.  Due request ids are handed to a pool of expirers, so a slow sink holds up writing other events, but never the heaps.
+type scheduler struct {
+	// accessed atomically, and kept first for alignment
+	count int64
+
+	shards   []*expiryShard
+	expire   func(reqId string)
+	due      chan string
+	done     chan struct{}
+	stopOnce sync.Once
+	wait     sync.WaitGroup
+}
+
+// expiryShard one hash partition of the scheduler
+type expiryShard struct {
+	sync.Mutex
+	heap    expiryHeap
+	pending map[string]*expiry
+	wake    chan struct{}
+}
+
+// newScheduler creates a scheduler with n shards and starts their goroutines, along with the EXPIRERS.  They run until stop is called.
+func newScheduler(n int, expire func(reqId string)) *scheduler {
+	if n < 1 {
+		n = 1
+	}
+
+	s := &scheduler{
+		shards: make([]*expiryShard, n),
+		expire: expire,
+		due:    make(chan string, EXPIRY_QUEUE),
+		done:   make(chan struct{}),
+	}
+
+	for i := range s.shards {
+		s.shards[i] = &expiryShard{
+			pending: make(map[string]*expiry),
+			wake:    make(chan struct{}, 1),
+		}
+
+		s.wait.Add(1)
+		go s.run(s.shards[i])
+	}
+
+	for i := 0; i < EXPIRERS; i++ {
+		s.wait.Add(1)
+		go s.expirer()
+	}
+
+	return s
+}
+
+// stop stops the scheduler's goroutines, waiting for any expiry in progress to finish.  Nothing is expired once it returns; deadlines still pending, or due but not yet expired, are left for the caller to flush.
+func (s *scheduler) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+
+	s.wait.Wait()
+}
+
+// shard returns the shard holding the request id's deadline
+func (s *scheduler) shard(reqId string) *expiryShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(reqId))
+
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// wakeUp wakes the shard's goroutine, if it isn't already due to wake
+func (sh *expiryShard) wakeUp() {
+	select {
+	case sh.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule sets the deadline for the request id, replacing any existing deadline
+func (s *scheduler) Schedule(reqId string, deadline time.Time) {
+	sh := s.shard(reqId)
+
+	sh.Lock()
+	e, exists := sh.pending[reqId]
+	if exists {
+		e.deadline = deadline
+		heap.Fix(&sh.heap, e.index)
+	} else {
+		e = &expiry{reqId: reqId, deadline: deadline}
+		heap.Push(&sh.heap, e)
+		sh.pending[reqId] = e
+		atomic.AddInt64(&s.count, 1)
+	}
+
+	// Only need to wake the loop if its next deadline just changed
+	earliest := sh.heap[0] == e
+	sh.Unlock()
+
+	if earliest {
+		sh.wakeUp()
+	}
+}
+
+// Expedite brings the deadline for a pending request id forward.  It does nothing if the request id isn't pending, or is already due sooner.
+func (s *scheduler) Expedite(reqId string, deadline time.Time) {
+	sh := s.shard(reqId)
+
+	sh.Lock()
+	e, exists := sh.pending[reqId]
+	if !exists || !deadline.Before(e.deadline) {
+		sh.Unlock()
+		return
+	}
+
+	e.deadline = deadline
+	heap.Fix(&sh.heap, e.index)
+
+	earliest := sh.heap[0] == e
+	sh.Unlock()
+
+	if earliest {
+		sh.wakeUp()
+	}
+}
+
+// Cancel forgets the deadline for the request id
+func (s *scheduler) Cancel(reqId string) {
+	sh := s.shard(reqId)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	e, exists := sh.pending[reqId]
+	if !exists {
+		return
+	}
+
+	heap.Remove(&sh.heap, e.index)
+	delete(sh.pending, reqId)
+	atomic.AddInt64(&s.count, -1)
+}
+
+// pop removes the shard's earliest deadline.  The shard must be locked and not empty.
+func (s *scheduler) pop(sh *expiryShard) *expiry {
+	e := heap.Pop(&sh.heap).(*expiry)
+	delete(sh.pending, e.reqId)
+	atomic.AddInt64(&s.count, -1)
+
+	return e
+}
+
+// PopEarliest removes and returns the request id with the earliest deadline across every shard, or false if nothing is pending
+func (s *scheduler) PopEarliest() (reqId string, ok bool) {
+	for {
+		var earliest *expiry
+		var from *expiryShard
+
+		for _, sh := range s.shards {
+			sh.Lock()
+			if len(sh.heap) > 0 && (earliest == nil || sh.heap[0].deadline.Before(earliest.deadline)) {
+				earliest, from = sh.heap[0], sh
+			}
+			sh.Unlock()
+		}
+
+		if earliest == nil {
+			return reqId, ok
+		}
+
+		// Only pop it if it's still the shard's earliest, otherwise look again
+		from.Lock()
+		if len(from.heap) > 0 && from.heap[0] == earliest {
+			s.pop(from)
+			from.Unlock()
+
+			return earliest.reqId, true
+		}
+		from.Unlock()
+	}
+}
+
+// Len returns the number of pending deadlines
+func (s *scheduler) Len() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// run is the loop for one shard.  It hands everything that's due to the expirers, then sleeps until the next deadline or until woken by Schedule.
+func (s *scheduler) run(sh *expiryShard) {
+	defer s.wait.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		sh.Lock()
+		for len(sh.heap) > 0 && !sh.heap[0].deadline.After(time.Now()) {
+			e := s.pop(sh)
+
+			sh.Unlock()
+			select {
+			case s.due <- e.reqId:
+			case <-s.done:
+				return
+			}
+			sh.Lock()
+		}
+
+		wait := time.Hour
+		if len(sh.heap) > 0 {
+			wait = time.Until(sh.heap[0].deadline)
+		}
+		sh.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-sh.wake:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// expirer expires the request ids the shards find due
+func (s *scheduler) expirer() {
+	defer s.wait.Done()
+
+	for {
+		select {
+		case reqId := <-s.due:
+			s.expire(reqId)
+		case <-s.done:
+			return
+		}
+	}
+}
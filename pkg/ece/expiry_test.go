@@ -0,0 +1,204 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testExpiryRecorder records the order in which request ids expire
+type testExpiryRecorder struct {
+	sync.Mutex
+	reqIds []string
+}
+
+func (r *testExpiryRecorder) expire(reqId string) {
+	r.Lock()
+	r.reqIds = append(r.reqIds, reqId)
+	r.Unlock()
+}
+
+func (r *testExpiryRecorder) expired() []string {
+	r.Lock()
+	defer r.Unlock()
+
+	return append([]string{}, r.reqIds...)
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	recorder := &testExpiryRecorder{}
+	s := newScheduler(4, recorder.expire)
+	defer s.stop()
+
+	now := time.Now()
+	s.Schedule("c", now.Add(150*time.Millisecond))
+	s.Schedule("a", now.Add(50*time.Millisecond))
+	s.Schedule("b", now.Add(100*time.Millisecond))
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return len(recorder.expired()) == 3, fmt.Sprintf("expired: %v", recorder.expired())
+	})
+	if !ok {
+		t.Error(message)
+	}
+
+	assert.Equal(t, recorder.expired(), []string{"a", "b", "c"}, "Request ids expire in deadline order.")
+	assert.Equal(t, s.Len(), 0, "Nothing left pending.")
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	recorder := &testExpiryRecorder{}
+	s := newScheduler(4, recorder.expire)
+	defer s.stop()
+
+	now := time.Now()
+	s.Schedule("a", now.Add(time.Hour))
+	s.Schedule("b", now.Add(time.Hour))
+	s.Schedule("b", now.Add(10*time.Millisecond))
+
+	assert.Equal(t, s.Len(), 2, "Rescheduling doesn't add a second deadline.")
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return len(recorder.expired()) == 1, fmt.Sprintf("expired: %v", recorder.expired())
+	})
+	if !ok {
+		t.Error(message)
+	}
+
+	assert.Equal(t, recorder.expired(), []string{"b"}, "Rescheduled request id expires early.")
+	assert.Equal(t, s.Len(), 1, "Other request id still pending.")
+}
+
+// TestSchedulerSlowExpiry checks that an expiry stuck on a slow sink doesn't hold up the others, or scheduling
+func TestSchedulerSlowExpiry(t *testing.T) {
+	recorder := &testExpiryRecorder{}
+	release := make(chan struct{})
+
+	s := newScheduler(4, func(reqId string) {
+		if reqId == "slow" {
+			<-release
+		}
+		recorder.expire(reqId)
+	})
+	defer s.stop()
+	defer close(release)
+
+	now := time.Now()
+	s.Schedule("slow", now)
+	s.Schedule("a", now.Add(10*time.Millisecond))
+	s.Schedule("b", now.Add(20*time.Millisecond))
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return len(recorder.expired()) == 2, fmt.Sprintf("expired: %v", recorder.expired())
+	})
+	if !ok {
+		t.Error(message)
+	}
+
+	// The expirers race each other, so a and b may finish in either order
+	expired := recorder.expired()
+	sort.Strings(expired)
+	assert.Equal(t, expired, []string{"a", "b"}, "Others expire while one is stuck.")
+}
+
+func TestSchedulerStop(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	recorder := &testExpiryRecorder{}
+	s := newScheduler(4, recorder.expire)
+	s.Schedule("a", time.Now().Add(50*time.Millisecond))
+
+	s.stop()
+	s.stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Equal(t, len(recorder.expired()), 0, "Nothing expires once stopped.")
+	assert.Equal(t, s.Len(), 1, "Deadline left pending for the caller.")
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return runtime.NumGoroutine() <= before, fmt.Sprintf("%d goroutines, %d before", runtime.NumGoroutine(), before)
+	})
+	if !ok {
+		t.Errorf("scheduler goroutines left running: %s", message)
+	}
+}
+
+// TestExpiryGoroutines holds a large number of pending events and checks that doing so doesn't cost a goroutine apiece
+func TestExpiryGoroutines(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = nil
+
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20000; i++ {
+		err := ece.AddEvent(testWafEntryMessageFor(fmt.Sprintf("req-%d", i)))
+		if err != nil {
+			t.Fatalf("failed adding event: %s", err)
+		}
+	}
+
+	after := runtime.NumGoroutine()
+
+	assert.Equal(t, ece.expiries.Len(), 20000, "Every event has a pending deadline.")
+
+	if after-before > 5 {
+		t.Errorf("goroutine count grew from %d to %d holding 20000 pending events", before, after)
+	}
+}
+
+// BenchmarkAddEvent adds events that all stay pending, reporting the goroutines and heap held per pending event
+func BenchmarkAddEvent(b *testing.B) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = nil
+
+	messages := make([]string, b.N)
+	for i := range messages {
+		messages[i] = testWafEntryMessageFor(fmt.Sprintf("req-%d", i))
+	}
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	heapBefore := stats.HeapAlloc
+	goroutinesBefore := runtime.NumGoroutine()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for _, message := range messages {
+		_ = ece.AddEvent(message)
+	}
+
+	b.StopTimer()
+
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutinesBefore), "goroutines")
+	b.ReportMetric(float64(int64(stats.HeapAlloc)-int64(heapBefore))/float64(b.N), "heap-bytes/pending")
+}
+
+// BenchmarkAddEventExpiring adds events under a short TTL, so they're flushed while the benchmark runs
+func BenchmarkAddEventExpiring(b *testing.B) {
+	ece := NewECE(time.Millisecond, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = nil
+
+	goroutinesBefore := runtime.NumGoroutine()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_ = ece.AddEvent(testWafEntryMessageFor(fmt.Sprintf("req-%d", i)))
+	}
+
+	b.StopTimer()
+
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutinesBefore), "goroutines")
+	b.ReportMetric(float64(ece.expiries.Len()), "pending")
+}
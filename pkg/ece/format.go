@@ -0,0 +1,274 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+const FORMAT_JSON = "json"
+const FORMAT_CEF = "cef"
+const FORMAT_LEEF = "leef"
+
+// FORMAT_VENDOR, FORMAT_PRODUCT and FORMAT_PRODUCT_VERSION identify the device in CEF and LEEF headers
+const FORMAT_VENDOR = "Fastly"
+const FORMAT_PRODUCT = "WAF"
+const FORMAT_PRODUCT_VERSION = "1.0"
+
+const ACTION_BLOCKED = "blocked"
+const ACTION_LOGGED = "logged"
+const ACTION_ALLOWED = "allowed"
+
+// LEEF_TIME_LAYOUT the default LEEF devTime format, MMM dd yyyy HH:mm:ss.SSS zzz
+const LEEF_TIME_LAYOUT = "Jan 02 2006 15:04:05.000 MST"
+
+// MODSECURITY_SEVERITIES maps WAF rule severities, on ModSecurity's scale where 0 is an emergency and 7 debug, to the 0-10 scale of CEF and LEEF, where 10 is the most severe
+var MODSECURITY_SEVERITIES = map[int]int{
+	0: 10,
+	1: 9,
+	2: 8,
+	3: 7,
+	4: 5,
+	5: 3,
+	6: 1,
+	7: 0,
+}
+
+// Formatter renders an event as a single line, without the trailing newline, for sinks that write lines
+type Formatter interface {
+	Format(event OutputEvent) ([]byte, error)
+}
+
+// NewFormatter returns the formatter with the given name: json, typed, cef, leef, ecs or ocsf
+func NewFormatter(name string) (formatter Formatter, err error) {
+	switch strings.ToLower(name) {
+	case FORMAT_JSON, "":
+		return JSONFormatter{}, err
+	case FORMAT_CEF:
+		return CEFFormatter{}, err
+	case FORMAT_LEEF:
+		return LEEFFormatter{}, err
+	case FORMAT_ECS:
+		return ECSFormatter{}, err
+	case FORMAT_OCSF:
+		return OCSFFormatter{}, err
+	case FORMAT_TYPED:
+		return TypedFormatter{}, err
+	}
+
+	err = fmt.Errorf("unsupported output format %q.  Must be one of json, typed, cef, leef, ecs or ocsf", name)
+
+	return formatter, err
+}
+
+// formatOrJSON formats the event with the formatter, or as JSON if there isn't one
+func formatOrJSON(formatter Formatter, event OutputEvent) ([]byte, error) {
+	if formatter == nil {
+		formatter = JSONFormatter{}
+	}
+
+	return formatter.Format(event)
+}
+
+// JSONFormatter renders events as our own JSON, the default
+type JSONFormatter struct{}
+
+func (f JSONFormatter) Format(event OutputEvent) (line []byte, err error) {
+	line, err = json.Marshal(event)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshall output for req id %q", event.RequestId)
+	}
+
+	return line, err
+}
+
+// Action returns what the WAF did with the request: blocked, logged or allowed
+func Action(event OutputEvent) string {
+	switch {
+	case event.WafBlocked == "1":
+		return ACTION_BLOCKED
+	case event.WafLogged == "1":
+		return ACTION_LOGGED
+	}
+
+	return ACTION_ALLOWED
+}
+
+// Severity returns the event's severity on the 0-10 scale, from the most severe of its WAF rules, and that rule's id.  Severities outside ModSecurity's 0-7, such as the 99 Fastly sends when no severity is set, are ignored, leaving a severity of 0 and no rule.
+func Severity(event OutputEvent) (severity int, ruleId string) {
+	worst := len(MODSECURITY_SEVERITIES)
+
+	for _, waf := range event.WafEvents {
+		level, err := strconv.Atoi(waf.Severity)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := MODSECURITY_SEVERITIES[level]; ok && level < worst {
+			worst = level
+			ruleId = waf.RuleId
+		}
+	}
+
+	return MODSECURITY_SEVERITIES[worst], ruleId
+}
+
+// requestURL returns the URL requested, taking the scheme from whether the client used TLS.  A URI that isn't a path, say because it's still base64 encoded, is put after a slash rather than run into the host.
+func requestURL(event OutputEvent) string {
+	uri := event.ReqURI
+	if event.ReqHHost == "" || strings.Contains(uri, "://") {
+		return uri
+	}
+
+	if uri != "" && !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+
+	scheme := "http"
+	if event.TlsProtocol != "" {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, event.ReqHHost, uri)
+}
+
+// ruleIdList returns the event's rule ids, comma separated
+func ruleIdList(event OutputEvent) string {
+	ids := make([]string, 0, len(event.RuleIds))
+	for _, id := range event.RuleIds {
+		ids = append(ids, strconv.Itoa(id))
+	}
+
+	return strings.Join(ids, ",")
+}
+
+// signatureId the event's class in CEF and LEEF headers: the id of its most severe rule, or else what the WAF did
+func signatureId(event OutputEvent) string {
+	_, ruleId := Severity(event)
+	if ruleId != "" {
+		return ruleId
+	}
+
+	return Action(event)
+}
+
+// extension a key/value pair in the extension of a CEF or LEEF line
+type extension struct {
+	key   string
+	value string
+}
+
+// escapeHeader escapes a CEF or LEEF header field, in which backslashes and pipes are special and line breaks aren't allowed
+func escapeHeader(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ").Replace(s)
+}
+
+// CEFFormatter renders events in ArcSight's Common Event Format.  The client IP is src, the URL requested is request, what the WAF did is act, and the rule ids are the cs1 custom string.  Severity is that of the most severe rule.
+type CEFFormatter struct{}
+
+// escapeCEF escapes a CEF extension value, in which backslashes and equals signs are special and line breaks are written as \n and \r
+func escapeCEF(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`).Replace(s)
+}
+
+func (f CEFFormatter) Format(event OutputEvent) (line []byte, err error) {
+	severity, _ := Severity(event)
+
+	extensions := []extension{
+		{"src", event.ClientIp},
+		{"requestMethod", event.ReqMethod},
+		{"request", requestURL(event)},
+		{"requestClientApplication", event.ReqHUserAgent},
+		{"act", Action(event)},
+		{"externalId", event.RequestId},
+		{"cs1Label", "ruleIds"},
+		{"cs1", ruleIdList(event)},
+		{"cs2Label", "serviceId"},
+		{"cs2", event.ServiceId},
+		{"cs3Label", "datacenter"},
+		{"cs3", event.Datacenter},
+		{"cn1Label", "anomalyScore"},
+		{"cn1", event.AnomalyScore},
+		{"cn2Label", "httpStatus"},
+		{"cn2", event.RespStatus},
+	}
+
+	if when, ok := startTime(event); ok {
+		extensions = append([]extension{{"rt", strconv.FormatInt(when.UnixNano()/1e6, 10)}}, extensions...)
+	}
+
+	b := &strings.Builder{}
+	_, _ = fmt.Fprintf(b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		escapeHeader(FORMAT_VENDOR),
+		escapeHeader(FORMAT_PRODUCT),
+		escapeHeader(FORMAT_PRODUCT_VERSION),
+		escapeHeader(signatureId(event)),
+		escapeHeader(fmt.Sprintf("Request %s by WAF", Action(event))),
+		severity)
+
+	sep := ""
+	for _, ext := range extensions {
+		if ext.value == "" {
+			continue
+		}
+		_, _ = fmt.Fprintf(b, "%s%s=%s", sep, ext.key, escapeCEF(ext.value))
+		sep = " "
+	}
+
+	return []byte(b.String()), err
+}
+
+// LEEFFormatter renders events in QRadar's Log Event Extended Format, version 2.0, tab delimited.  The mapping follows CEFFormatter's, using LEEF's own keys where it has them: url for the URL requested, and sev, at least 1, for severity.
+type LEEFFormatter struct{}
+
+// escapeLEEF makes a LEEF attribute value safe.  LEEF has no escaping for values, so tabs, the delimiter, and line breaks become spaces.
+func escapeLEEF(s string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+func (f LEEFFormatter) Format(event OutputEvent) (line []byte, err error) {
+	severity, _ := Severity(event)
+	if severity < 1 {
+		severity = 1
+	}
+
+	extensions := []extension{
+		{"cat", "waf"},
+		{"sev", strconv.Itoa(severity)},
+		{"src", event.ClientIp},
+		{"method", event.ReqMethod},
+		{"url", requestURL(event)},
+		{"userAgent", event.ReqHUserAgent},
+		{"act", Action(event)},
+		{"requestId", event.RequestId},
+		{"ruleIds", ruleIdList(event)},
+		{"serviceId", event.ServiceId},
+		{"datacenter", event.Datacenter},
+		{"anomalyScore", event.AnomalyScore},
+		{"httpStatus", event.RespStatus},
+	}
+
+	if when, ok := startTime(event); ok {
+		extensions = append([]extension{{"devTime", when.UTC().Format(LEEF_TIME_LAYOUT)}}, extensions...)
+	}
+
+	b := &strings.Builder{}
+	_, _ = fmt.Fprintf(b, "LEEF:2.0|%s|%s|%s|%s|x09|",
+		escapeHeader(FORMAT_VENDOR),
+		escapeHeader(FORMAT_PRODUCT),
+		escapeHeader(FORMAT_PRODUCT_VERSION),
+		escapeHeader(signatureId(event)))
+
+	sep := ""
+	for _, ext := range extensions {
+		if ext.value == "" {
+			continue
+		}
+		_, _ = fmt.Fprintf(b, "%s%s=%s", sep, ext.key, escapeLEEF(ext.value))
+		sep = "\t"
+	}
+
+	return []byte(b.String()), err
+}
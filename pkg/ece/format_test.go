@@ -0,0 +1,212 @@
+package ece
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+// testSchemaEvents the events schema mappings are checked against, by golden file name
+func testSchemaEvents() map[string]OutputEvent {
+	return map[string]OutputEvent{
+		"logged":  testOutputEvent(),
+		"blocked": testBlockedEvent(),
+		"orphan":  {RequestId: "orphan"},
+	}
+}
+
+// checkGolden compares the formatter's output for each of testSchemaEvents, indented, with testdata/<schema>/<name>.json, or rewrites the files with -update
+func checkGolden(t *testing.T, schema string, formatter Formatter) {
+	for name, event := range testSchemaEvents() {
+		t.Run(name, func(t *testing.T) {
+			line, err := formatter.Format(event)
+			if err != nil {
+				t.Fatalf("failed formatting: %s", err)
+			}
+
+			got := &bytes.Buffer{}
+			err = json.Indent(got, line, "", "  ")
+			if err != nil {
+				t.Fatalf("output isn't JSON: %s", err)
+			}
+			got.WriteByte('\n')
+
+			path := filepath.Join("testdata", schema, name+".json")
+
+			if *updateGolden {
+				err = ioutil.WriteFile(path, got.Bytes(), 0644)
+				if err != nil {
+					t.Fatalf("failed writing %s: %s", path, err)
+				}
+			}
+
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed reading %s: %s", path, err)
+			}
+
+			assert.Equal(t, got.String(), string(want), fmt.Sprintf("Output matches %s.", path))
+		})
+	}
+}
+
+// testBlockedEvent an event for a request the WAF blocked, matching two rules of differing severity
+func testBlockedEvent() OutputEvent {
+	event := testOutputEvent()
+	event.WafBlocked = "1"
+	event.ReqURI = "/search?q=a=b|c"
+	event.TlsProtocol = "TLSv1.2"
+	event.RuleIds = []int{942100, 920350}
+	event.WafEvents = []OutputWaf{
+		{RuleId: "920350", Severity: "4"},
+		{RuleId: "942100", Severity: "2"},
+	}
+
+	return event
+}
+
+func TestNewFormatter(t *testing.T) {
+	inputs := []struct {
+		name string
+		want Formatter
+		ok   bool
+	}{
+		{"", JSONFormatter{}, true},
+		{"json", JSONFormatter{}, true},
+		{"CEF", CEFFormatter{}, true},
+		{"leef", LEEFFormatter{}, true},
+		{"ecs", ECSFormatter{}, true},
+		{"OCSF", OCSFFormatter{}, true},
+		{"xml", nil, false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			formatter, err := NewFormatter(tc.name)
+			assert.Equal(t, err == nil, tc.ok, fmt.Sprintf("Error meets expectations: %v", err))
+			assert.Equal(t, formatter, tc.want, "Formatter meets expectations.")
+		})
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	inputs := []struct {
+		name     string
+		event    OutputEvent
+		severity int
+		ruleId   string
+	}{
+		{"unset", testOutputEvent(), 0, ""},
+		{"most severe rule", testBlockedEvent(), 8, "942100"},
+		{"no rules", OutputEvent{}, 0, ""},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			severity, ruleId := Severity(tc.event)
+			assert.Equal(t, severity, tc.severity, "Severity meets expectations.")
+			assert.Equal(t, ruleId, tc.ruleId, "Rule meets expectations.")
+		})
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	inputs := []struct {
+		name  string
+		event OutputEvent
+		url   string
+	}{
+		{"path", OutputEvent{ReqHHost: "api.scribd.com", ReqURI: "/search?q=a"}, "http://api.scribd.com/search?q=a"},
+		{"tls", OutputEvent{ReqHHost: "api.scribd.com", ReqURI: "/", TlsProtocol: "TLSv1.2"}, "https://api.scribd.com/"},
+		{"not a path", OutputEvent{ReqHHost: "api.scribd.com", ReqURI: "L2luZGV4Lmh0bWwK"}, "http://api.scribd.com/L2luZGV4Lmh0bWwK"},
+		{"absolute", OutputEvent{ReqHHost: "api.scribd.com", ReqURI: "http://example.com/"}, "http://example.com/"},
+		{"no uri", OutputEvent{ReqHHost: "api.scribd.com"}, "http://api.scribd.com"},
+		{"no host", OutputEvent{ReqURI: "/search"}, "/search"},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, requestURL(tc.event), tc.url, "URL meets expectations.")
+		})
+	}
+}
+
+func TestCEF(t *testing.T) {
+	inputs := []struct {
+		name  string
+		event OutputEvent
+		want  string
+	}{
+		{
+			"logged",
+			testOutputEvent(),
+			`CEF:0|Fastly|WAF|1.0|allowed|Request allowed by WAF|0|rt=1521150005000 src=8.8.8.8 requestMethod=POST request=http://api.scribd.com/L2luZGV4Lmh0bWwK requestClientApplication=Zm9vLzEuMQo\= act=allowed externalId=65df6a015f5a85fdf3559acad090ce1c567cbceacefea4baa476406b1d876392 cs1Label=ruleIds cs1=0 cs2Label=serviceId cs2=AAABBBB cs3Label=datacenter cs3=SFO cn1Label=anomalyScore cn1=0 cn2Label=httpStatus cn2=200`,
+		},
+		{
+			"blocked",
+			testBlockedEvent(),
+			`CEF:0|Fastly|WAF|1.0|942100|Request blocked by WAF|8|rt=1521150005000 src=8.8.8.8 requestMethod=POST request=https://api.scribd.com/search?q\=a\=b|c requestClientApplication=Zm9vLzEuMQo\= act=blocked externalId=65df6a015f5a85fdf3559acad090ce1c567cbceacefea4baa476406b1d876392 cs1Label=ruleIds cs1=942100,920350 cs2Label=serviceId cs2=AAABBBB cs3Label=datacenter cs3=SFO cn1Label=anomalyScore cn1=0 cn2Label=httpStatus cn2=200`,
+		},
+		{
+			"orphan",
+			OutputEvent{RequestId: "orphan", ReqHUserAgent: "a\\b\nc"},
+			`CEF:0|Fastly|WAF|1.0|allowed|Request allowed by WAF|0|requestClientApplication=a\\b\nc act=allowed externalId=orphan cs1Label=ruleIds cs2Label=serviceId cs3Label=datacenter cn1Label=anomalyScore cn2Label=httpStatus`,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			line, err := CEFFormatter{}.Format(tc.event)
+			if err != nil {
+				t.Fatalf("failed formatting: %s", err)
+			}
+
+			assert.Equal(t, string(line), tc.want, "CEF meets expectations.")
+		})
+	}
+}
+
+func TestLEEF(t *testing.T) {
+	inputs := []struct {
+		name  string
+		event OutputEvent
+		want  string
+	}{
+		{
+			"blocked",
+			testBlockedEvent(),
+			"LEEF:2.0|Fastly|WAF|1.0|942100|x09|devTime=Mar 15 2018 21:40:05.000 UTC\tcat=waf\tsev=8\tsrc=8.8.8.8\tmethod=POST\turl=https://api.scribd.com/search?q=a=b|c\tuserAgent=Zm9vLzEuMQo=\tact=blocked\trequestId=65df6a015f5a85fdf3559acad090ce1c567cbceacefea4baa476406b1d876392\truleIds=942100,920350\tserviceId=AAABBBB\tdatacenter=SFO\tanomalyScore=0\thttpStatus=200",
+		},
+		{
+			"orphan",
+			OutputEvent{RequestId: "or|phan", ReqHUserAgent: "a\tb"},
+			"LEEF:2.0|Fastly|WAF|1.0|allowed|x09|cat=waf\tsev=1\tuserAgent=a b\tact=allowed\trequestId=or|phan",
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			line, err := LEEFFormatter{}.Format(tc.event)
+			if err != nil {
+				t.Fatalf("failed formatting: %s", err)
+			}
+
+			assert.Equal(t, string(line), tc.want, "LEEF meets expectations.")
+		})
+	}
+}
+
+func TestECS(t *testing.T) {
+	checkGolden(t, FORMAT_ECS, ECSFormatter{})
+}
+
+func TestOCSF(t *testing.T) {
+	checkGolden(t, FORMAT_OCSF, OCSFFormatter{})
+}
@@ -0,0 +1,338 @@
+package ece
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ECE_FORWARD_TLS_CA_PATH_ENV_VAR names a PEM bundle of CAs to trust when forwarding over TLS, instead of the system roots
+const ECE_FORWARD_TLS_CA_PATH_ENV_VAR = "ECE_FORWARD_TLS_CA_PATH"
+
+// FORWARD_BUFFER_DEFAULT the number of events held for an unreachable collector before the oldest are dropped
+const FORWARD_BUFFER_DEFAULT = 10000
+
+// FORWARD_PRIORITY local0.info
+const FORWARD_PRIORITY = 16*8 + 6
+
+const FORWARD_APP_NAME = "fastly-waf-ece"
+const FORWARD_MSG_ID = "waf-event"
+
+const FORWARD_BACKOFF_MIN = 100 * time.Millisecond
+const FORWARD_BACKOFF_MAX = 30 * time.Second
+const FORWARD_WRITE_TIMEOUT = 10 * time.Second
+
+// SyslogSink forwards events to a syslog collector as RFC5424 messages, octet counted (RFC6587) over TCP and TLS, one per datagram over UDP.  Writes only queue the event, so a slow or unreachable collector never blocks correlation.  A single goroutine sends the queue, reconnecting with exponential backoff, and once the queue is full the oldest events are dropped.
+type SyslogSink struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	Network string
+	Address string
+
+	// Formatter renders each message.  JSON if unset.
+	Formatter Formatter
+
+	tlsConfig *tls.Config
+	hostname  string
+	pid       int
+
+	conn     net.Conn
+	queue    [][]byte
+	sending  bool
+	down     bool
+	capacity int
+	dropped  uint64
+	closed   bool
+	stop     chan struct{}
+	done     chan struct{}
+
+	failureReporter
+}
+
+// ParseForward parses a collector spec of the form network://address, where network is one of tcp, tls or udp, e.g. tls://siem.example.com:6514.  A bare address is treated as TCP.
+func ParseForward(spec string) (network string, address string, err error) {
+	parts := strings.SplitN(spec, "://", 2)
+	if len(parts) == 1 {
+		network = LISTENER_TCP
+		address = spec
+	} else {
+		network = strings.ToLower(parts[0])
+		address = parts[1]
+	}
+
+	switch network {
+	case LISTENER_TCP, LISTENER_TLS, LISTENER_UDP:
+	default:
+		err = fmt.Errorf("collector %q has unsupported network %q.  Must be one of tcp, tls or udp", spec, network)
+		return network, address, err
+	}
+
+	_, _, err = net.SplitHostPort(address)
+	if err != nil {
+		err = errors.Wrapf(err, "collector %q needs a host:port", spec)
+	}
+
+	return network, address, err
+}
+
+// forwardTLSConfig builds the TLS config for forwarding, trusting the CAs in the PEM bundle at caPath if it's set, the system roots if not
+func forwardTLSConfig(caPath string) (config *tls.Config, err error) {
+	config = &tls.Config{}
+
+	if caPath == "" {
+		return config, err
+	}
+
+	pem, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read CAs from %s", caPath)
+		return config, err
+	}
+
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no certificates found in %s", caPath)
+	}
+
+	return config, err
+}
+
+// NewSyslogSink creates a SyslogSink and starts sending.  tlsConfig is only used for the tls network, and may be nil to trust the CAs named by ECE_FORWARD_TLS_CA_PATH, or the system roots.  buffer is the most events to hold while the collector is unreachable; 0 means FORWARD_BUFFER_DEFAULT.
+func NewSyslogSink(network string, address string, tlsConfig *tls.Config, buffer int) (sink *SyslogSink, err error) {
+	if network == LISTENER_TLS && tlsConfig == nil {
+		tlsConfig, err = forwardTLSConfig(os.Getenv(ECE_FORWARD_TLS_CA_PATH_ENV_VAR))
+		if err != nil {
+			return sink, err
+		}
+	}
+
+	if buffer <= 0 {
+		buffer = FORWARD_BUFFER_DEFAULT
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	sink = &SyslogSink{
+		Network:   network,
+		Address:   address,
+		tlsConfig: tlsConfig,
+		hostname:  hostname,
+		pid:       os.Getpid(),
+		capacity:  buffer,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	sink.cond = sync.NewCond(&sink.Mutex)
+
+	go sink.run()
+
+	return sink, nil
+}
+
+// Write queues the event for the collector.  It only fails if the event can't be marshalled.
+func (s *SyslogSink) Write(event OutputEvent) (err error) {
+	payload, err := formatOrJSON(s.Formatter, event)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.queue = append(s.queue, s.frame(payload))
+	s.trim()
+	s.cond.Broadcast()
+
+	return err
+}
+
+// Flush waits until every queued event has been sent.  It gives up straight away if the collector is unreachable, rather than waiting out the outage.
+func (s *SyslogSink) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	for len(s.queue) > 0 || s.sending {
+		if s.down && !s.sending {
+			return fmt.Errorf("collector %s://%s unreachable, %d events unsent", s.Network, s.Address, len(s.queue))
+		}
+
+		s.cond.Wait()
+	}
+
+	return nil
+}
+
+// Close stops sending and closes the connection.  Anything still queued is lost, so Flush first.
+func (s *SyslogSink) Close() (err error) {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return err
+	}
+
+	s.closed = true
+	close(s.stop)
+	s.cond.Broadcast()
+	s.Unlock()
+
+	<-s.done
+
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+
+	return err
+}
+
+// Ready reports whether the collector is reachable.  Events are still queued while it isn't, but dropped once the buffer fills.
+func (s *SyslogSink) Ready() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.down {
+		return fmt.Errorf("collector %s://%s unreachable, %d events queued", s.Network, s.Address, len(s.queue))
+	}
+
+	return nil
+}
+
+// Dropped returns the number of events dropped because the queue was full
+func (s *SyslogSink) Dropped() uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.dropped
+}
+
+// frame formats the payload as an RFC5424 message, octet counted unless sent over UDP
+func (s *SyslogSink) frame(payload []byte) []byte {
+	message := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", FORWARD_PRIORITY, time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, FORWARD_APP_NAME, s.pid, FORWARD_MSG_ID, payload)
+
+	if s.Network == LISTENER_UDP {
+		return []byte(message)
+	}
+
+	return []byte(fmt.Sprintf("%d %s", len(message), message))
+}
+
+// trim drops the oldest queued events until the queue fits.  Must be called with the lock held.
+func (s *SyslogSink) trim() {
+	if excess := len(s.queue) - s.capacity; excess > 0 {
+		s.queue = s.queue[excess:]
+		s.dropped += uint64(excess)
+		s.gaveUp(excess)
+	}
+}
+
+// next waits for a queued message, and takes it off the queue.  Returns false once the sink is closed.
+func (s *SyslogSink) next() (message []byte, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		return message, false
+	}
+
+	message = s.queue[0]
+	s.queue = s.queue[1:]
+	s.sending = true
+
+	return message, true
+}
+
+// sent records the outcome of sending a message taken by next.  A message that failed goes back on the front of the queue.
+func (s *SyslogSink) sent(message []byte, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sending = false
+	s.down = err != nil
+
+	if err != nil {
+		s.queue = append([][]byte{message}, s.queue...)
+		s.trim()
+	}
+
+	s.cond.Broadcast()
+}
+
+// dial connects to the collector
+func (s *SyslogSink) dial() (conn net.Conn, err error) {
+	dialer := &net.Dialer{Timeout: FORWARD_WRITE_TIMEOUT}
+
+	if s.Network == LISTENER_TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(s.Network, s.Address)
+	}
+
+	if err != nil {
+		err = errors.Wrapf(err, "failed to connect to collector %s://%s", s.Network, s.Address)
+	}
+
+	return conn, err
+}
+
+// run sends queued messages until the sink is closed, reconnecting with exponential backoff whenever the collector can't be reached
+func (s *SyslogSink) run() {
+	defer close(s.done)
+
+	backoff := FORWARD_BACKOFF_MIN
+
+	for {
+		message, ok := s.next()
+		if !ok {
+			return
+		}
+
+		var err error
+		if s.conn == nil {
+			s.conn, err = s.dial()
+		}
+
+		if err == nil {
+			_ = s.conn.SetWriteDeadline(time.Now().Add(FORWARD_WRITE_TIMEOUT))
+			_, err = s.conn.Write(message)
+			if err != nil {
+				_ = s.conn.Close()
+				s.conn = nil
+				err = errors.Wrapf(err, "failed to write to collector %s://%s", s.Network, s.Address)
+			}
+		}
+
+		s.sent(message, err)
+
+		if err == nil {
+			backoff = FORWARD_BACKOFF_MIN
+			continue
+		}
+
+		_, _ = fmt.Fprintf(os.Stderr, "%s.  Retrying in %s\n", err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-s.stop:
+			return
+		}
+
+		backoff *= 2
+		if backoff > FORWARD_BACKOFF_MAX {
+			backoff = FORWARD_BACKOFF_MAX
+		}
+	}
+}
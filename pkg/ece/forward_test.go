@@ -0,0 +1,224 @@
+package ece
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCollector a syslog server recording the messages it receives
+type testCollector struct {
+	sync.Mutex
+	server   *syslog.Server
+	messages []string
+	appNames []string
+}
+
+// startTestCollector starts a collector parsing the format the SyslogSink sends on network
+func startTestCollector(t *testing.T, network string, address string) *testCollector {
+	collector := &testCollector{server: syslog.NewServer()}
+
+	if network == LISTENER_UDP {
+		collector.server.SetFormat(syslog.RFC5424)
+	} else {
+		collector.server.SetFormat(syslog.RFC6587)
+	}
+
+	channel := make(syslog.LogPartsChannel)
+	collector.server.SetHandler(syslog.NewChannelHandler(channel))
+
+	var err error
+	switch network {
+	case LISTENER_TLS:
+		keypair, keyErr := tls.LoadX509KeyPair(fmt.Sprintf("%s/cert.pem", tmpDir), fmt.Sprintf("%s/key.pem", tmpDir))
+		if keyErr != nil {
+			t.Fatalf("failed loading test cert: %s", keyErr)
+		}
+		// Don't ask the sink for a client cert
+		collector.server.SetTlsPeerNameFunc(nil)
+		err = collector.server.ListenTCPTLS(address, &tls.Config{Certificates: []tls.Certificate{keypair}})
+	case LISTENER_UDP:
+		err = collector.server.ListenUDP(address)
+	default:
+		err = collector.server.ListenTCP(address)
+	}
+	if err != nil {
+		t.Fatalf("failed starting collector on %s://%s: %s", network, address, err)
+	}
+
+	err = collector.server.Boot()
+	if err != nil {
+		t.Fatalf("failed booting collector: %s", err)
+	}
+
+	go func() {
+		for logParts := range channel {
+			collector.Lock()
+			collector.messages = append(collector.messages, fmt.Sprint(logParts["message"]))
+			collector.appNames = append(collector.appNames, fmt.Sprint(logParts["app_name"]))
+			collector.Unlock()
+		}
+	}()
+
+	return collector
+}
+
+// String returns the messages received so far, one per line
+func (c *testCollector) String() string {
+	c.Lock()
+	defer c.Unlock()
+
+	return strings.Join(c.messages, "\n")
+}
+
+func (c *testCollector) Stop() {
+	_ = c.server.Kill()
+}
+
+func TestParseForward(t *testing.T) {
+	inputs := []struct {
+		spec    string
+		network string
+		address string
+		ok      bool
+	}{
+		{"tls://siem.example.com:6514", LISTENER_TLS, "siem.example.com:6514", true},
+		{"UDP://10.0.0.1:514", LISTENER_UDP, "10.0.0.1:514", true},
+		{"10.0.0.1:514", LISTENER_TCP, "10.0.0.1:514", true},
+		{"unixgram:///dev/log", "unixgram", "/dev/log", false},
+		{"tcp://10.0.0.1", LISTENER_TCP, "10.0.0.1", false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.spec, func(t *testing.T) {
+			network, address, err := ParseForward(tc.spec)
+
+			assert.Equal(t, err == nil, tc.ok, fmt.Sprintf("Parse error meets expectations: %v", err))
+			assert.Equal(t, network, tc.network, "Network meets expectations.")
+			assert.Equal(t, address, tc.address, "Address meets expectations.")
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	for _, network := range []string{LISTENER_TCP, LISTENER_TLS, LISTENER_UDP} {
+		t.Run(network, func(t *testing.T) {
+			address := testAddress()
+			collector := startTestCollector(t, network, address)
+			defer collector.Stop()
+
+			sink, err := NewSyslogSink(network, address, tlsConfig, 0)
+			if err != nil {
+				t.Fatalf("failed creating sink: %s", err)
+			}
+
+			events := []OutputEvent{testOutputEvent(), {RequestId: "other"}}
+			for _, event := range events {
+				err = sink.Write(event)
+				if err != nil {
+					t.Errorf("failed writing: %s", err)
+				}
+			}
+
+			err = sink.Flush()
+			if err != nil {
+				t.Errorf("failed flushing: %s", err)
+			}
+
+			ok, message := within(time.Second, func() (bool, string) {
+				return compareOutput(collector.String(), events)
+			})
+			if !ok {
+				t.Error(message)
+			}
+
+			collector.Lock()
+			assert.Equal(t, collector.appNames, []string{FORWARD_APP_NAME, FORWARD_APP_NAME}, "Sent as RFC5424 with our app name.")
+			collector.Unlock()
+
+			err = sink.Close()
+			if err != nil {
+				t.Errorf("failed closing: %s", err)
+			}
+		})
+	}
+}
+
+// TestForwardReconnect queues events while the collector is down, checks the oldest are dropped once the buffer is full, and that the rest are delivered once it comes up
+func TestForwardReconnect(t *testing.T) {
+	address := testAddress()
+
+	sink, err := NewSyslogSink(LISTENER_TCP, address, nil, 2)
+	if err != nil {
+		t.Fatalf("failed creating sink: %s", err)
+	}
+	defer sink.Close()
+
+	events := []OutputEvent{}
+	for i := 0; i < 5; i++ {
+		event := OutputEvent{RequestId: fmt.Sprintf("req-%d", i)}
+		events = append(events, event)
+
+		err = sink.Write(event)
+		if err != nil {
+			t.Errorf("failed writing: %s", err)
+		}
+	}
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return sink.Dropped() == 3, fmt.Sprintf("dropped %d events, expected 3", sink.Dropped())
+	})
+	if !ok {
+		t.Error(message)
+	}
+
+	err = sink.Flush()
+	if err == nil {
+		t.Error("unreachable collector not reported by flush")
+	}
+
+	collector := startTestCollector(t, LISTENER_TCP, address)
+	defer collector.Stop()
+
+	ok, message = within(5*time.Second, func() (bool, string) {
+		return compareOutput(collector.String(), events[3:])
+	})
+	if !ok {
+		t.Error(message)
+	}
+}
+
+// TestForwardNonBlocking checks that writes don't wait on an unreachable collector
+func TestForwardNonBlocking(t *testing.T) {
+	sink, err := NewSyslogSink(LISTENER_TCP, testAddress(), nil, 100)
+	if err != nil {
+		t.Fatalf("failed creating sink: %s", err)
+	}
+	defer sink.Close()
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{sink}
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		reqId := fmt.Sprintf("req-%d", i)
+		_ = ece.AddEvent(testWafEntryMessageFor(reqId))
+		_ = ece.WriteEvent(reqId)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("writing 1000 events to an unreachable collector took %s", time.Since(start))
+	}
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return sink.Dropped() == 900, fmt.Sprintf("dropped %d events, expected 900", sink.Dropped())
+	})
+	if !ok {
+		t.Error(message)
+	}
+}
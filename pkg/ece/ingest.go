@@ -0,0 +1,158 @@
+package ece
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTP_CHALLENGE_PATH is where Fastly checks that we're willing to receive logs before it starts sending them.  See https://docs.fastly.com/en/guides/log-streaming-https
+const HTTP_CHALLENGE_PATH = "/.well-known/fastly/logging/challenge"
+
+// max size of a single log line in a POSTed batch
+const HTTP_MAX_LINE_BYTES = 1024 * 1024
+
+// max size of a POSTed batch, once decompressed.  Fastly's batches are a few MB at most.
+const HTTP_MAX_BODY_BYTES = 32 * 1024 * 1024
+
+// how long a client gets to send a request's headers, and then the whole request, and how long an idle keep-alive connection is held open
+const HTTP_READ_HEADER_TIMEOUT = 10 * time.Second
+const HTTP_READ_TIMEOUT = time.Minute
+const HTTP_IDLE_TIMEOUT = 2 * time.Minute
+
+// HTTPHandler returns the handler for Fastly's HTTPS logging endpoint.  POSTed bodies are newline delimited batches of log lines, up to HTTP_MAX_BODY_BYTES, each of which is fed to the correlation engine as if it had arrived over syslog.
+func (ece *ECE) HTTPHandler(listener string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(HTTP_CHALLENGE_PATH, ece.httpChallenge)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ece.httpIngest(listener, w, r)
+	})
+
+	return mux
+}
+
+// httpChallenge answers Fastly's ownership check with the sha256 of each allowed service id, or * if any service may log here
+func (ece *ECE) httpChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	if len(ece.HTTPServiceIds) == 0 {
+		_, _ = fmt.Fprintln(w, "*")
+		return
+	}
+
+	for _, serviceId := range ece.HTTPServiceIds {
+		sum := sha256.Sum256([]byte(serviceId))
+		_, _ = fmt.Fprintln(w, hex.EncodeToString(sum[:]))
+	}
+}
+
+// httpIngest splits a POSTed batch into lines and handles each one.  A batch that can't be read in full is refused without ingesting any of it.
+func (ece *ECE) httpIngest(listener string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, HTTP_MAX_BODY_BYTES)
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			ece.metrics.parseFailures.WithLabelValues(PARSE_FAILURE_BAD_BATCH).Inc()
+			http.Error(w, fmt.Sprintf("bad gzip body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		// Capped again once decompressed, or a small body could inflate without bound
+		defer gz.Close()
+		body = http.MaxBytesReader(w, gz, HTTP_MAX_BODY_BYTES)
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), HTTP_MAX_LINE_BYTES)
+
+	// The whole batch is read before any of it is ingested, so one refused part way through, which Fastly will retry, isn't ingested twice
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		ece.metrics.parseFailures.WithLabelValues(PARSE_FAILURE_BAD_BATCH).Inc()
+		log.Printf("Error: failed reading batch from %s on %s: %s", r.RemoteAddr, listener, err)
+		http.Error(w, fmt.Sprintf("failed reading body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	// Lines that don't parse are counted and skipped, as over syslog, rather than failing the batch
+	for _, line := range lines {
+		ece.handleMessage(listener, line)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// listenHTTP starts an HTTP(S) server for the listener
+func (ece *ECE) listenHTTP(listener Listener) (err error) {
+	ln, err := net.Listen("tcp", listener.Address)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to start %s listener on %s", listener.Network, listener.Address)
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           ece.HTTPHandler(listener.String()),
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		ReadTimeout:       HTTP_READ_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+	}
+
+	if listener.Network == LISTENER_HTTPS {
+		server.TLSConfig, err = ece.tlsConfig()
+		if err != nil {
+			_ = ln.Close()
+			return err
+		}
+	}
+
+	ece.httpServers = append(ece.httpServers, server)
+	ece.httpWait.Add(1)
+
+	go func() {
+		defer ece.httpWait.Done()
+
+		var err error
+		if listener.Network == LISTENER_HTTPS {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			_, _ = fmt.Fprintf(os.Stderr, "%s listener on %s failed: %s\n", listener.Network, listener.Address, err)
+		}
+	}()
+
+	return err
+}
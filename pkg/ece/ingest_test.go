@@ -0,0 +1,181 @@
+package ece
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPChallenge(t *testing.T) {
+	inputs := []struct {
+		name       string
+		serviceIds []string
+		body       string
+	}{
+		{
+			"any-service",
+			[]string{},
+			"*\n",
+		},
+		{
+			"listed-services",
+			[]string{"AAABBBB", "CCCDDDD"},
+			"95482ac48ff12237a38cc0f913520b75eadb0d503de61fb592a55fb7c9a7c4dc\nad0804688c506247b54f03bf484a772f942fc7bb7f11083ba0f53ff57e860487\n",
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			ece := NewECE(time.Second, "/dev/null", 0, 0, 0, false, "")
+			ece.HTTPServiceIds = tc.serviceIds
+
+			recorder := httptest.NewRecorder()
+			ece.HTTPHandler("test").ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, HTTP_CHALLENGE_PATH, nil))
+
+			assert.Equal(t, recorder.Code, http.StatusOK, "Challenge succeeds.")
+			assert.Equal(t, recorder.Body.String(), tc.body, "Challenge response meets expectations.")
+		})
+	}
+}
+
+func TestHTTPIngest(t *testing.T) {
+	listener := Listener{Network: LISTENER_HTTP, Address: testAddress()}
+	client := http.DefaultClient
+
+	if useTls {
+		listener.Network = LISTENER_HTTPS
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+
+	ece, logs := testServerWithListeners([]Listener{listener})
+
+	batch := testWebEntryMessage() + "\n" + testWafEntryMessage() + "\n"
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte(batch))
+	_ = gz.Close()
+
+	inputs := []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{"ndjson", []byte(batch), ""},
+		{"gzip", compressed.Bytes(), "gzip"},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/", listener.Network, listener.Address), bytes.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("failed creating request: %s", err)
+			}
+
+			req.Header.Set("Content-Type", "application/x-ndjson")
+			if tc.encoding != "" {
+				req.Header.Set("Content-Encoding", tc.encoding)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed posting batch: %s", err)
+			}
+
+			_, _ = ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+
+			assert.Equal(t, resp.StatusCode, http.StatusOK, "Batch accepted.")
+
+			ok, message := within(time.Second, func() (bool, string) {
+				return compareOutput(logs.String(), []OutputEvent{testOutputEvent()})
+			})
+			if !ok {
+				t.Error(message)
+			}
+		})
+	}
+
+	_ = ece.Shutdown()
+	ece.Wait()
+}
+
+func TestHTTPIngestMethod(t *testing.T) {
+	ece := NewECE(time.Second, "/dev/null", 0, 0, 0, false, "")
+
+	recorder := httptest.NewRecorder()
+	ece.HTTPHandler("test").ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, recorder.Code, http.StatusMethodNotAllowed, "Only POST is accepted for logs.")
+}
+
+// TestHTTPIngestTooLarge checks that a batch over the size limit, even one that only grows that big once decompressed, is refused
+func TestHTTPIngestTooLarge(t *testing.T) {
+	ece := NewECE(time.Second, "/dev/null", 0, 0, 0, false, "")
+
+	batch := bytes.Repeat([]byte("\n"), HTTP_MAX_BODY_BYTES+1)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write(batch)
+	_ = gz.Close()
+
+	inputs := []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{"plain", batch, ""},
+		{"gzip", compressed.Bytes(), "gzip"},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tc.body))
+			if tc.encoding != "" {
+				req.Header.Set("Content-Encoding", tc.encoding)
+			}
+
+			recorder := httptest.NewRecorder()
+			ece.HTTPHandler("test").ServeHTTP(recorder, req)
+
+			assert.Equal(t, recorder.Code, http.StatusBadRequest, "Batch refused.")
+		})
+	}
+}
+
+// TestHTTPIngestBadLine checks that a line that doesn't parse is skipped without failing the batch, while one that can't be read fails it before anything is ingested
+func TestHTTPIngestBadLine(t *testing.T) {
+	inputs := []struct {
+		name    string
+		bad     string
+		code    int
+		pending int
+	}{
+		{"unparsable", "not a log line", http.StatusOK, 1},
+		{"too long", strings.Repeat("x", HTTP_MAX_LINE_BYTES+1), http.StatusBadRequest, 0},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+
+			batch := testWafEntryMessage() + "\n" + tc.bad + "\n" + testWebEntryMessage() + "\n"
+
+			recorder := httptest.NewRecorder()
+			ece.HTTPHandler("test").ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(batch)))
+
+			assert.Equal(t, recorder.Code, tc.code, "Status meets expectations.")
+			assert.Equal(t, ece.Pending(), tc.pending, "Ingested events meet expectations.")
+		})
+	}
+}
@@ -0,0 +1,487 @@
+package ece
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// journalRecord a single line of the journal.  Either a raw message accepted for a request id, or a marker that the request id's event is done with, i.e. written or dropped.
+type journalRecord struct {
+	Timestamp int64  `json:"ts"`
+	RequestId string `json:"id"`
+	Message   string `json:"msg,omitempty"`
+	Done      bool   `json:"done,omitempty"`
+}
+
+// journal an append-only log of the raw messages behind pending events, so they can be rebuilt after a restart or crash.  Each record is written with a single write, so survives the process dying, but the file is only synced to disk when compacted.
+type journal struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+// openJournal opens the journal at path for appending, creating it if necessary, and returns the records it already holds
+func openJournal(path string) (j *journal, records []journalRecord, err error) {
+	oldPath := path + ".old"
+
+	// A compaction interrupted by a crash leaves the start of the journal set aside, its live records perhaps already copied into the journal too
+	old, err := readJournal(oldPath)
+	if err != nil {
+		return j, records, err
+	}
+
+	records, err = readJournal(path)
+	if err != nil {
+		return j, records, err
+	}
+
+	if len(old) > 0 {
+		records = liveRecords(append(old, records...))
+
+		err = writeJournal(path, records)
+		if err != nil {
+			return j, records, err
+		}
+
+		_ = os.Remove(oldPath)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to open journal %s", path)
+		return j, records, err
+	}
+
+	j = &journal{path: path, file: file}
+
+	return j, records, err
+}
+
+// readJournal reads every record in the journal at path.  A missing journal has no records.  A truncated final line, as left by a crash mid-write, is ignored.
+func readJournal(path string) (records []journalRecord, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+
+	if err != nil {
+		err = errors.Wrapf(err, "failed to open journal %s", path)
+		return records, err
+	}
+
+	defer file.Close()
+
+	return decodeJournal(file)
+}
+
+// decodeJournal reads records from r until EOF
+func decodeJournal(r io.Reader) (records []journalRecord, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), HTTP_MAX_LINE_BYTES+1024)
+
+	for scanner.Scan() {
+		var record journalRecord
+
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "skipping unreadable journal record: %s\n", scanner.Text())
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		err = errors.Wrap(err, "failed to read journal")
+	}
+
+	return records, err
+}
+
+// writeJournal replaces the journal at path with the given records
+func writeJournal(path string, records []journalRecord) (err error) {
+	tmpPath := path + ".compact"
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create journal %s", tmpPath)
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	for _, record := range records {
+		err = encoder.Encode(record)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write journal %s", tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to replace journal %s", path)
+	}
+
+	return err
+}
+
+// liveRecords drops the records of request ids that are done with, keeping the rest in their original order.  A request id can reappear after it's done with, in which case the later records are live.  Repeats of a live record are dropped too, as a crash mid compaction leaves the live records in both the old and the compacted journal.
+func liveRecords(records []journalRecord) (live []journalRecord) {
+	byId := make(map[string][]int)
+	seen := make(map[journalRecord]bool)
+
+	for i, record := range records {
+		if record.Done {
+			for _, j := range byId[record.RequestId] {
+				delete(seen, records[j])
+			}
+			delete(byId, record.RequestId)
+			continue
+		}
+
+		if seen[record] {
+			continue
+		}
+		seen[record] = true
+
+		byId[record.RequestId] = append(byId[record.RequestId], i)
+	}
+
+	keep := make([]bool, len(records))
+	for _, indexes := range byId {
+		for _, i := range indexes {
+			keep[i] = true
+		}
+	}
+
+	for i, record := range records {
+		if keep[i] {
+			live = append(live, record)
+		}
+	}
+
+	return live
+}
+
+// write appends a single record
+func (j *journal) write(record journalRecord) (err error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshal journal record for %q", record.RequestId)
+		return err
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if j.file == nil {
+		// Closed
+		return err
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write journal record for %q", record.RequestId)
+	}
+
+	return err
+}
+
+// Append records a message accepted for the request id
+func (j *journal) Append(reqId string, received time.Time, message string) error {
+	return j.write(journalRecord{Timestamp: received.UnixNano(), RequestId: reqId, Message: message})
+}
+
+// Done records that the request id's event has been written or dropped, so its messages needn't be replayed
+func (j *journal) Done(reqId string) error {
+	return j.write(journalRecord{Timestamp: time.Now().UnixNano(), RequestId: reqId, Done: true})
+}
+
+// setAside moves the journal at path to oldPath for compacting.  If a failed compaction left an old file there, whose records are in no other, the journal is added to the end of it instead.
+func setAside(path string, oldPath string) (err error) {
+	_, err = os.Stat(oldPath)
+	if os.IsNotExist(err) {
+		return os.Rename(path, oldPath)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(oldPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		// Whatever was copied is repeated in the journal, which liveRecords tolerates
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Compact rewrites the journal without the records of request ids that are done with.  Appends carry on into a fresh file while the old one is filtered, and are added to the end of the compacted journal once it's ready.
+func (j *journal) Compact() (err error) {
+	oldPath := j.path + ".old"
+	compactPath := j.path + ".compact"
+
+	// Swap in a fresh file for appends
+	j.Lock()
+	err = j.file.Close()
+	if err != nil {
+		j.Unlock()
+		err = errors.Wrapf(err, "failed to close journal %s", j.path)
+		return err
+	}
+
+	err = setAside(j.path, oldPath)
+	if err != nil {
+		// Carry on appending to the journal as it is
+		j.file, _ = os.OpenFile(j.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+		j.Unlock()
+		err = errors.Wrapf(err, "failed to move journal %s aside", j.path)
+		return err
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	j.Unlock()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to open fresh journal %s", j.path)
+		return err
+	}
+
+	// Filter the old file, which nothing else is touching now
+	records, err := readJournal(oldPath)
+	if err != nil {
+		return err
+	}
+
+	compact, err := os.OpenFile(compactPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create compacted journal %s", compactPath)
+		return err
+	}
+
+	writer := bufio.NewWriter(compact)
+	encoder := json.NewEncoder(writer)
+	for _, record := range liveRecords(records) {
+		err = encoder.Encode(record)
+		if err != nil {
+			_ = compact.Close()
+			err = errors.Wrap(err, "failed to write compacted journal")
+			return err
+		}
+	}
+
+	// Add whatever was appended in the meantime, and swap the compacted file in
+	j.Lock()
+	defer j.Unlock()
+
+	_, err = j.file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(writer, j.file)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = compact.Sync()
+	}
+	if err != nil {
+		_ = compact.Close()
+		err = errors.Wrap(err, "failed to write compacted journal")
+		return err
+	}
+
+	err = os.Rename(compactPath, j.path)
+	if err != nil {
+		_ = compact.Close()
+		err = errors.Wrapf(err, "failed to replace journal %s", j.path)
+		return err
+	}
+
+	_ = j.file.Close()
+	j.file = compact
+
+	_ = os.Remove(oldPath)
+
+	return err
+}
+
+// Close syncs and closes the journal
+func (j *journal) Close() (err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	err = j.file.Sync()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to sync journal %s", j.path)
+		return err
+	}
+
+	err = j.file.Close()
+	j.file = nil
+	if err != nil {
+		err = errors.Wrapf(err, "failed to close journal %s", j.path)
+	}
+
+	return err
+}
+
+// openJournal opens the ECE's journal, replays the events it holds, and starts compacting it periodically
+func (ece *ECE) openJournal() (err error) {
+	j, records, err := openJournal(ece.JournalPath)
+	if err != nil {
+		return err
+	}
+
+	ece.journal = j
+
+	live := liveRecords(records)
+	ece.replay(live)
+
+	if len(live) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "Replayed %d messages from journal %s\n", len(live), ece.JournalPath)
+	}
+
+	interval := ece.JournalCompactInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ece.journalStop = make(chan struct{})
+	ece.journalWait.Add(1)
+
+	go func() {
+		defer ece.journalWait.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := j.Compact()
+				if err != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "error compacting journal: %s\n", err)
+				}
+			case <-ece.journalStop:
+				return
+			}
+		}
+	}()
+
+	return err
+}
+
+// closeJournal stops compaction, compacts one last time and closes the journal
+func (ece *ECE) closeJournal() (err error) {
+	if ece.journal == nil {
+		return err
+	}
+
+	close(ece.journalStop)
+	ece.journalWait.Wait()
+
+	err = ece.journal.Compact()
+	if err != nil {
+		return err
+	}
+
+	return ece.journal.Close()
+}
+
+// replay rebuilds pending events from journal records.  Each event keeps the deadline it had when its first message arrived, so events that should already have been written are written straight away.
+func (ece *ECE) replay(records []journalRecord) {
+	byId := make(map[string][]journalRecord)
+	order := []string{}
+
+	for _, record := range records {
+		if _, exists := byId[record.RequestId]; !exists {
+			order = append(order, record.RequestId)
+		}
+
+		byId[record.RequestId] = append(byId[record.RequestId], record)
+	}
+
+	for _, reqId := range order {
+		group := byId[reqId]
+
+		var wafs []WafEntry
+		var reqs []RequestEntry
+		var reqReceived time.Time
+		size := 0
+
+		for _, record := range group {
+			size += len(record.Message)
+
+			waf, err := UnmarshalWaf(record.Message)
+			if err == nil {
+				wafs = append(wafs, waf)
+				continue
+			}
+
+			req, err := UnmarshalWeb(record.Message)
+			if err == nil {
+				reqs = append(reqs, req)
+				reqReceived = time.Unix(0, record.Timestamp)
+				continue
+			}
+
+			_, _ = fmt.Fprintf(os.Stderr, "skipping unparseable journal message for %q: %s\n", reqId, record.Message)
+		}
+
+		// The whole group goes in under a single lock, so the event can't be written half replayed
+		ok := ece.addToEvent(reqId, time.Unix(0, group[0].Timestamp), "", size, func(event *Event) {
+			event.WafEntries = append(event.WafEntries, wafs...)
+			event.RequestEntries = append(event.RequestEntries, reqs...)
+		})
+		if !ok {
+			continue
+		}
+
+		if len(reqs) > 0 && ece.Completion == COMPLETION_REQUEST {
+			ece.expiries.Expedite(reqId, reqReceived.Add(ece.Grace))
+		}
+	}
+}
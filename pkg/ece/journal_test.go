@@ -0,0 +1,250 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveRecords(t *testing.T) {
+	records := []journalRecord{
+		{Timestamp: 1, RequestId: "a", Message: "a1"},
+		{Timestamp: 2, RequestId: "b", Message: "b1"},
+		{Timestamp: 3, RequestId: "a", Message: "a2"},
+		{Timestamp: 4, RequestId: "a", Done: true},
+		{Timestamp: 5, RequestId: "c", Message: "c1"},
+		{Timestamp: 6, RequestId: "a", Message: "a3"},
+	}
+
+	live := []string{}
+	for _, record := range liveRecords(records) {
+		live = append(live, record.Message)
+	}
+
+	assert.Equal(t, live, []string{"b1", "c1", "a3"}, "Records of done request ids dropped, order kept.")
+}
+
+// TestJournalCompactCrash checks that a crash between swapping in the compacted journal and removing the old one doesn't replay anything twice
+func TestJournalCompactCrash(t *testing.T) {
+	path := fmt.Sprintf("%s/crash.journal", tmpDir)
+	defer os.Remove(path)
+
+	old := []journalRecord{
+		{Timestamp: 1, RequestId: "a", Message: "a1"},
+		{Timestamp: 2, RequestId: "b", Message: "b1"},
+		{Timestamp: 3, RequestId: "a", Done: true},
+		{Timestamp: 4, RequestId: "c", Message: "c1"},
+	}
+
+	// The compacted journal holds the old journal's live records, then whatever was appended during compaction
+	compacted := append(liveRecords(old), journalRecord{Timestamp: 5, RequestId: "b", Message: "b2"}, journalRecord{Timestamp: 6, RequestId: "c", Done: true})
+
+	for file, records := range map[string][]journalRecord{path + ".old": old, path: compacted} {
+		err := writeJournal(file, records)
+		if err != nil {
+			t.Fatalf("failed writing %s: %s", file, err)
+		}
+	}
+
+	j, records, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("failed opening journal: %s", err)
+	}
+	defer j.Close()
+
+	messages := []string{}
+	for _, record := range records {
+		messages = append(messages, record.Message)
+	}
+
+	assert.Equal(t, messages, []string{"b1", "b2"}, "Each live record replayed once.")
+
+	_, err = os.Stat(path + ".old")
+	assert.Equal(t, os.IsNotExist(err), true, "Old journal removed.")
+}
+
+// TestJournalCompactFailure fails a compaction after the journal is set aside, then checks the next one keeps what was set aside
+func TestJournalCompactFailure(t *testing.T) {
+	path := fmt.Sprintf("%s/failure.journal", tmpDir)
+	defer os.Remove(path)
+
+	j, _, err := openJournal(path)
+	if err != nil {
+		t.Fatalf("failed opening journal: %s", err)
+	}
+	defer j.Close()
+
+	_ = j.Append("a", time.Now(), "a1")
+	_ = j.Append("b", time.Now(), "b1")
+
+	// Nothing can be created where the compacted journal goes
+	err = os.Mkdir(path+".compact", 0755)
+	if err != nil {
+		t.Fatalf("failed blocking compaction: %s", err)
+	}
+
+	err = j.Compact()
+	assert.Equal(t, err != nil, true, "Compaction failed.")
+
+	_ = os.Remove(path + ".compact")
+
+	_ = j.Append("c", time.Now(), "c1")
+	_ = j.Done("b")
+
+	err = j.Compact()
+	if err != nil {
+		t.Fatalf("failed compacting: %s", err)
+	}
+
+	records, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("failed reading journal: %s", err)
+	}
+
+	messages := []string{}
+	for _, record := range records {
+		messages = append(messages, record.Message)
+	}
+
+	assert.Equal(t, messages, []string{"a1", "c1"}, "Records set aside by the failed compaction kept.")
+
+	_, err = os.Stat(path + ".old")
+	assert.Equal(t, os.IsNotExist(err), true, "Old journal removed.")
+}
+
+// testJournaledECE creates an ECE journaling to path, without starting any listeners
+func testJournaledECE(t *testing.T, ttl time.Duration, path string) (ece *ECE, logs *testSink) {
+	logs = &testSink{}
+	ece = NewECE(ttl, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs}
+	ece.JournalPath = path
+
+	err := ece.openJournal()
+	if err != nil {
+		t.Fatalf("failed opening journal: %s", err)
+	}
+
+	return ece, logs
+}
+
+// TestJournalReplay journals some events, then rebuilds them in a second ECE as if after a crash
+func TestJournalReplay(t *testing.T) {
+	path := fmt.Sprintf("%s/replay.journal", tmpDir)
+	defer os.Remove(path)
+
+	before, _ := testJournaledECE(t, time.Hour, path)
+
+	for _, message := range []string{testWafEntryMessage(), testWebEntryMessage(), testWafEntryMessageFor("orphan"), testWafEntryMessageFor("written")} {
+		err := before.AddEvent(message)
+		if err != nil {
+			t.Fatalf("failed adding event: %s", err)
+		}
+	}
+
+	err := before.WriteEvent("written")
+	if err != nil {
+		t.Fatalf("failed writing event: %s", err)
+	}
+
+	after, logs := testJournaledECE(t, time.Hour, path)
+
+	assert.Equal(t, after.Pending(), 2, "Pending events rebuilt, written event not.")
+
+	for _, reqId := range []string{testWafEntry().RequestId, "orphan"} {
+		original, _ := before.events.Get(reqId)
+		replayed, exists := after.events.Get(reqId)
+		if !exists {
+			t.Fatalf("event %s not replayed", reqId)
+		}
+
+		assert.Equal(t, replayed.WafEntries, original.WafEntries, "Waf entries replayed.")
+		assert.Equal(t, replayed.RequestEntries, original.RequestEntries, "Req entries replayed.")
+		assert.Equal(t, replayed.created.Equal(original.created), true, "Replayed event keeps its original deadline.")
+	}
+
+	err = after.Flush(time.Now().Add(time.Second))
+	if err != nil {
+		t.Errorf("failed flushing: %s", err)
+	}
+
+	ok, message := compareOutput(logs.String(), []OutputEvent{
+		testOutputEvent(),
+		{
+			RequestId: "orphan",
+			RuleIds:   []int{0},
+			WafEvents: []OutputWaf{{RuleId: "0", Severity: "99", AnomalyScore: "0"}},
+		},
+	})
+	if !ok {
+		t.Error(message)
+	}
+
+	_ = before.closeJournal()
+	_ = after.closeJournal()
+}
+
+// TestJournalReplayExpired checks that events whose TTL ran out while the ECE was down are written as soon as they're replayed
+func TestJournalReplayExpired(t *testing.T) {
+	path := fmt.Sprintf("%s/expired.journal", tmpDir)
+	defer os.Remove(path)
+
+	before, _ := testJournaledECE(t, time.Hour, path)
+
+	_ = before.AddEvent(testWafEntryMessage())
+	_ = before.AddEvent(testWebEntryMessage())
+
+	after, logs := testJournaledECE(t, 10*time.Millisecond, path)
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return compareOutput(logs.String(), []OutputEvent{testOutputEvent()})
+	})
+	if !ok {
+		t.Error(message)
+	}
+
+	_ = before.closeJournal()
+	_ = after.closeJournal()
+}
+
+func TestJournalCompact(t *testing.T) {
+	path := fmt.Sprintf("%s/compact.journal", tmpDir)
+	defer os.Remove(path)
+
+	ece, _ := testJournaledECE(t, time.Hour, path)
+
+	_ = ece.AddEvent(testWafEntryMessageFor("a"))
+	_ = ece.AddEvent(testWafEntryMessageFor("b"))
+	_ = ece.WriteEvent("a")
+
+	err := ece.journal.Compact()
+	if err != nil {
+		t.Fatalf("failed compacting: %s", err)
+	}
+
+	// Appends carry on after compaction
+	_ = ece.AddEvent(testWafEntryMessageFor("c"))
+
+	records, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("failed reading journal: %s", err)
+	}
+
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.RequestId)
+	}
+
+	assert.Equal(t, ids, []string{"b", "c"}, "Compacted journal holds only pending events.")
+
+	err = ece.closeJournal()
+	if err != nil {
+		t.Errorf("failed closing journal: %s", err)
+	}
+
+	contents, _ := ioutil.ReadFile(path)
+	assert.Equal(t, strings.Count(string(contents), "\n"), 2, "Closing compacts once more, and still pending events are kept.")
+}
@@ -0,0 +1,405 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+const KAFKA_KEY_SERVICE_ID = "service_id"
+const KAFKA_KEY_CLIENT_IP = "client_ip"
+
+const KAFKA_ACKS_NONE = "none"
+const KAFKA_ACKS_LEADER = "leader"
+const KAFKA_ACKS_ALL = "all"
+
+const KAFKA_TOPIC_DEFAULT = "fastly-waf"
+const KAFKA_CLIENT_ID = "fastly-waf-ece"
+const KAFKA_RETRIES_DEFAULT = 5
+
+// KAFKA_BUFFER_DEFAULT how many events can wait for the producer before the oldest are dead lettered
+const KAFKA_BUFFER_DEFAULT = 10000
+
+// KAFKA_COMPRESSION_CODECS the compression codecs, by the names Kafka's own clients use for them
+var KAFKA_COMPRESSION_CODECS = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+// KafkaSink produces events to a Kafka topic as JSON, keyed by ServiceId or ClientIp.  Kafka hashes the key to pick a partition, so all of a service's or a client's events land on the same partition, in order.  Events Kafka won't take, after the producer's own retries, are appended to a dead letter file, in the same format as the output log, so they can be replayed.  Writes only queue the event, so brokers that are down or slow never block correlation; once the queue is full the oldest events are dead lettered too.
+type KafkaSink struct {
+	Brokers []string
+	Topic   string
+
+	// Key the event field to key messages by: KAFKA_KEY_SERVICE_ID or KAFKA_KEY_CLIENT_IP
+	Key string
+
+	// RequiredAcks how many replicas must have each message before it counts as sent
+	RequiredAcks sarama.RequiredAcks
+
+	Compression sarama.CompressionCodec
+
+	// Retries how many times the producer retries a message before giving up on it
+	Retries int
+
+	// Buffer how many events can wait for the producer
+	Buffer int
+
+	// DeadLetterPath the file undeliverable events are appended to.  If empty, they're only logged.
+	DeadLetterPath string
+
+	// Formatter renders message values.  JSON if unset.  Dead letters are always JSON, so they can be replayed.
+	Formatter Formatter
+
+	// Config the producer config, for anything not covered above, e.g. TLS or SASL.  Defaults to sarama's.
+	Config *sarama.Config
+
+	producer       sarama.AsyncProducer
+	deadLetter     *os.File
+	deadLetterLock sync.Mutex
+	done           sync.WaitGroup
+	fed            sync.WaitGroup
+
+	// cond signalled whenever messages are queued, and whenever in-flight messages are settled, for Flush.  Queued messages count as in flight.
+	cond     *sync.Cond
+	queue    []*sarama.ProducerMessage
+	closed   bool
+	inFlight int
+	failures int
+	sent     uint64
+	failed   uint64
+	dropped  uint64
+
+	failureReporter
+}
+
+// NewKafkaSink creates a KafkaSink for the cluster with the given brokers, with default settings.  Adjust them, then call Start.
+func NewKafkaSink(brokers []string) *KafkaSink {
+	return &KafkaSink{
+		Brokers:      brokers,
+		Topic:        KAFKA_TOPIC_DEFAULT,
+		Key:          KAFKA_KEY_SERVICE_ID,
+		RequiredAcks: sarama.WaitForAll,
+		Compression:  sarama.CompressionNone,
+		Retries:      KAFKA_RETRIES_DEFAULT,
+		Buffer:       KAFKA_BUFFER_DEFAULT,
+		cond:         sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// ParseKafkaAcks parses the required acks: none, leader or all
+func ParseKafkaAcks(acks string) (requiredAcks sarama.RequiredAcks, err error) {
+	switch strings.ToLower(acks) {
+	case KAFKA_ACKS_NONE:
+		return sarama.NoResponse, err
+	case KAFKA_ACKS_LEADER:
+		return sarama.WaitForLocal, err
+	case KAFKA_ACKS_ALL:
+		return sarama.WaitForAll, err
+	}
+
+	err = fmt.Errorf("unsupported kafka acks %q.  Must be one of none, leader or all", acks)
+
+	return requiredAcks, err
+}
+
+// ParseKafkaCompression parses the compression codec: none, gzip, snappy, lz4 or zstd
+func ParseKafkaCompression(compression string) (codec sarama.CompressionCodec, err error) {
+	codec, ok := KAFKA_COMPRESSION_CODECS[strings.ToLower(compression)]
+	if !ok {
+		err = fmt.Errorf("unsupported kafka compression %q.  Must be one of none, gzip, snappy, lz4 or zstd", compression)
+	}
+
+	return codec, err
+}
+
+// Start connects to the cluster and starts producing
+func (s *KafkaSink) Start() (err error) {
+	if len(s.Brokers) == 0 || s.Topic == "" {
+		err = errors.New("kafka sink needs brokers and a topic")
+		return err
+	}
+
+	if s.Key != KAFKA_KEY_SERVICE_ID && s.Key != KAFKA_KEY_CLIENT_IP {
+		err = fmt.Errorf("unsupported kafka key %q.  Must be %s or %s", s.Key, KAFKA_KEY_SERVICE_ID, KAFKA_KEY_CLIENT_IP)
+		return err
+	}
+
+	config := s.Config
+	if config == nil {
+		config = sarama.NewConfig()
+		config.ClientID = KAFKA_CLIENT_ID
+	}
+
+	config.Producer.RequiredAcks = s.RequiredAcks
+	config.Producer.Compression = s.Compression
+	config.Producer.Retry.Max = s.Retries
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	if s.Compression == sarama.CompressionZSTD && !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+		config.Version = sarama.V2_1_0_0
+	}
+
+	if s.DeadLetterPath != "" {
+		s.deadLetter, err = os.OpenFile(s.DeadLetterPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to open dead letter file %s", s.DeadLetterPath)
+			return err
+		}
+	}
+
+	s.producer, err = sarama.NewAsyncProducer(s.Brokers, config)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to connect to kafka brokers %s", strings.Join(s.Brokers, ","))
+		if s.deadLetter != nil {
+			_ = s.deadLetter.Close()
+		}
+		return err
+	}
+
+	s.done.Add(2)
+	go s.acked()
+	go s.undelivered()
+
+	s.fed.Add(1)
+	go s.feed()
+
+	return err
+}
+
+// key returns the message key for the event.  Orphaned waf entries carry no client ip, and perhaps no service id, so those fall back to the request id rather than all sharing the empty key, and so one partition.
+func (s *KafkaSink) key(event OutputEvent) string {
+	key := event.ServiceId
+	if s.Key == KAFKA_KEY_CLIENT_IP {
+		key = event.ClientIp
+	}
+
+	if key == "" {
+		return event.RequestId
+	}
+
+	return key
+}
+
+// message builds the message for the event, carrying the event as metadata so it can be dead lettered if it fails
+func (s *KafkaSink) message(event OutputEvent) (msg *sarama.ProducerMessage, err error) {
+	value, err := formatOrJSON(s.Formatter, event)
+	if err != nil {
+		return msg, err
+	}
+
+	msg = &sarama.ProducerMessage{
+		Topic:    s.Topic,
+		Key:      sarama.StringEncoder(s.key(event)),
+		Value:    sarama.ByteEncoder(value),
+		Metadata: event,
+	}
+
+	return msg, err
+}
+
+// Write queues the event for the producer, which sends it in the background.  If the queue is full, the oldest event is dead lettered to make room.  It fails if the event can't be formatted, or the sink is closed.
+func (s *KafkaSink) Write(event OutputEvent) (err error) {
+	msg, err := s.message(event)
+	if err != nil {
+		return err
+	}
+
+	s.cond.L.Lock()
+	if s.closed {
+		s.cond.L.Unlock()
+		err = fmt.Errorf("kafka sink closed, req id %q not written", event.RequestId)
+		return err
+	}
+
+	s.queue = append(s.queue, msg)
+	s.inFlight++
+
+	var oldest *sarama.ProducerMessage
+	if s.Buffer > 0 && len(s.queue) > s.Buffer {
+		oldest = s.queue[0]
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+
+	if oldest != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "kafka queue full, dead lettering req id %q\n", oldest.Metadata.(OutputEvent).RequestId)
+		s.undeliverable(oldest)
+	}
+
+	return err
+}
+
+// feed hands queued messages to the producer until the sink is closed and the queue drained.  Only it blocks on the producer.
+func (s *KafkaSink) feed() {
+	defer s.fed.Done()
+
+	for {
+		s.cond.L.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+
+		if len(s.queue) == 0 {
+			s.cond.L.Unlock()
+			return
+		}
+
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		s.cond.L.Unlock()
+
+		s.producer.Input() <- msg
+	}
+}
+
+// settle records the outcome of a message, waking Flush once nothing is in flight
+func (s *KafkaSink) settle(ok bool) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	s.inFlight--
+	if ok {
+		s.sent++
+	} else {
+		s.failed++
+		s.failures++
+		s.gaveUp(1)
+	}
+
+	if s.inFlight == 0 {
+		s.cond.Broadcast()
+	}
+}
+
+// acked counts messages Kafka acknowledged
+func (s *KafkaSink) acked() {
+	defer s.done.Done()
+
+	for range s.producer.Successes() {
+		s.settle(true)
+	}
+}
+
+// undelivered dead letters messages the producer gave up on
+func (s *KafkaSink) undelivered() {
+	defer s.done.Done()
+
+	for producerErr := range s.producer.Errors() {
+		event, _ := producerErr.Msg.Metadata.(OutputEvent)
+
+		_, _ = fmt.Fprintf(os.Stderr, "failed to produce req id %q to kafka: %s\n", event.RequestId, producerErr.Err)
+
+		s.undeliverable(producerErr.Msg)
+	}
+}
+
+// undeliverable dead letters a message that won't be produced, and settles it as failed
+func (s *KafkaSink) undeliverable(msg *sarama.ProducerMessage) {
+	event, _ := msg.Metadata.(OutputEvent)
+
+	err := s.deadLetterEvent(event)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+
+	s.settle(false)
+}
+
+// deadLetterEvent appends the event to the dead letter file, if there is one
+func (s *KafkaSink) deadLetterEvent(event OutputEvent) (err error) {
+	if s.deadLetter == nil {
+		return err
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshall req id %q for the dead letter file", event.RequestId)
+		return err
+	}
+
+	s.deadLetterLock.Lock()
+	_, err = s.deadLetter.Write(append(line, '\n'))
+	s.deadLetterLock.Unlock()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write req id %q to %s", event.RequestId, s.DeadLetterPath)
+	}
+
+	return err
+}
+
+// Flush waits until every event written so far has been acknowledged or dead lettered.  Returns an error if any failed since the last Flush.
+func (s *KafkaSink) Flush() (err error) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	for s.inFlight > 0 {
+		s.cond.Wait()
+	}
+
+	if s.failures > 0 {
+		err = fmt.Errorf("failed to produce %d events to kafka", s.failures)
+		s.failures = 0
+	}
+
+	return err
+}
+
+// Close refuses further writes, and shuts the producer down once it has everything queued, waiting for anything in flight.  Then it closes the dead letter file.
+func (s *KafkaSink) Close() (err error) {
+	s.cond.L.Lock()
+	alreadyClosed := s.closed
+	s.closed = true
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+
+	if alreadyClosed || s.producer == nil {
+		return err
+	}
+
+	s.fed.Wait()
+	s.producer.AsyncClose()
+	s.done.Wait()
+
+	if s.deadLetter != nil {
+		err = s.deadLetter.Close()
+	}
+
+	return err
+}
+
+// Sent returns the number of events Kafka has acknowledged
+func (s *KafkaSink) Sent() uint64 {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	return s.sent
+}
+
+// Failed returns the number of events that couldn't be produced, including those dropped from a full queue
+func (s *KafkaSink) Failed() uint64 {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	return s.failed
+}
+
+// Dropped returns the number of events dead lettered because the queue was full
+func (s *KafkaSink) Dropped() uint64 {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	return s.dropped
+}
@@ -0,0 +1,235 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKafkaTopic = "waf"
+
+// testKafkaBroker starts an in-process fake broker leading the single partition of testKafkaTopic, answering produce requests with produceErr
+func testKafkaBroker(t *testing.T, produceErr sarama.KError) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(testKafkaTopic, 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetVersion(3).
+			SetError(testKafkaTopic, 0, produceErr),
+	})
+
+	return broker
+}
+
+// produceRequests counts the produce requests the fake broker has had
+func produceRequests(broker *sarama.MockBroker) (count int) {
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestParseKafkaAcks(t *testing.T) {
+	inputs := []struct {
+		acks string
+		want sarama.RequiredAcks
+		ok   bool
+	}{
+		{"none", sarama.NoResponse, true},
+		{"leader", sarama.WaitForLocal, true},
+		{"ALL", sarama.WaitForAll, true},
+		{"2", 0, false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.acks, func(t *testing.T) {
+			acks, err := ParseKafkaAcks(tc.acks)
+			assert.Equal(t, err == nil, tc.ok, fmt.Sprintf("Error meets expectations: %v", err))
+			assert.Equal(t, acks, tc.want, "Acks meet expectations.")
+		})
+	}
+}
+
+func TestParseKafkaCompression(t *testing.T) {
+	inputs := []struct {
+		compression string
+		want        sarama.CompressionCodec
+		ok          bool
+	}{
+		{"none", sarama.CompressionNone, true},
+		{"gzip", sarama.CompressionGZIP, true},
+		{"Snappy", sarama.CompressionSnappy, true},
+		{"zstd", sarama.CompressionZSTD, true},
+		{"brotli", sarama.CompressionNone, false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.compression, func(t *testing.T) {
+			codec, err := ParseKafkaCompression(tc.compression)
+			assert.Equal(t, err == nil, tc.ok, fmt.Sprintf("Error meets expectations: %v", err))
+			assert.Equal(t, codec, tc.want, "Codec meets expectations.")
+		})
+	}
+}
+
+func TestKafkaMessage(t *testing.T) {
+	inputs := []struct {
+		name  string
+		key   string
+		event OutputEvent
+		want  string
+	}{
+		{"service-id", KAFKA_KEY_SERVICE_ID, testOutputEvent(), testOutputEvent().ServiceId},
+		{"client-ip", KAFKA_KEY_CLIENT_IP, testOutputEvent(), testOutputEvent().ClientIp},
+		{"orphan-service-id", KAFKA_KEY_SERVICE_ID, OutputEvent{RequestId: "orphan"}, "orphan"},
+		{"orphan-client-ip", KAFKA_KEY_CLIENT_IP, OutputEvent{RequestId: "orphan", ServiceId: "service"}, "orphan"},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := NewKafkaSink([]string{"localhost:9092"})
+			sink.Topic = testKafkaTopic
+			sink.Key = tc.key
+
+			msg, err := sink.message(tc.event)
+			if err != nil {
+				t.Fatalf("failed building message: %s", err)
+			}
+
+			key, _ := msg.Key.Encode()
+			value, _ := msg.Value.Encode()
+
+			var event OutputEvent
+			_ = json.Unmarshal(value, &event)
+
+			assert.Equal(t, msg.Topic, testKafkaTopic, "Topic meets expectations.")
+			assert.Equal(t, string(key), tc.want, "Key meets expectations.")
+			assert.Equal(t, event, tc.event, "Value is the event.")
+		})
+	}
+}
+
+func TestKafka(t *testing.T) {
+	broker := testKafkaBroker(t, sarama.ErrNoError)
+	defer broker.Close()
+
+	sink := NewKafkaSink([]string{broker.Addr()})
+	sink.Topic = testKafkaTopic
+	sink.RequiredAcks = sarama.WaitForLocal
+	sink.Compression = sarama.CompressionGZIP
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+
+	events, _ := testEvents(3)
+	for _, event := range events {
+		_ = sink.Write(event)
+	}
+
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("failed flushing: %s", err)
+	}
+
+	err = sink.Close()
+	if err != nil {
+		t.Errorf("failed closing: %s", err)
+	}
+
+	assert.Equal(t, sink.Sent(), uint64(3), "Sent count meets expectations.")
+	assert.Equal(t, sink.Failed(), uint64(0), "Failed count meets expectations.")
+	assert.Equal(t, produceRequests(broker) > 0, true, "Events produced to the broker.")
+
+	err = sink.Write(events[0])
+	assert.Equal(t, err != nil, true, "Writes refused once closed.")
+	assert.Equal(t, sink.Close(), nil, "Closing twice is harmless.")
+}
+
+// TestKafkaQueueFull checks that writes don't block on a producer that isn't keeping up, dropping the oldest events instead
+func TestKafkaQueueFull(t *testing.T) {
+	sink := NewKafkaSink([]string{"127.0.0.1:9092"})
+	sink.Buffer = 2
+
+	// Never started, so nothing takes events off the queue
+	events, reqIds := testEvents(3)
+	for _, event := range events {
+		err := sink.Write(event)
+		if err != nil {
+			t.Errorf("failed writing: %s", err)
+		}
+	}
+
+	queued := []string{}
+	for _, msg := range sink.queue {
+		queued = append(queued, msg.Metadata.(OutputEvent).RequestId)
+	}
+
+	assert.Equal(t, queued, reqIds[1:], "Newest events kept.")
+	assert.Equal(t, sink.Dropped(), uint64(1), "Dropped count meets expectations.")
+	assert.Equal(t, sink.Failed(), uint64(1), "Dropped events count as failed.")
+	assert.Equal(t, sink.Close(), nil, "Closed.")
+}
+
+// TestKafkaDeadLetter checks that events the broker refuses are appended to the dead letter file
+func TestKafkaDeadLetter(t *testing.T) {
+	broker := testKafkaBroker(t, sarama.ErrMessageSizeTooLarge)
+	defer broker.Close()
+
+	deadLetterPath := filepath.Join(tmpDir, "kafka-dead-letter.log")
+	defer os.Remove(deadLetterPath)
+
+	sink := NewKafkaSink([]string{broker.Addr()})
+	sink.Topic = testKafkaTopic
+	sink.Retries = 0
+	sink.DeadLetterPath = deadLetterPath
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+
+	events, reqIds := testEvents(2)
+	for _, event := range events {
+		_ = sink.Write(event)
+	}
+
+	err = sink.Flush()
+	if err == nil {
+		t.Error("failed events not reported")
+	}
+
+	err = sink.Close()
+	if err != nil {
+		t.Errorf("failed closing: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("failed reading dead letter file: %s", err)
+	}
+
+	deadIds := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var event OutputEvent
+		_ = json.Unmarshal([]byte(line), &event)
+		deadIds = append(deadIds, event.RequestId)
+	}
+
+	assert.Equal(t, deadIds, reqIds, "Refused events dead lettered in order.")
+	assert.Equal(t, sink.Sent(), uint64(0), "Sent count meets expectations.")
+	assert.Equal(t, sink.Failed(), uint64(2), "Failed count meets expectations.")
+}
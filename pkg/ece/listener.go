@@ -0,0 +1,196 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const LISTENER_TCP = "tcp"
+const LISTENER_TLS = "tls"
+const LISTENER_UDP = "udp"
+const LISTENER_UNIXGRAM = "unixgram"
+const LISTENER_HTTP = "http"
+const LISTENER_HTTPS = "https"
+
+const SYSLOG_FORMAT_RFC5424 = "rfc5424"
+const SYSLOG_FORMAT_RFC3164 = "rfc3164"
+const SYSLOG_FORMAT_RFC6587 = "rfc6587"
+const SYSLOG_FORMAT_AUTOMATIC = "automatic"
+
+// Listener an endpoint on which the ECE receives messages, either syslog or Fastly's HTTPS logging.  Every listener feeds the same correlation channel.
+type Listener struct {
+	Network string
+	Address string
+
+	// Format the syslog format expected on this listener.  If empty, the ECE's Format is used.
+	Format string
+}
+
+// String renders the listener in the same network://address[?format=name] form accepted by ParseListener
+func (l Listener) String() string {
+	if l.Format != "" {
+		return fmt.Sprintf("%s://%s?format=%s", l.Network, l.Address, l.Format)
+	}
+
+	return fmt.Sprintf("%s://%s", l.Network, l.Address)
+}
+
+// ParseListener parses a listener spec of the form network://address, e.g. udp://0.0.0.0:514, https://0.0.0.0:8443 or unixgram:///var/run/ece.sock.  A bare address without a network is treated as TCP.  The syslog format may be chosen per listener by appending ?format=name, e.g. udp://0.0.0.0:514?format=rfc3164.
+func ParseListener(spec string) (listener Listener, err error) {
+	address := spec
+
+	if i := strings.LastIndex(spec, "?"); i >= 0 {
+		query, err := url.ParseQuery(spec[i+1:])
+		if err != nil {
+			err = errors.Wrapf(err, "failed to parse options of listener %q", spec)
+			return listener, err
+		}
+
+		for key := range query {
+			if key != "format" {
+				err = fmt.Errorf("listener %q has unsupported option %q", spec, key)
+				return listener, err
+			}
+		}
+
+		listener.Format = strings.ToLower(query.Get("format"))
+		address = spec[:i]
+
+		_, err = syslogFormat(listener.Format)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid listener %q", spec)
+			return listener, err
+		}
+	}
+
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) == 1 {
+		listener.Network = LISTENER_TCP
+		listener.Address = address
+	} else {
+		listener.Network = strings.ToLower(parts[0])
+		listener.Address = parts[1]
+	}
+
+	if listener.Address == "" {
+		err = fmt.Errorf("listener %q has no address", spec)
+		return listener, err
+	}
+
+	switch listener.Network {
+	case LISTENER_TCP, LISTENER_TLS, LISTENER_UDP, LISTENER_UNIXGRAM, LISTENER_HTTP, LISTENER_HTTPS:
+	default:
+		err = fmt.Errorf("listener %q has unsupported network %q", spec, listener.Network)
+		return listener, err
+	}
+
+	return listener, err
+}
+
+// ParseListeners parses a list of listener specs.  See ParseListener.
+func ParseListeners(specs []string) (listeners []Listener, err error) {
+	for _, spec := range specs {
+		listener, err := ParseListener(spec)
+		if err != nil {
+			return listeners, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, err
+}
+
+// syslogFormat maps a format name onto the syslog package's formats.  An empty name means RFC5424.
+func syslogFormat(name string) (f format.Format, err error) {
+	switch strings.ToLower(name) {
+	case "", SYSLOG_FORMAT_RFC5424:
+		return syslog.RFC5424, err
+	case SYSLOG_FORMAT_RFC3164:
+		return syslog.RFC3164, err
+	case SYSLOG_FORMAT_RFC6587:
+		return syslog.RFC6587, err
+	case SYSLOG_FORMAT_AUTOMATIC:
+		return syslog.Automatic, err
+	default:
+		err = fmt.Errorf("unsupported syslog format %q.  Must be one of %s, %s, %s or %s", name, SYSLOG_FORMAT_RFC5424, SYSLOG_FORMAT_RFC3164, SYSLOG_FORMAT_RFC6587, SYSLOG_FORMAT_AUTOMATIC)
+		return f, err
+	}
+}
+
+// logMessage extracts the message body from the parsed syslog entry.  RFC5424 parsers put it under "message", RFC3164 parsers under "content".
+func logMessage(logParts format.LogParts) (message string, ok bool) {
+	for _, key := range []string{"message", "content"} {
+		message, ok = logParts[key].(string)
+		if ok {
+			return message, ok
+		}
+	}
+
+	return message, ok
+}
+
+// listenerHandler tags every message with the listener it arrived on before handing it to the shared correlation channel
+type listenerHandler struct {
+	channel  syslog.LogPartsChannel
+	listener Listener
+}
+
+// Handle implements syslog.Handler
+func (h *listenerHandler) Handle(logParts format.LogParts, messageLength int64, err error) {
+	logParts["listener"] = h.listener.String()
+	h.channel <- logParts
+}
+
+// listen configures a syslog server for the given listener
+func (ece *ECE) listen(server *syslog.Server, listener Listener) (err error) {
+	switch listener.Network {
+	case LISTENER_TCP:
+		err = server.ListenTCP(listener.Address)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to start TCP listener on %s", listener.Address)
+			return err
+		}
+
+	case LISTENER_TLS:
+		config, err := ece.tlsConfig()
+		if err != nil {
+			return err
+		}
+
+		err = server.ListenTCPTLS(listener.Address, config)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to start TLS TCP listener on %s", listener.Address)
+			return err
+		}
+
+	case LISTENER_UDP:
+		err = server.ListenUDP(listener.Address)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to start UDP listener on %s", listener.Address)
+			return err
+		}
+
+	case LISTENER_UNIXGRAM:
+		// A socket left behind by a previous run would make the bind fail
+		if info, statErr := os.Stat(listener.Address); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(listener.Address)
+		}
+
+		err = server.ListenUnixgram(listener.Address)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to start unixgram listener on %s", listener.Address)
+			return err
+		}
+
+	default:
+		err = fmt.Errorf("unsupported listener network %q", listener.Network)
+	}
+
+	return err
+}
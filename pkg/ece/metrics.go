@@ -0,0 +1,251 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// METRICS_NAMESPACE the prefix of every metric name
+const METRICS_NAMESPACE = "ece"
+
+// METRICS_PATH where metrics are served on MetricsAddress
+const METRICS_PATH = "/metrics"
+
+// Reasons a message couldn't be parsed, as labelled on ece_parse_failures_total
+const PARSE_FAILURE_NO_MESSAGE = "no_message"
+const PARSE_FAILURE_INVALID_JSON = "invalid_json"
+const PARSE_FAILURE_UNKNOWN_EVENT_TYPE = "unknown_event_type"
+const PARSE_FAILURE_BAD_BATCH = "bad_batch"
+
+// Kinds of written event, as labelled on ece_events_written_total
+const CORRELATION_COMPLETE = "complete"
+const CORRELATION_WAF_ONLY = "waf_only"
+const CORRELATION_REQ_ONLY = "req_only"
+
+// ReportingSink is implemented by sinks that deliver events after Write returns, so can't fail it.  ECE has them report the events they give up on, counting them on ece_sink_errors_total.
+type ReportingSink interface {
+	ReportFailures(report func(events int))
+}
+
+// failureReporter passes an asynchronous sink's failures to whatever ReportFailures was given, if anything.  Sinks embed it to implement ReportingSink.
+type failureReporter struct {
+	reportMutex sync.Mutex
+	report      func(events int)
+}
+
+// ReportFailures has report called with the number of events each time some are given up on
+func (r *failureReporter) ReportFailures(report func(events int)) {
+	r.reportMutex.Lock()
+	defer r.reportMutex.Unlock()
+
+	r.report = report
+}
+
+// gaveUp reports events given up on
+func (r *failureReporter) gaveUp(events int) {
+	r.reportMutex.Lock()
+	report := r.report
+	r.reportMutex.Unlock()
+
+	if report != nil && events > 0 {
+		report(events)
+	}
+}
+
+// metrics the Prometheus collectors for an ECE.  Each ECE has a registry of its own, so several can run in one process, as they do in the tests.
+type metrics struct {
+	registry      *prometheus.Registry
+	received      *prometheus.CounterVec
+	parseFailures *prometheus.CounterVec
+	written       *prometheus.CounterVec
+	ruleHits      *prometheus.CounterVec
+	blocked       prometheus.Counter
+	sinkErrors    *prometheus.CounterVec
+	latency       prometheus.Histogram
+	reloads       *prometheus.CounterVec
+	certExpiry    *prometheus.GaugeVec
+}
+
+// newMetrics creates the collectors for the ECE, including gauges and counters read straight from its own state
+func newMetrics(ece *ECE) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "messages_received_total",
+			Help:      "Log messages received, by listener.",
+		}, []string{"listener"}),
+		parseFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "parse_failures_total",
+			Help:      "Messages, or HTTP batches, that couldn't be parsed, by reason.",
+		}, []string{"reason"}),
+		written: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "events_written_total",
+			Help:      "Events written to the sinks, by correlation: complete (req and WAF entries), req_only, or waf_only (orphaned WAF entries whose req entry never arrived).",
+		}, []string{"correlation"}),
+		ruleHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "rule_hits_total",
+			Help:      "Events matching each WAF rule, by rule id and datacenter.",
+		}, []string{"rule_id", "datacenter"}),
+		blocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "blocked_requests_total",
+			Help:      "Events for requests the WAF blocked.",
+		}),
+		sinkErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "sink_errors_total",
+			Help:      "Events a sink failed to write, by sink, including those asynchronous sinks gave up on after Write returned.",
+		}, []string{"sink"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "correlation_latency_seconds",
+			Help:      "Time from an event's first message arriving to it being written.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "config_reloads_total",
+			Help:      "Config reloads, by result: success or failure.",
+		}, []string{"result"}),
+		certExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "tls_cert_expiry_days",
+			Help:      "Days until each TLS cert served expires, by cert path.",
+		}, []string{"cert"}),
+	}
+
+	m.registry.MustRegister(
+		m.received,
+		m.parseFailures,
+		m.written,
+		m.ruleHits,
+		m.blocked,
+		m.sinkErrors,
+		m.latency,
+		m.reloads,
+		m.certExpiry,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "pending_events",
+			Help:      "Events waiting to be written.",
+		}, func() float64 { return float64(ece.Pending()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "pending_bytes",
+			Help:      "Size of the raw messages held in pending events.",
+		}, func() float64 { return float64(ece.PendingBytes()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "events_evicted_total",
+			Help:      "Events written before they were complete to make room for new ones.",
+		}, func() float64 { return float64(ece.Evicted()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "events_dropped_total",
+			Help:      "Events discarded without being written, for want of room.",
+		}, func() float64 { return float64(ece.Dropped()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "invalid_rule_ids_total",
+			Help:      "Rule ids that weren't numbers, written under invalid_rule_ids.",
+		}, func() float64 { return float64(ece.InvalidRuleIds()) }),
+	)
+
+	return m
+}
+
+// parseFailure works out why AddEvent couldn't parse the message
+func parseFailure(message string) string {
+	if !json.Valid([]byte(message)) {
+		return PARSE_FAILURE_INVALID_JSON
+	}
+
+	return PARSE_FAILURE_UNKNOWN_EVENT_TYPE
+}
+
+// correlation describes how complete the event was when written
+func correlation(event *Event) string {
+	switch {
+	case len(event.RequestEntries) == 0:
+		return CORRELATION_WAF_ONLY
+	case len(event.WafEntries) == 0:
+		return CORRELATION_REQ_ONLY
+	default:
+		return CORRELATION_COMPLETE
+	}
+}
+
+// reportSinkFailures has each asynchronous sink count the events it gives up on as sink errors
+func (m *metrics) reportSinkFailures(sinks []Sink) {
+	for _, sink := range sinks {
+		if reporter, ok := sink.(ReportingSink); ok {
+			counter := m.sinkErrors.WithLabelValues(sinkName(sink))
+			reporter.ReportFailures(func(events int) { counter.Add(float64(events)) })
+		}
+	}
+}
+
+// observeWrite records an event being written by at least one sink
+func (m *metrics) observeWrite(event *Event, output OutputEvent) {
+	m.written.WithLabelValues(correlation(event)).Inc()
+
+	if !event.created.IsZero() {
+		m.latency.Observe(time.Since(event.created).Seconds())
+	}
+
+	for _, id := range output.RuleIds {
+		m.ruleHits.WithLabelValues(strconv.Itoa(id), output.Datacenter).Inc()
+	}
+
+	if Action(output) == ACTION_BLOCKED {
+		m.blocked.Inc()
+	}
+}
+
+// MetricsHandler returns the handler serving the ECE's metrics in the Prometheus exposition format
+func (ece *ECE) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(ece.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// listenMetrics serves metrics on MetricsAddress
+func (ece *ECE) listenMetrics() (err error) {
+	ln, err := net.Listen("tcp", ece.MetricsAddress)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to start metrics listener on %s", ece.MetricsAddress)
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, ece.MetricsHandler())
+
+	server := &http.Server{
+		Handler: mux,
+	}
+
+	ece.httpServers = append(ece.httpServers, server)
+	ece.httpWait.Add(1)
+
+	go func() {
+		defer ece.httpWait.Done()
+
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			_, _ = fmt.Fprintf(os.Stderr, "metrics listener on %s failed: %s\n", ece.MetricsAddress, err)
+		}
+	}()
+
+	return err
+}
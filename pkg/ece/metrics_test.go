@@ -0,0 +1,151 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	logs := &testSink{}
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs, testFailingSink{}}
+
+	ece.handleMessage("tcp", testWafEntryMessage())
+	ece.handleMessage("tcp", testWebEntryMessage())
+	ece.handleMessage("http", testWafEntryMessageFor("orphan"))
+	ece.handleMessage("http", "not json")
+	ece.handleMessage("http", `{"event_type":"vcl"}`)
+
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.received.WithLabelValues("tcp")), float64(2), "Messages counted by listener.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.received.WithLabelValues("http")), float64(3), "Messages counted by listener.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.parseFailures.WithLabelValues(PARSE_FAILURE_INVALID_JSON)), float64(1), "Invalid JSON counted.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.parseFailures.WithLabelValues(PARSE_FAILURE_UNKNOWN_EVENT_TYPE)), float64(1), "Unknown event type counted.")
+
+	blocked := strings.Replace(testWebEntryMessageFor("blocked"), `"waf_blocked":"0"`, `"waf_blocked":"1"`, 1)
+	ece.handleMessage("tcp", blocked)
+
+	assert.Equal(t, metricValue(t, ece, "ece_pending_events"), "3", "Pending events gauged.")
+
+	for _, reqId := range []string{testWafEntry().RequestId, "orphan", "blocked"} {
+		_ = ece.WriteEvent(reqId)
+	}
+
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.written.WithLabelValues(CORRELATION_COMPLETE)), float64(1), "Complete event counted.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.written.WithLabelValues(CORRELATION_WAF_ONLY)), float64(1), "Orphaned WAF event counted.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.written.WithLabelValues(CORRELATION_REQ_ONLY)), float64(1), "Req only event counted.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.ruleHits.WithLabelValues("0", "SFO")), float64(1), "Rule hit counted by datacenter.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.ruleHits.WithLabelValues("0", "")), float64(1), "Rule hit counted without a datacenter.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.blocked), float64(1), "Blocked request counted.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.sinkErrors.WithLabelValues("ece.testFailingSink")), float64(3), "Sink errors counted by sink.")
+	assert.Equal(t, testutil.CollectAndCount(ece.metrics.latency), 1, "Latency observed.")
+	assert.Equal(t, metricValue(t, ece, "ece_pending_events"), "0", "Pending events gauged.")
+
+	ece.Sinks = []Sink{testFailingSink{}}
+	ece.handleMessage("tcp", testWebEntryMessageFor("unwritten"))
+	_ = ece.WriteEvent("unwritten")
+
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.written.WithLabelValues(CORRELATION_REQ_ONLY)), float64(1), "Event no sink wrote not counted.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.sinkErrors.WithLabelValues("ece.testFailingSink")), float64(4), "Its error counted.")
+}
+
+func TestMetricsAsyncSinkErrors(t *testing.T) {
+	sink, err := NewSyslogSink(LISTENER_TCP, testAddress(), nil, 2)
+	if err != nil {
+		t.Fatalf("failed creating sink: %s", err)
+	}
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{sink}
+	ece.Listeners = []Listener{{Network: LISTENER_UDP, Address: testAddress()}}
+
+	err = ece.Start()
+	if err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+
+	defer func() {
+		_ = ece.Shutdown()
+		ece.Wait()
+	}()
+
+	for i := 0; i < 5; i++ {
+		_ = sink.Write(OutputEvent{RequestId: fmt.Sprintf("req-%d", i)})
+	}
+
+	ok, message := within(time.Second, func() (bool, string) {
+		errors := testutil.ToFloat64(ece.metrics.sinkErrors.WithLabelValues("syslog"))
+		return errors == 3, fmt.Sprintf("counted %v sink errors, expected 3", errors)
+	})
+	if !ok {
+		t.Error(message)
+	}
+}
+
+func TestSinkName(t *testing.T) {
+	inputs := []struct {
+		sink Sink
+		name string
+	}{
+		{&FileSink{}, "file"},
+		{&KafkaSink{}, "kafka"},
+		{&testSink{}, "*ece.testSink"},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, sinkName(tc.sink), tc.name, "Sink name meets expectations.")
+		})
+	}
+}
+
+func TestMetricsListener(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{&testSink{}}
+	ece.Listeners = []Listener{{Network: LISTENER_HTTP, Address: testAddress()}}
+	ece.MetricsAddress = testAddress()
+
+	err := ece.Start()
+	if err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+
+	defer func() {
+		_ = ece.Shutdown()
+		ece.Wait()
+	}()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", ece.MetricsAddress, METRICS_PATH))
+	if err != nil {
+		t.Fatalf("failed to get metrics: %s", err)
+	}
+
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	assert.Equal(t, resp.StatusCode, http.StatusOK, "Metrics served.")
+	assert.Equal(t, strings.Contains(string(body), "ece_pending_events 0\n"), true, "Exposition format.")
+}
+
+// metricValue scrapes the ECE's metrics handler for the value of an unlabelled metric
+func metricValue(t *testing.T, ece *ECE, name string) string {
+	recorder := httptest.NewRecorder()
+	ece.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, METRICS_PATH, nil))
+
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			return strings.TrimPrefix(line, name+" ")
+		}
+	}
+
+	t.Fatalf("no %s in metrics", name)
+
+	return ""
+}
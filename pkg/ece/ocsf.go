@@ -0,0 +1,251 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+const FORMAT_OCSF = "ocsf"
+
+// OCSF_VERSION the version of the Open Cybersecurity Schema Framework events are mapped to
+const OCSF_VERSION = "1.1.0"
+
+const OCSF_CATEGORY_NETWORK = 4
+const OCSF_CATEGORY_NETWORK_NAME = "Network Activity"
+const OCSF_CLASS_HTTP_ACTIVITY = 4002
+const OCSF_CLASS_HTTP_ACTIVITY_NAME = "HTTP Activity"
+
+const OCSF_ACTIVITY_OTHER = 99
+
+// OCSF_ACTIVITIES the HTTP Activity activity ids, by request method
+var OCSF_ACTIVITIES = map[string]int{
+	"CONNECT": 1,
+	"DELETE":  2,
+	"GET":     3,
+	"HEAD":    4,
+	"OPTIONS": 5,
+	"POST":    6,
+	"PUT":     7,
+	"TRACE":   8,
+}
+
+const OCSF_ACTION_ALLOWED = 1
+const OCSF_ACTION_DENIED = 2
+
+const OCSF_DISPOSITION_ALLOWED = 1
+const OCSF_DISPOSITION_BLOCKED = 2
+const OCSF_DISPOSITION_LOGGED = 17
+
+// OCSF_SEVERITIES the OCSF severity names, by severity id
+var OCSF_SEVERITIES = []string{"Unknown", "Informational", "Low", "Medium", "High", "Critical", "Fatal"}
+
+// OCSFFormatter renders events as JSON in the OCSF HTTP Activity class, with the security control profile for what the WAF did.  Anything OCSF has no attribute for goes under unmapped.
+type OCSFFormatter struct{}
+
+type ocsfEvent struct {
+	CategoryUid   int               `json:"category_uid"`
+	CategoryName  string            `json:"category_name"`
+	ClassUid      int               `json:"class_uid"`
+	ClassName     string            `json:"class_name"`
+	ActivityId    int               `json:"activity_id"`
+	ActivityName  string            `json:"activity_name"`
+	TypeUid       int               `json:"type_uid"`
+	TypeName      string            `json:"type_name"`
+	Time          int64             `json:"time,omitempty"`
+	SeverityId    int               `json:"severity_id"`
+	Severity      string            `json:"severity"`
+	ActionId      int               `json:"action_id"`
+	Action        string            `json:"action"`
+	DispositionId int               `json:"disposition_id"`
+	Disposition   string            `json:"disposition"`
+	Metadata      ocsfMetadata      `json:"metadata"`
+	SrcEndpoint   *ocsfEndpoint     `json:"src_endpoint,omitempty"`
+	HTTPRequest   ocsfHTTPRequest   `json:"http_request"`
+	HTTPResponse  *ocsfHTTPResponse `json:"http_response,omitempty"`
+	TLS           *ocsfTLS          `json:"tls,omitempty"`
+	FirewallRule  *ocsfRule         `json:"firewall_rule,omitempty"`
+	Unmapped      ocsfUnmapped      `json:"unmapped"`
+}
+
+type ocsfMetadata struct {
+	Version string      `json:"version"`
+	Uid     string      `json:"uid"`
+	Product ocsfProduct `json:"product"`
+}
+
+type ocsfProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+}
+
+type ocsfEndpoint struct {
+	IP string `json:"ip"`
+}
+
+type ocsfHTTPRequest struct {
+	Uid        string   `json:"uid"`
+	HTTPMethod string   `json:"http_method,omitempty"`
+	URL        *ocsfURL `json:"url,omitempty"`
+	UserAgent  string   `json:"user_agent,omitempty"`
+	Length     *int     `json:"length,omitempty"`
+}
+
+type ocsfURL struct {
+	URLString string `json:"url_string"`
+	Hostname  string `json:"hostname,omitempty"`
+	Path      string `json:"path,omitempty"`
+	Scheme    string `json:"scheme,omitempty"`
+}
+
+type ocsfHTTPResponse struct {
+	Code   *int `json:"code,omitempty"`
+	Length *int `json:"length,omitempty"`
+}
+
+type ocsfTLS struct {
+	Version string `json:"version,omitempty"`
+	Cipher  string `json:"cipher,omitempty"`
+}
+
+type ocsfRule struct {
+	Uid  string `json:"uid"`
+	Type string `json:"type"`
+}
+
+// ocsfUnmapped the fields OCSF has no attribute for
+type ocsfUnmapped struct {
+	ServiceId      string         `json:"service_id,omitempty"`
+	Datacenter     string         `json:"datacenter,omitempty"`
+	FastlyInfo     string         `json:"fastly_info,omitempty"`
+	ThrottlingRule string         `json:"throttling_rule,omitempty"`
+	Throttled      int            `json:"throttled"`
+	RuleIds        []int          `json:"rule_ids"`
+	InvalidRuleIds []string       `json:"invalid_rule_ids,omitempty"`
+	WafScores      map[string]int `json:"waf_scores,omitempty"`
+	WafEvents      []OutputWaf    `json:"waf_events"`
+}
+
+// ocsfSeverity converts a 0-10 severity to an OCSF severity id, from Informational to Critical
+func ocsfSeverity(severity int) int {
+	switch {
+	case severity >= 9:
+		return 5
+	case severity >= 7:
+		return 4
+	case severity >= 4:
+		return 3
+	case severity >= 1:
+		return 2
+	}
+
+	return 1
+}
+
+// ocsfActivity returns the activity id and name for the request method
+func ocsfActivity(method string) (id int, name string) {
+	method = strings.ToUpper(method)
+
+	id, ok := OCSF_ACTIVITIES[method]
+	if !ok {
+		return OCSF_ACTIVITY_OTHER, "Other"
+	}
+
+	return id, method[:1] + strings.ToLower(method[1:])
+}
+
+func (f OCSFFormatter) Format(event OutputEvent) (line []byte, err error) {
+	severity, ruleId := Severity(event)
+	activityId, activityName := ocsfActivity(event.ReqMethod)
+	severityId := ocsfSeverity(severity)
+
+	doc := ocsfEvent{
+		CategoryUid:  OCSF_CATEGORY_NETWORK,
+		CategoryName: OCSF_CATEGORY_NETWORK_NAME,
+		ClassUid:     OCSF_CLASS_HTTP_ACTIVITY,
+		ClassName:    OCSF_CLASS_HTTP_ACTIVITY_NAME,
+		ActivityId:   activityId,
+		ActivityName: activityName,
+		TypeUid:      OCSF_CLASS_HTTP_ACTIVITY*100 + activityId,
+		TypeName:     fmt.Sprintf("%s: %s", OCSF_CLASS_HTTP_ACTIVITY_NAME, activityName),
+		SeverityId:   severityId,
+		Severity:     OCSF_SEVERITIES[severityId],
+		Metadata: ocsfMetadata{
+			Version: OCSF_VERSION,
+			Uid:     event.RequestId,
+			Product: ocsfProduct{Name: FORMAT_PRODUCT, VendorName: FORMAT_VENDOR},
+		},
+		HTTPRequest: ocsfHTTPRequest{
+			Uid:        event.RequestId,
+			HTTPMethod: event.ReqMethod,
+			UserAgent:  event.ReqHUserAgent,
+			Length:     optionalInt(event.ReqBodyBytes),
+		},
+		Unmapped: ocsfUnmapped{
+			ServiceId:      event.ServiceId,
+			Datacenter:     event.Datacenter,
+			FastlyInfo:     event.FastlyInfo,
+			ThrottlingRule: event.ThrottlingRule,
+			Throttled:      event.Throttled,
+			RuleIds:        event.RuleIds,
+			InvalidRuleIds: event.InvalidRuleIds,
+			WafScores:      wafScores(event),
+			WafEvents:      event.WafEvents,
+		},
+	}
+
+	if when, ok := startTime(event); ok {
+		doc.Time = when.UnixNano() / 1e6
+	}
+
+	switch Action(event) {
+	case ACTION_BLOCKED:
+		doc.ActionId, doc.Action = OCSF_ACTION_DENIED, "Denied"
+		doc.DispositionId, doc.Disposition = OCSF_DISPOSITION_BLOCKED, "Blocked"
+	case ACTION_LOGGED:
+		doc.ActionId, doc.Action = OCSF_ACTION_ALLOWED, "Allowed"
+		doc.DispositionId, doc.Disposition = OCSF_DISPOSITION_LOGGED, "Logged"
+	default:
+		doc.ActionId, doc.Action = OCSF_ACTION_ALLOWED, "Allowed"
+		doc.DispositionId, doc.Disposition = OCSF_DISPOSITION_ALLOWED, "Allowed"
+	}
+
+	if event.ClientIp != "" {
+		doc.SrcEndpoint = &ocsfEndpoint{IP: event.ClientIp}
+	}
+
+	if event.ReqURI != "" || event.ReqHHost != "" {
+		doc.HTTPRequest.URL = &ocsfURL{
+			URLString: requestURL(event),
+			Hostname:  event.ReqHHost,
+			Path:      strings.SplitN(event.ReqURI, "?", 2)[0],
+		}
+		if event.ReqHHost != "" {
+			doc.HTTPRequest.URL.Scheme = strings.SplitN(doc.HTTPRequest.URL.URLString, ":", 2)[0]
+		}
+	}
+
+	if event.RespStatus != "" || event.RespBodyBytes != "" {
+		doc.HTTPResponse = &ocsfHTTPResponse{
+			Code:   optionalInt(event.RespStatus),
+			Length: optionalInt(event.RespBodyBytes),
+		}
+	}
+
+	if event.TlsProtocol != "" || event.TlsCipher != "" {
+		_, version := tlsVersion(event.TlsProtocol)
+		doc.TLS = &ocsfTLS{Version: version, Cipher: event.TlsCipher}
+	}
+
+	if ruleId != "" {
+		doc.FirewallRule = &ocsfRule{Uid: ruleId, Type: "waf"}
+	}
+
+	line, err = json.Marshal(doc)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshall req id %q as OCSF", event.RequestId)
+	}
+
+	return line, err
+}
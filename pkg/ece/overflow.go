@@ -0,0 +1,189 @@
+package ece
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// OVERFLOW_EVICT_OLDEST makes room for a new event by flushing the event due soonest, i.e. the oldest
+const OVERFLOW_EVICT_OLDEST = "evict-oldest"
+
+// OVERFLOW_DROP_NEW refuses new events until there's room for them
+const OVERFLOW_DROP_NEW = "drop-new"
+
+// OVERFLOW_DROP_WAF_ONLY makes room for a new event by discarding a pending event that has no req entry.  If every pending event has a req entry, the new event is refused.
+const OVERFLOW_DROP_WAF_ONLY = "drop-waf-only"
+
+// validOverflow checks the overflow policy name
+func validOverflow(policy string) (err error) {
+	switch policy {
+	case "", OVERFLOW_EVICT_OLDEST, OVERFLOW_DROP_NEW, OVERFLOW_DROP_WAF_ONLY:
+	default:
+		err = fmt.Errorf("unsupported overflow policy %q.  Must be one of %s, %s or %s", policy, OVERFLOW_EVICT_OLDEST, OVERFLOW_DROP_NEW, OVERFLOW_DROP_WAF_ONLY)
+	}
+
+	return err
+}
+
+// Evicted returns the number of events flushed before they were complete to make room for new ones
+func (ece *ECE) Evicted() uint64 {
+	return atomic.LoadUint64(&ece.evicted)
+}
+
+// Dropped returns the number of events discarded without being written, counting each entry refused for want of room as an event
+func (ece *ECE) Dropped() uint64 {
+	return atomic.LoadUint64(&ece.dropped)
+}
+
+// PendingBytes returns the size of the raw messages held in pending events
+func (ece *ECE) PendingBytes() int64 {
+	return atomic.LoadInt64(&ece.pendingBytes)
+}
+
+// reserve takes a slot for a new event if newEvent is set, and size bytes for the message being added, reporting false, and taking neither, if either would go past its configured limit.  Both are taken before the event is created or added to, so concurrent workers can't overshoot the limits.  A message bigger than MaxBytes is only let in when nothing else is pending.
+func (ece *ECE) reserve(newEvent bool, size int) bool {
+	if newEvent {
+		slots := atomic.AddInt64(&ece.slots, 1)
+		if ece.MaxEvents > 0 && slots > int64(ece.MaxEvents) {
+			atomic.AddInt64(&ece.slots, -1)
+			return false
+		}
+	}
+
+	bytes := atomic.AddInt64(&ece.pendingBytes, int64(size))
+	if ece.MaxBytes > 0 && size > 0 && bytes > ece.MaxBytes && bytes > int64(size) {
+		atomic.AddInt64(&ece.pendingBytes, -int64(size))
+		if newEvent {
+			atomic.AddInt64(&ece.slots, -1)
+		}
+		return false
+	}
+
+	return true
+}
+
+// makeRoom applies the overflow policy until there's room for a message of size bytes, and a new event for it if newEvent is set, and reserves it.  It returns false if the message should be refused, having counted it as dropped.
+func (ece *ECE) makeRoom(newEvent bool, size int) bool {
+	for !ece.reserve(newEvent, size) {
+		switch ece.Overflow {
+		case OVERFLOW_DROP_NEW:
+			atomic.AddUint64(&ece.dropped, 1)
+			return false
+
+		case OVERFLOW_DROP_WAF_ONLY:
+			reqId, ok := ece.wafOnly.pop()
+			if !ok {
+				atomic.AddUint64(&ece.dropped, 1)
+				return false
+			}
+
+			if ece.dropWafOnly(reqId) {
+				atomic.AddUint64(&ece.dropped, 1)
+			}
+
+		default:
+			reqId, ok := ece.expiries.PopEarliest()
+			if !ok {
+				// Nothing left to evict, so there's no making room
+				atomic.AddUint64(&ece.dropped, 1)
+				return false
+			}
+
+			event := ece.RemoveEvent(reqId)
+			if event == nil {
+				// Written in the meantime, which made room anyway
+				continue
+			}
+
+			atomic.AddUint64(&ece.evicted, 1)
+
+			err := ece.writeEvent(reqId, event)
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "error writing evicted event: %s\n", err)
+			}
+		}
+	}
+
+	return true
+}
+
+// dropWafOnly discards the event for the request id if it's still waf only, reporting whether it did.  Its req entry may have arrived since it was indexed, so that's checked under the event's lock, which is held while anything is added to it.
+func (ece *ECE) dropWafOnly(reqId string) bool {
+	event, exists := ece.events.Get(reqId)
+	if !exists {
+		return false
+	}
+
+	event.mutex.Lock()
+	defer event.mutex.Unlock()
+
+	if event.removed || len(event.RequestEntries) > 0 || !ece.events.Discard(reqId, event) {
+		return false
+	}
+
+	ece.expiries.Cancel(reqId)
+	ece.retire(reqId, event)
+
+	return true
+}
+
+// wafOnlyIndex the pending events that have waf entries but no req entry, oldest first, so drop-waf-only finds one without searching every pending event
+type wafOnlyIndex struct {
+	sync.Mutex
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+// newWafOnlyIndex creates an empty index
+func newWafOnlyIndex() *wafOnlyIndex {
+	return &wafOnlyIndex{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// update adds the request id if its event is waf only, and removes it otherwise.  Must be called with the event's mutex held.
+func (w *wafOnlyIndex) update(reqId string, event *Event) {
+	if len(event.RequestEntries) > 0 || len(event.WafEntries) == 0 {
+		w.remove(reqId)
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if _, exists := w.elements[reqId]; !exists {
+		w.elements[reqId] = w.order.PushBack(reqId)
+	}
+}
+
+// remove forgets the request id
+func (w *wafOnlyIndex) remove(reqId string) {
+	w.Lock()
+	defer w.Unlock()
+
+	element, exists := w.elements[reqId]
+	if exists {
+		w.order.Remove(element)
+		delete(w.elements, reqId)
+	}
+}
+
+// pop removes and returns the oldest waf only request id, or false if there are none
+func (w *wafOnlyIndex) pop() (reqId string, ok bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	front := w.order.Front()
+	if front == nil {
+		return reqId, ok
+	}
+
+	reqId = w.order.Remove(front).(string)
+	delete(w.elements, reqId)
+
+	return reqId, true
+}
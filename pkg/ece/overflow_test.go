@@ -0,0 +1,235 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOverflow(t *testing.T) {
+	inputs := []struct {
+		name      string
+		policy    string
+		maxEvents int
+		maxBytes  int64
+		in        []string
+		pending   []string
+		written   []string
+		evicted   uint64
+		dropped   uint64
+	}{
+		{
+			"evict-oldest",
+			OVERFLOW_EVICT_OLDEST,
+			2,
+			0,
+			[]string{testWafEntryMessageFor("a"), testWafEntryMessageFor("b"), testWafEntryMessageFor("c")},
+			[]string{"b", "c"},
+			[]string{"a"},
+			1,
+			0,
+		},
+		{
+			"evict-oldest-bytes",
+			"",
+			0,
+			int64(2 * len(testWafEntryMessageFor("a"))),
+			[]string{testWafEntryMessageFor("a"), testWafEntryMessageFor("b"), testWafEntryMessageFor("c")},
+			[]string{"b", "c"},
+			[]string{"a"},
+			1,
+			0,
+		},
+		{
+			"evict-oldest-bytes-append",
+			OVERFLOW_EVICT_OLDEST,
+			0,
+			int64(len(testWafEntryMessageFor("b")) + len(testWebEntryMessageFor("b"))),
+			[]string{testWafEntryMessageFor("a"), testWafEntryMessageFor("b"), testWebEntryMessageFor("b")},
+			[]string{"b"},
+			[]string{"a"},
+			1,
+			0,
+		},
+		{
+			"drop-new-bytes-append",
+			OVERFLOW_DROP_NEW,
+			0,
+			int64(len(testWafEntryMessageFor("b")) + len(testWebEntryMessageFor("b"))),
+			[]string{testWafEntryMessageFor("a"), testWafEntryMessageFor("b"), testWebEntryMessageFor("b")},
+			[]string{"a", "b"},
+			[]string{},
+			0,
+			1,
+		},
+		{
+			"drop-new",
+			OVERFLOW_DROP_NEW,
+			2,
+			0,
+			[]string{testWafEntryMessageFor("a"), testWafEntryMessageFor("b"), testWafEntryMessageFor("c"), testWafEntryMessageFor("a")},
+			[]string{"a", "b"},
+			[]string{},
+			0,
+			1,
+		},
+		{
+			"drop-waf-only",
+			OVERFLOW_DROP_WAF_ONLY,
+			2,
+			0,
+			[]string{testWebEntryMessageFor("a"), testWafEntryMessageFor("b"), testWafEntryMessageFor("c")},
+			[]string{"a", "c"},
+			[]string{},
+			0,
+			1,
+		},
+		{
+			"drop-waf-only-completed",
+			OVERFLOW_DROP_WAF_ONLY,
+			2,
+			0,
+			[]string{testWafEntryMessageFor("a"), testWafEntryMessageFor("b"), testWebEntryMessageFor("a"), testWafEntryMessageFor("c")},
+			[]string{"a", "c"},
+			[]string{},
+			0,
+			1,
+		},
+		{
+			"drop-waf-only-none",
+			OVERFLOW_DROP_WAF_ONLY,
+			2,
+			0,
+			[]string{testWebEntryMessageFor("a"), testWebEntryMessageFor("b"), testWafEntryMessageFor("c")},
+			[]string{"a", "b"},
+			[]string{},
+			0,
+			1,
+		},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := &testSink{}
+			ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+			ece.Sinks = []Sink{logs}
+			ece.Overflow = tc.policy
+			ece.MaxEvents = tc.maxEvents
+			ece.MaxBytes = tc.maxBytes
+
+			for _, message := range tc.in {
+				err := ece.AddEvent(message)
+				if err != nil {
+					t.Fatalf("failed adding event: %s", err)
+				}
+			}
+
+			pending := []string{}
+			ece.events.Range(func(reqId string, event *Event) bool {
+				pending = append(pending, reqId)
+				return true
+			})
+			sort.Strings(pending)
+
+			written := []string{}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if line == "" {
+					continue
+				}
+
+				written = append(written, strings.Split(strings.Split(line, `"request_id":"`)[1], `"`)[0])
+			}
+
+			assert.Equal(t, pending, tc.pending, "Pending events meet expectations.")
+			assert.Equal(t, written, tc.written, "Written events meet expectations.")
+			assert.Equal(t, ece.Evicted(), tc.evicted, "Evicted count meets expectations.")
+			assert.Equal(t, ece.Dropped(), tc.dropped, "Dropped count meets expectations.")
+		})
+	}
+}
+
+func TestPendingBytes(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+
+	_ = ece.AddEvent(testWafEntryMessage())
+	_ = ece.AddEvent(testWebEntryMessage())
+
+	assert.Equal(t, ece.PendingBytes(), int64(len(testWafEntryMessage())+len(testWebEntryMessage())), "Pending bytes count both entries.")
+
+	ece.RemoveEvent(testWafEntry().RequestId)
+
+	assert.Equal(t, ece.PendingBytes(), int64(0), "Pending bytes released with the event.")
+}
+
+// TestOverflowNothingToEvict checks that a new event is dropped, rather than let in over the limit, when there's no deadline left to evict
+func TestOverflowNothingToEvict(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{&testSink{}}
+	ece.MaxEvents = 1
+
+	_ = ece.AddEvent(testWafEntryMessageFor("a"))
+	ece.expiries.Cancel("a")
+	_ = ece.AddEvent(testWafEntryMessageFor("b"))
+
+	assert.Equal(t, ece.Pending(), 1, "Limit held.")
+	assert.Equal(t, ece.Dropped(), uint64(1), "New event dropped.")
+	assert.Equal(t, ece.Evicted(), uint64(0), "Nothing evicted.")
+}
+
+// TestDropWafOnly checks that an event whose req entry arrived after it was indexed as waf only isn't dropped
+func TestDropWafOnly(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Overflow = OVERFLOW_DROP_WAF_ONLY
+
+	_ = ece.AddEvent(testWafEntryMessageFor("a"))
+	_ = ece.AddEvent(testWafEntryMessageFor("b"))
+	_ = ece.AddEvent(testWebEntryMessageFor("b"))
+
+	assert.Equal(t, ece.dropWafOnly("b"), false, "Completed event kept.")
+	assert.Equal(t, ece.dropWafOnly("a"), true, "Waf only event dropped.")
+	assert.Equal(t, ece.dropWafOnly("a"), false, "Already gone.")
+	assert.Equal(t, ece.Pending(), 1, "Completed event still pending.")
+	assert.Equal(t, ece.PendingBytes(), int64(len(testWafEntryMessageFor("b"))+len(testWebEntryMessageFor("b"))), "Dropped event's bytes released.")
+}
+
+// TestOverflowEvictWritten checks that a deadline whose event was already written doesn't count as an eviction
+func TestOverflowEvictWritten(t *testing.T) {
+	logs := &testSink{}
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{logs}
+	ece.MaxEvents = 1
+
+	_ = ece.AddEvent(testWafEntryMessageFor("a"))
+	ece.expiries.Schedule("written", time.Now().Add(time.Minute))
+	_ = ece.AddEvent(testWafEntryMessageFor("b"))
+
+	assert.Equal(t, ece.Evicted(), uint64(1), "Only the event actually written counted.")
+	assert.Equal(t, strings.Contains(logs.String(), `"request_id":"a"`), true, "Oldest event written.")
+}
+
+// TestOverflowConcurrent adds events from many goroutines at once, checking that they can't overshoot the limit between them
+func TestOverflowConcurrent(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = nil
+	ece.Overflow = OVERFLOW_DROP_NEW
+	ece.MaxEvents = 10
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				_ = ece.AddEvent(testWafEntryMessageFor(fmt.Sprintf("req-%d-%d", g, i)))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.Equal(t, ece.Pending(), 10, "Limit held.")
+	assert.Equal(t, ece.Dropped(), uint64(790), "The rest dropped.")
+}
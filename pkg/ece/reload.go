@@ -0,0 +1,220 @@
+package ece
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of a reload, as labelled on ece_config_reloads_total
+const RELOAD_SUCCESS = "success"
+const RELOAD_FAILURE = "failure"
+
+// RELOAD_ENGINE_SETTINGS the settings of the ECE itself that Reload applies.  Every other setting of the ECE itself only takes effect on a restart, while the rest configure its sinks.
+var RELOAD_ENGINE_SETTINGS = []string{"ttl", "decode-base64", "shutdown-timeout"}
+
+// RESTART_SETTINGS the settings Reload can't apply to a running ECE
+var RESTART_SETTINGS = []string{
+	"address",
+	"debug",
+	"listen",
+	"syslog-format",
+	"tls-crt-path",
+	"tls-key-path",
+	"tls-cert",
+	"http-service-id",
+	"metrics-address",
+	"admin-address",
+	"completion",
+	"grace",
+	"max-events",
+	"max-bytes",
+	"overflow",
+	"journal",
+	"journal-compact-interval",
+}
+
+// ReopenSink is implemented by sinks holding files open, which Reload reopens so external log rotation takes effect
+type ReopenSink interface {
+	Reopen() error
+}
+
+// ReloadStatus the outcome of the reloads so far, as the admin API shows it
+type ReloadStatus struct {
+	Reloads   uint64     `json:"reloads"`
+	Failures  uint64     `json:"failures"`
+	Last      *time.Time `json:"last,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+
+	// Restart the settings changed by the last reload that need a restart to take effect
+	Restart []string `json:"restart_needed,omitempty"`
+}
+
+// reloadState serializes reloads, and records how they went.  The status has a lock of its own, so it can be read mid reload.
+type reloadState struct {
+	sync.Mutex
+	statusMutex sync.Mutex
+	status      ReloadStatus
+}
+
+// changedSettings lists the settings that differ between the configs, by key
+func changedSettings(a Config, b Config) (keys []string) {
+	va := reflect.ValueOf(a)
+	vb := reflect.ValueOf(b)
+
+	for i := 0; i < va.NumField(); i++ {
+		key := va.Type().Field(i).Tag.Get("mapstructure")
+		if key == "-" {
+			continue
+		}
+
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// contains reports whether the key is in the list
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reload re-reads the config with load, e.g. LoadConfig, and applies it to the running ECE.  The TTL applies to new events, and decode-base64 to events written from now on.  If any sink setting changed, every sink is rebuilt, and swapped in at once for the old ones, which are then flushed and closed in the background, within the shutdown timeout.  Otherwise log files are just reopened, for external log rotation.  Settings that need a restart are logged, and otherwise ignored.  On failure the ECE carries on as it was.  The outcome is logged, counted in ece_config_reloads_total, and shown at /reload on the admin API.
+func (ece *ECE) Reload(load func() (Config, error)) (err error) {
+	ece.reload.Lock()
+	defer ece.reload.Unlock()
+
+	restart := []string{}
+
+	defer func() {
+		ece.recordReload(restart, err)
+	}()
+
+	config, err := load()
+	if err != nil {
+		err = errors.Wrap(err, "failed to load config")
+		return err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+
+	rebuild := ece.config == nil
+
+	if ece.config != nil {
+		for _, key := range changedSettings(*ece.config, config) {
+			switch {
+			case contains(RESTART_SETTINGS, key):
+				restart = append(restart, key)
+			case !contains(RELOAD_ENGINE_SETTINGS, key):
+				rebuild = true
+			}
+		}
+	}
+
+	var sinks []Sink
+
+	if rebuild {
+		sinks, err = config.sinks()
+		if err != nil {
+			err = errors.Wrap(err, "failed to set up sinks")
+			return err
+		}
+	}
+
+	if rebuild {
+		ece.metrics.reportSinkFailures(sinks)
+	}
+
+	ece.settings.Lock()
+	old := multiSink(ece.Sinks)
+	ece.Ttl = time.Duration(config.TTL) * time.Second
+	ece.DecodeFields = config.DecodeBase64
+	if rebuild {
+		ece.Sinks = sinks
+	}
+	ece.config = &config
+	ece.settings.Unlock()
+
+	if rebuild {
+		// Nothing writes to the old sinks now.  They're closed in the background, so a slow one holds up neither the next reload nor a shutdown, which waits for them within its own timeout.
+		ece.retiring.Add(1)
+		go func(deadline time.Time) {
+			defer ece.retiring.Done()
+
+			closeErr := old.flushAndClose(deadline)
+			if closeErr != nil {
+				log.Printf("Error closing the replaced sinks: %s", closeErr)
+			}
+		}(time.Now().Add(config.ShutdownTimeout))
+
+		return err
+	}
+
+	return old.each(func(sink Sink) error {
+		if reopener, ok := sink.(ReopenSink); ok {
+			return reopener.Reopen()
+		}
+
+		return nil
+	})
+}
+
+// recordReload logs and records the outcome of a reload
+func (ece *ECE) recordReload(restart []string, err error) {
+	now := time.Now()
+
+	ece.reload.statusMutex.Lock()
+	defer ece.reload.statusMutex.Unlock()
+
+	ece.reload.status.Reloads++
+	ece.reload.status.Last = &now
+	ece.reload.status.LastError = ""
+	ece.reload.status.Restart = restart
+
+	if err != nil {
+		ece.reload.status.Failures++
+		ece.reload.status.LastError = err.Error()
+		ece.metrics.reloads.WithLabelValues(RELOAD_FAILURE).Inc()
+		log.Printf("Reload failed, carrying on as before: %s", err)
+		return
+	}
+
+	ece.metrics.reloads.WithLabelValues(RELOAD_SUCCESS).Inc()
+
+	if len(restart) > 0 {
+		log.Printf("Reloaded.  Restart to apply the changes to %s", strings.Join(restart, ", "))
+		return
+	}
+
+	log.Printf("Reloaded.  TTL: %s", time.Duration(ece.config.TTL)*time.Second)
+}
+
+// ReloadStatus returns the outcome of the reloads so far
+func (ece *ECE) ReloadStatus() ReloadStatus {
+	ece.reload.statusMutex.Lock()
+	defer ece.reload.statusMutex.Unlock()
+
+	return ece.reload.status
+}
+
+// Config returns the config last applied by Config.NewECE or Reload, or nil if the ECE wasn't created from one
+func (ece *ECE) Config() *Config {
+	ece.settings.RLock()
+	defer ece.settings.RUnlock()
+
+	return ece.config
+}
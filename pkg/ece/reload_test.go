@@ -0,0 +1,174 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReloadConfig a config for an ECE logging to the dir
+func testReloadConfig(dir string) Config {
+	config := DefaultConfig()
+	config.Address = testAddress()
+	config.LogFile = filepath.Join(dir, "ece.log")
+	config.TLSCrtPath = ""
+	config.TLSKeyPath = ""
+
+	return config
+}
+
+// testLoad a loader for Reload returning the config
+func testLoad(config Config) func() (Config, error) {
+	return func() (Config, error) {
+		return config, nil
+	}
+}
+
+// testWrite adds a WAF entry for the req id and writes it out
+func testWrite(t *testing.T, ece *ECE, reqId string) {
+	_ = ece.AddEvent(testWafEntryMessageFor(reqId))
+
+	err := ece.WriteEvent(reqId)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s", reqId, err)
+	}
+}
+
+// testReadFile returns the file's contents, or "" if it doesn't exist
+func testReadFile(path string) string {
+	b, _ := ioutil.ReadFile(path)
+	return string(b)
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-reload")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testReloadConfig(dir)
+
+	ece, err := config.NewECE()
+	if err != nil {
+		t.Fatalf("failed to create ECE: %s", err)
+	}
+	defer ece.closeSinks(time.Now().Add(time.Second))
+
+	sink := ece.Sinks[0]
+
+	t.Run("ttl", func(t *testing.T) {
+		config.TTL = 60
+
+		err := ece.Reload(testLoad(config))
+		assert.Equal(t, err, nil, "Reloaded.")
+		assert.Equal(t, ece.Ttl, time.Minute, "TTL changed.")
+		assert.Equal(t, ece.Sinks[0], sink, "Sinks kept.")
+		assert.Equal(t, ece.Config().TTL, 60, "Config recorded.")
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		testWrite(t, ece, "before")
+
+		rotated := filepath.Join(dir, "ece.log.1")
+		err := os.Rename(config.LogFile, rotated)
+		if err != nil {
+			t.Fatalf("failed to rotate: %s", err)
+		}
+
+		err = ece.Reload(testLoad(config))
+		assert.Equal(t, err, nil, "Reloaded.")
+
+		testWrite(t, ece, "after")
+
+		assert.Equal(t, strings.Contains(testReadFile(rotated), `"request_id":"before"`), true, "Earlier event in the rotated file.")
+		assert.Equal(t, strings.Contains(testReadFile(config.LogFile), `"request_id":"after"`), true, "Later event in a new file.")
+		assert.Equal(t, strings.Contains(testReadFile(rotated), `"request_id":"after"`), false, "Rotated file left alone.")
+	})
+
+	t.Run("sinks", func(t *testing.T) {
+		config.LogFile = filepath.Join(dir, "other.log")
+		config.OutputFormat = FORMAT_CEF
+
+		err := ece.Reload(testLoad(config))
+		assert.Equal(t, err, nil, "Reloaded.")
+		assert.Equal(t, ece.Sinks[0] != sink, true, "Sinks replaced.")
+
+		testWrite(t, ece, "other")
+
+		assert.Equal(t, strings.HasPrefix(testReadFile(config.LogFile), "CEF:0|"), true, "Event in the new format and file.")
+	})
+
+	t.Run("slow sink", func(t *testing.T) {
+		slow := &testSlowSink{release: make(chan struct{})}
+		defer close(slow.release)
+
+		ece.settings.Lock()
+		ece.Sinks = append(ece.Sinks, slow)
+		ece.settings.Unlock()
+
+		config.OutputFormat = FORMAT_JSON
+
+		start := time.Now()
+		err := ece.Reload(testLoad(config))
+		assert.Equal(t, err, nil, "Reloaded.")
+		assert.Equal(t, time.Since(start) < time.Second, true, "Reload didn't wait for the slow sink to close.")
+		assert.Equal(t, ece.Config().OutputFormat, FORMAT_JSON, "Config readable while it closes.")
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		config.MaxEvents = 10
+
+		err := ece.Reload(testLoad(config))
+		assert.Equal(t, err, nil, "Reloaded.")
+		assert.Equal(t, ece.MaxEvents, 0, "Not applied.")
+		assert.Equal(t, ece.ReloadStatus().Restart, []string{"max-events"}, "Restart needed.")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		bad := config
+		bad.TTL = 0
+		bad.LogFile = filepath.Join(dir, "bad.log")
+
+		err := ece.Reload(testLoad(bad))
+		assert.Equal(t, err != nil, true, "Invalid config refused.")
+		assert.Equal(t, ece.Ttl, time.Minute, "TTL kept.")
+		assert.Equal(t, ece.Config().LogFile, config.LogFile, "Config kept.")
+
+		err = ece.Reload(func() (Config, error) { return config, fmt.Errorf("no such file") })
+		assert.Equal(t, err != nil, true, "Load failure reported.")
+	})
+
+	status := ece.ReloadStatus()
+	assert.Equal(t, status.Reloads, uint64(7), "Reloads counted.")
+	assert.Equal(t, status.Failures, uint64(2), "Failures counted.")
+	assert.Equal(t, strings.Contains(status.LastError, "no such file"), true, "Last error kept.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.reloads.WithLabelValues(RELOAD_SUCCESS)), float64(5), "Successes counted.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.reloads.WithLabelValues(RELOAD_FAILURE)), float64(2), "Failures counted.")
+
+	code, body := adminRequest(ece, http.MethodGet, "/reload")
+	assert.Equal(t, code, http.StatusOK, "Status served.")
+
+	var served ReloadStatus
+	_ = json.Unmarshal([]byte(body), &served)
+	assert.Equal(t, served.Failures, uint64(2), "Status shown.")
+}
+
+func TestChangedSettings(t *testing.T) {
+	a := DefaultConfig()
+	b := DefaultConfig()
+	b.File = "/etc/ece.yaml"
+	b.TTL = 60
+	b.KafkaBrokers = []string{"kafka:9092"}
+
+	assert.Equal(t, changedSettings(a, b), []string{"ttl", "kafka-brokers"}, "Changes listed by key.")
+	assert.Equal(t, len(changedSettings(a, a)), 0, "Nothing changed.")
+}
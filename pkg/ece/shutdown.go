@@ -0,0 +1,124 @@
+package ece
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Stop gracefully stops the ECE.  It stops accepting connections, lets the workers correlate whatever the listeners have already received, then stops expiring events and writes every pending one without waiting for its TTL, and flushes and closes the sinks.  Everything has to be done within the timeout; whatever isn't, including sinks still sending when it runs out, is reported in the returned error, and is lost unless journaled.
+func (ece *ECE) Stop(timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	atomic.StoreInt32(&ece.running, 0)
+
+	// Stop accepting.  HTTP requests already in flight are allowed to finish.
+	for _, server := range ece.httpServers {
+		shutdownErr := server.Shutdown(ctx)
+		if shutdownErr != nil && err == nil {
+			err = errors.Wrapf(shutdownErr, "failed to shut down http server")
+		}
+	}
+
+	killErr := ece.killSyslog()
+	if killErr != nil && err == nil {
+		err = killErr
+	}
+
+	// Once the listeners have stopped, nothing else can send on the channel, so the workers can drain it and exit
+	if waitUntil(deadline, ece.Wait) {
+		if ece.channel != nil {
+			close(ece.channel)
+			ece.channel = nil
+		}
+
+		if !waitUntil(deadline, ece.workerWait.Wait) && err == nil {
+			err = errors.New("timed out correlating received messages")
+		}
+	} else if err == nil {
+		err = errors.New("timed out waiting for listeners to stop")
+	}
+
+	// Stop expiring, so nothing writes to the sinks behind the flush, or once they're closed
+	if !waitUntil(deadline, ece.expiries.stop) && err == nil {
+		err = errors.New("timed out waiting for expiring events to be written")
+	}
+
+	flushErr := ece.Flush(deadline)
+	if flushErr != nil && err == nil {
+		err = flushErr
+	}
+
+	sinkErr := ece.closeSinks(deadline)
+	if sinkErr != nil && err == nil {
+		err = sinkErr
+	}
+
+	// Sinks a reload replaced may still be sending what they had
+	if !waitUntil(deadline, ece.retiring.Wait) && err == nil {
+		err = errors.New("timed out closing the sinks replaced by a reload")
+	}
+
+	journalErr := ece.closeJournal()
+	if journalErr != nil && err == nil {
+		err = journalErr
+	}
+
+	return err
+}
+
+// Flush writes every pending event now, regardless of its TTL.  It gives up once the deadline has passed, returning an error saying how many events went unwritten.
+func (ece *ECE) Flush(deadline time.Time) (err error) {
+	_, err = ece.flush(deadline)
+	return err
+}
+
+// flush is Flush, also returning the number of events written
+func (ece *ECE) flush(deadline time.Time) (written int, err error) {
+	reqIds := []string{}
+
+	ece.events.Range(func(reqId string, event *Event) bool {
+		reqIds = append(reqIds, reqId)
+		return true
+	})
+
+	for i, reqId := range reqIds {
+		if time.Now().After(deadline) {
+			err = fmt.Errorf("timed out flushing events, %d left unwritten", len(reqIds)-i)
+			return written, err
+		}
+
+		ece.expiries.Cancel(reqId)
+
+		writeErr := ece.WriteEvent(reqId)
+		if writeErr != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "error writing flushed event: %s\n", writeErr)
+		}
+		written++
+	}
+
+	return written, err
+}
+
+// waitUntil calls wait, and reports whether it returned before the deadline
+func waitUntil(deadline time.Time, wait func()) bool {
+	done := make(chan struct{})
+
+	go func() {
+		wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
@@ -0,0 +1,247 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink a destination for correlated events.  Write is called from many goroutines at once.  Sinks that batch or buffer should write everything they hold on Flush, and Close is called once, after the last Write.
+type Sink interface {
+	Write(event OutputEvent) error
+	Flush() error
+	Close() error
+}
+
+// FileSink writes events as lines to a log file, rotating it as it grows
+type FileSink struct {
+	sync.Mutex
+	logger *lumberjack.Logger
+
+	// Formatter renders each line.  JSON if unset.
+	Formatter Formatter
+}
+
+// NewFileSink creates a FileSink.  maxSize is in megabytes and maxAge in days, as for lumberjack.
+func NewFileSink(logFile string, maxSize int, maxBackups int, maxAge int, compress bool) *FileSink {
+	return &FileSink{
+		logger: &lumberjack.Logger{
+			Filename:   logFile,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAge,
+			Compress:   compress,
+		},
+	}
+}
+
+// Write writes the event as a single line
+func (s *FileSink) Write(event OutputEvent) (err error) {
+	line, err := formatOrJSON(s.Formatter, event)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	_, err = s.logger.Write(append(line, '\n'))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to write req id %q to %s", event.RequestId, s.logger.Filename)
+	}
+
+	return err
+}
+
+// Ready checks that the log file can be opened for writing
+func (s *FileSink) Ready() error {
+	name := s.logger.Filename
+	if name == "" {
+		// lumberjack picks a file in the temp dir
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "can't create the directory for %s", name)
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "can't write to %s", name)
+	}
+
+	return f.Close()
+}
+
+// Flush does nothing, as every Write goes straight to the file
+func (s *FileSink) Flush() error {
+	return nil
+}
+
+// Close closes the current log file
+func (s *FileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.logger.Close()
+}
+
+// Reopen closes the current log file, so the next Write opens it afresh, e.g. once logrotate has moved it aside
+func (s *FileSink) Reopen() error {
+	return s.Close()
+}
+
+// startTime parses the event's StartTime, which Fastly gives in epoch seconds, though RFC3339 is accepted too.  ok is false if it's missing, as for events that never got a req entry, or unparseable.
+func startTime(event OutputEvent) (when time.Time, ok bool) {
+	if seconds, err := strconv.ParseFloat(event.StartTime, 64); err == nil {
+		whole := math.Floor(seconds)
+		return time.Unix(int64(whole), int64((seconds-whole)*1e9)), true
+	}
+
+	if parsed, err := time.Parse(time.RFC3339, event.StartTime); err == nil {
+		return parsed, true
+	}
+
+	return when, false
+}
+
+// multiSink fans each call out to several sinks.  Every sink is tried, even if an earlier one fails.
+type multiSink []Sink
+
+// each calls f for every sink, and combines any errors
+func (m multiSink) each(f func(sink Sink) error) error {
+	failures := []string{}
+
+	for _, sink := range m {
+		err := f(sink)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d of %d sinks failed: %s", len(failures), len(m), strings.Join(failures, "; "))
+}
+
+func (m multiSink) Write(event OutputEvent) error {
+	return m.each(func(sink Sink) error { return sink.Write(event) })
+}
+
+func (m multiSink) Flush() error {
+	return m.each(func(sink Sink) error { return sink.Flush() })
+}
+
+func (m multiSink) Close() error {
+	return m.each(func(sink Sink) error { return sink.Close() })
+}
+
+// closeSinks flushes and closes every sink, giving up on any still busy at the deadline
+func (ece *ECE) closeSinks(deadline time.Time) (err error) {
+	ece.settings.RLock()
+	sinks := multiSink(ece.Sinks)
+	ece.settings.RUnlock()
+
+	return sinks.flushAndClose(deadline)
+}
+
+// flushAndClose flushes and closes each sink, every one on a goroutine of its own so a slow one doesn't hold up the rest.  Sinks still busy at the deadline are left to finish in the background, and named in the error.
+func (m multiSink) flushAndClose(deadline time.Time) (err error) {
+	type closed struct {
+		index int
+		err   error
+	}
+
+	results := make(chan closed, len(m))
+
+	for i, sink := range m {
+		go func(i int, sink Sink) {
+			err := sink.Flush()
+			if err != nil {
+				err = errors.Wrapf(err, "failed to flush %s sink", sinkName(sink))
+				_ = sink.Close()
+			} else if err = sink.Close(); err != nil {
+				err = errors.Wrapf(err, "failed to close %s sink", sinkName(sink))
+			}
+
+			results <- closed{index: i, err: err}
+		}(i, sink)
+	}
+
+	finished := make([]bool, len(m))
+	failures := []string{}
+	timeout := time.After(time.Until(deadline))
+
+	record := func(result closed) {
+		finished[result.index] = true
+		if result.err != nil {
+			failures = append(failures, result.err.Error())
+		}
+	}
+
+wait:
+	for pending := len(m); pending > 0; pending-- {
+		select {
+		case result := <-results:
+			record(result)
+		case <-timeout:
+			// Take whatever finished at the last moment before naming the rest
+			for ; pending > 0; pending-- {
+				select {
+				case result := <-results:
+					record(result)
+				default:
+					break wait
+				}
+			}
+		}
+	}
+
+	unfinished := []string{}
+	for i, sink := range m {
+		if !finished[i] {
+			unfinished = append(unfinished, sinkName(sink))
+		}
+	}
+
+	failed := len(failures) + len(unfinished)
+	if failed == 0 {
+		return nil
+	}
+
+	if len(unfinished) > 0 {
+		failures = append(failures, fmt.Sprintf("timed out flushing and closing %s", strings.Join(unfinished, ", ")))
+	}
+
+	return fmt.Errorf("failed to close %d of %d sinks: %s", failed, len(m), strings.Join(failures, "; "))
+}
+
+// sinkName the name a sink goes by in errors and metrics
+func sinkName(sink Sink) string {
+	switch sink.(type) {
+	case *FileSink:
+		return "file"
+	case *SyslogSink:
+		return "syslog"
+	case *WebhookSink:
+		return "webhook"
+	case *ElasticSink:
+		return "elastic"
+	case *SplunkSink:
+		return "splunk"
+	case *KafkaSink:
+		return "kafka"
+	default:
+		return fmt.Sprintf("%T", sink)
+	}
+}
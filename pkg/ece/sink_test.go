@@ -0,0 +1,124 @@
+package ece
+
+import (
+	"errors"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testFailingSink a sink that fails every call
+type testFailingSink struct{}
+
+func (s testFailingSink) Write(event OutputEvent) error { return errors.New("write failed") }
+
+func (s testFailingSink) Flush() error { return errors.New("flush failed") }
+
+func (s testFailingSink) Close() error { return errors.New("close failed") }
+
+func TestFileSink(t *testing.T) {
+	path := fmt.Sprintf("%s/events.log", tmpDir)
+
+	sink := NewFileSink(path, 1, 0, 0, false)
+
+	for _, reqId := range []string{"a", "b"} {
+		err := sink.Write(OutputEvent{RequestId: reqId})
+		if err != nil {
+			t.Fatalf("failed writing: %s", err)
+		}
+	}
+
+	err := sink.Close()
+	if err != nil {
+		t.Errorf("failed closing: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed reading %s: %s", path, err)
+	}
+
+	ok, message := compareOutput(string(contents), []OutputEvent{{RequestId: "a"}, {RequestId: "b"}})
+	if !ok {
+		t.Error(message)
+	}
+}
+
+func TestFileSinkFormat(t *testing.T) {
+	path := fmt.Sprintf("%s/events.cef", tmpDir)
+
+	sink := NewFileSink(path, 1, 0, 0, false)
+	sink.Formatter = CEFFormatter{}
+
+	err := sink.Write(testOutputEvent())
+	if err != nil {
+		t.Fatalf("failed writing: %s", err)
+	}
+
+	_ = sink.Close()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed reading %s: %s", path, err)
+	}
+
+	want, _ := CEFFormatter{}.Format(testOutputEvent())
+	assert.Equal(t, string(contents), string(want)+"\n", "Event written as a CEF line.")
+}
+
+// TestFanOut writes through an ECE with several sinks, one of them broken, and checks the others still get every event
+func TestFanOut(t *testing.T) {
+	first := &testSink{}
+	second := &testSink{}
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{first, testFailingSink{}, second}
+
+	_ = ece.AddEvent(testWafEntryMessage())
+	_ = ece.AddEvent(testWebEntryMessage())
+
+	err := ece.WriteEvent(testWafEntry().RequestId)
+	if err == nil {
+		t.Error("broken sink not reported")
+	} else if !strings.Contains(err.Error(), "1 of 3 sinks failed") {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for i, sink := range []*testSink{first, second} {
+		ok, message := compareOutput(sink.String(), []OutputEvent{testOutputEvent()})
+		if !ok {
+			t.Errorf("sink %d: %s", i, message)
+		}
+	}
+
+	err = ece.closeSinks(time.Now().Add(time.Second))
+	assert.Equal(t, err != nil, true, "Broken sink reported on close.")
+}
+
+// testSlowSink a sink whose Flush waits until released
+type testSlowSink struct {
+	testSink
+	release chan struct{}
+}
+
+func (s *testSlowSink) Flush() error {
+	<-s.release
+	return nil
+}
+
+func TestCloseSinksDeadline(t *testing.T) {
+	fast := &testSink{}
+	slow := &testSlowSink{release: make(chan struct{})}
+	defer close(slow.release)
+
+	start := time.Now()
+	err := multiSink{fast, slow}.flushAndClose(start.Add(50 * time.Millisecond))
+
+	assert.Equal(t, time.Since(start) < time.Second, true, "Gave up on the slow sink at the deadline.")
+	assert.Equal(t, err != nil, true, "Slow sink reported.")
+	assert.Equal(t, strings.Contains(err.Error(), "timed out flushing and closing *ece.testSlowSink"), true, fmt.Sprintf("Slow sink named: %s", err))
+	assert.Equal(t, strings.Contains(err.Error(), "1 of 2 sinks"), true, fmt.Sprintf("Only the slow sink: %s", err))
+}
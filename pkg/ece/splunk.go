@@ -0,0 +1,577 @@
+package ece
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SPLUNK_SOURCETYPE_DEFAULT = "fastly:waf"
+const SPLUNK_SOURCE_DEFAULT = "fastly-waf-ece"
+const SPLUNK_BATCH_SIZE_DEFAULT = 100
+const SPLUNK_BATCH_INTERVAL_DEFAULT = time.Second
+const SPLUNK_RETRIES_DEFAULT = 5
+const SPLUNK_TIMEOUT = 30 * time.Second
+
+// SPLUNK_ACK_TIMEOUT_DEFAULT how long to wait for Splunk to acknowledge indexing a batch before sending it again
+const SPLUNK_ACK_TIMEOUT_DEFAULT = time.Minute
+
+// SPLUNK_ACK_POLL how often to ask Splunk whether a batch has been indexed
+const SPLUNK_ACK_POLL = time.Second
+
+const SPLUNK_EVENT_PATH = "/services/collector/event"
+const SPLUNK_ACK_PATH = "/services/collector/ack"
+
+// SplunkSink sends events to a Splunk HTTP Event Collector (HEC), each wrapped in the HEC envelope with its time taken from StartTime.  The event is the envelope's JSON object, or with a Formatter other than JSONFormatter, its formatted line as a string.  Batches failing with a 5xx, a 429 or a network error are retried with exponential backoff.  With Ack, each batch is sent on an acknowledgement channel and only counted as sent once Splunk confirms it's indexed, being resent if it doesn't within AckTimeout.  Acknowledgements are polled for on a goroutine of their own, so batches keep flowing while earlier ones await theirs.
+type SplunkSink struct {
+	// URL the base URL of the HEC, e.g. https://splunk.example.com:8088
+	URL   string
+	Token string
+
+	Index      string
+	Sourcetype string
+	Source     string
+
+	// Gzip compress request bodies
+	Gzip bool
+
+	// Formatter renders each event as a line, e.g. CEFFormatter.  The event is sent as JSON if unset.
+	Formatter Formatter
+
+	// Ack wait for Splunk to acknowledge indexing each batch.  Indexer acknowledgement must be enabled on the token.
+	Ack bool
+
+	// Channel the acknowledgement channel.  Generated if empty.
+	Channel string
+
+	AckTimeout time.Duration
+
+	// AckPoll how often to check for acknowledgement.  Defaults to SPLUNK_ACK_POLL.
+	AckPoll time.Duration
+
+	BatchSize     int
+	BatchInterval time.Duration
+	Retries       int
+
+	// Client the HTTP client to send with.  Defaults to one with a SPLUNK_TIMEOUT timeout.
+	Client *http.Client
+
+	batcher  *batcher
+	hostname string
+	mutex    sync.Mutex
+	sent     uint64
+	failed   uint64
+
+	// acks the batches awaiting acknowledgement, by ack id, and awaiting how many batches are yet to be acknowledged or given up on, including any being resent.  settled is signalled whenever awaiting drops to zero, for Flush.
+	acks        map[int64]*splunkPending
+	awaiting    int
+	ackFailures int
+	settled     *sync.Cond
+	ackStop     chan struct{}
+	ackDone     chan struct{}
+
+	failureReporter
+}
+
+// splunkPending a batch sent on the acknowledgement channel, awaiting acknowledgement
+type splunkPending struct {
+	batch    []OutputEvent
+	body     []byte
+	deadline time.Time
+	resends  int
+}
+
+// splunkEnvelope the HEC event envelope.  A batch is these concatenated.
+type splunkEnvelope struct {
+	Time       float64     `json:"time,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	Source     string      `json:"source,omitempty"`
+	Sourcetype string      `json:"sourcetype,omitempty"`
+	Index      string      `json:"index,omitempty"`
+	Event      interface{} `json:"event"`
+}
+
+// splunkResponse the HEC's reply to events
+type splunkResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckId *int64 `json:"ackId"`
+}
+
+type splunkAckRequest struct {
+	Acks []int64 `json:"acks"`
+}
+
+type splunkAckResponse struct {
+	Acks map[string]bool `json:"acks"`
+}
+
+// NewSplunkSink creates a SplunkSink for the HEC at url, authenticating with token, with default settings.  Adjust them, then call Start.
+func NewSplunkSink(url string, token string) *SplunkSink {
+	return &SplunkSink{
+		URL:           strings.TrimRight(url, "/"),
+		Token:         token,
+		Sourcetype:    SPLUNK_SOURCETYPE_DEFAULT,
+		Source:        SPLUNK_SOURCE_DEFAULT,
+		AckTimeout:    SPLUNK_ACK_TIMEOUT_DEFAULT,
+		AckPoll:       SPLUNK_ACK_POLL,
+		BatchSize:     SPLUNK_BATCH_SIZE_DEFAULT,
+		BatchInterval: SPLUNK_BATCH_INTERVAL_DEFAULT,
+		Retries:       SPLUNK_RETRIES_DEFAULT,
+	}
+}
+
+// newChannel generates a random UUID for an acknowledgement channel
+func newChannel() (channel string, err error) {
+	b := make([]byte, 16)
+
+	_, err = rand.Read(b)
+	if err != nil {
+		err = errors.Wrap(err, "failed to generate HEC channel")
+		return channel, err
+	}
+
+	// Version 4, variant 1
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), err
+}
+
+// Start starts sending
+func (s *SplunkSink) Start() (err error) {
+	if s.URL == "" || s.Token == "" {
+		err = errors.New("splunk sink needs a URL and token")
+		return err
+	}
+
+	if s.Ack && s.Channel == "" {
+		s.Channel, err = newChannel()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.AckTimeout <= 0 {
+		s.AckTimeout = SPLUNK_ACK_TIMEOUT_DEFAULT
+	}
+
+	if s.AckPoll <= 0 {
+		s.AckPoll = SPLUNK_ACK_POLL
+	}
+
+	if s.BatchInterval <= 0 {
+		s.BatchInterval = SPLUNK_BATCH_INTERVAL_DEFAULT
+	}
+
+	if s.Client == nil {
+		s.Client = &http.Client{Timeout: SPLUNK_TIMEOUT}
+	}
+
+	s.hostname, _ = os.Hostname()
+
+	s.batcher = newBatcher(s.BatchSize, s.BatchInterval, s.deliver)
+	s.batcher.shelve = func(batch []OutputEvent) {
+		s.fail(len(batch))
+		_, _ = fmt.Fprintf(os.Stderr, "dropped %d events, as %s isn't keeping up\n", len(batch), s.URL)
+	}
+	s.batcher.start()
+
+	if s.Ack {
+		s.acks = make(map[int64]*splunkPending)
+		s.settled = sync.NewCond(&s.mutex)
+		s.ackStop = make(chan struct{})
+		s.ackDone = make(chan struct{})
+
+		go s.pollAcks()
+	}
+
+	return err
+}
+
+// Write adds the event to the current batch.  It never waits on Splunk, but fails if the sink hasn't been started.
+func (s *SplunkSink) Write(event OutputEvent) (err error) {
+	if s.batcher == nil {
+		err = fmt.Errorf("splunk %s not started, req id %q not written", s.URL, event.RequestId)
+		return err
+	}
+
+	s.batcher.add(event)
+
+	return err
+}
+
+// Flush sends every event written so far, waiting for acknowledgement if enabled
+func (s *SplunkSink) Flush() (err error) {
+	if s.batcher == nil {
+		return err
+	}
+
+	err = s.batcher.flush()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to flush to %s", s.URL)
+		return err
+	}
+
+	if !s.Ack {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.awaiting > 0 {
+		s.settled.Wait()
+	}
+
+	if s.ackFailures > 0 {
+		err = fmt.Errorf("failed to flush to %s: %d batches weren't acknowledged", s.URL, s.ackFailures)
+		s.ackFailures = 0
+	}
+
+	return err
+}
+
+// Close stops sending.  Anything unsent or unacknowledged is dropped, so Flush first.
+func (s *SplunkSink) Close() error {
+	if s.batcher == nil {
+		return nil
+	}
+
+	s.batcher.close()
+
+	// Only once the batcher has stopped, so nothing more can await acknowledgement
+	if s.Ack {
+		close(s.ackStop)
+		<-s.ackDone
+	}
+
+	return nil
+}
+
+// Sent returns the number of events Splunk has accepted, or acknowledged if Ack is set
+func (s *SplunkSink) Sent() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.sent
+}
+
+// Failed returns the number of events given up on
+func (s *SplunkSink) Failed() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.failed
+}
+
+func (s *SplunkSink) fail(n int) {
+	s.mutex.Lock()
+	s.failed += uint64(n)
+	s.mutex.Unlock()
+
+	s.gaveUp(n)
+}
+
+// encode wraps each event in the HEC envelope, and concatenates them
+func (s *SplunkSink) encode(batch []OutputEvent) (body []byte, err error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+
+	for _, event := range batch {
+		envelope := splunkEnvelope{
+			Host:       s.hostname,
+			Source:     s.Source,
+			Sourcetype: s.Sourcetype,
+			Index:      s.Index,
+			Event:      event,
+		}
+
+		if _, isJSON := s.Formatter.(JSONFormatter); s.Formatter != nil && !isJSON {
+			var line []byte
+			line, err = s.Formatter.Format(event)
+			if err != nil {
+				return body, err
+			}
+
+			envelope.Event = string(line)
+		}
+
+		if when, ok := startTime(event); ok {
+			envelope.Time = float64(when.UnixNano()/int64(time.Millisecond)) / 1000
+		}
+
+		err = encoder.Encode(envelope)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to marshall req id %q for splunk", event.RequestId)
+			return body, err
+		}
+	}
+
+	if !s.Gzip {
+		return buf.Bytes(), err
+	}
+
+	compressed := &bytes.Buffer{}
+	writer := gzip.NewWriter(compressed)
+
+	_, err = writer.Write(buf.Bytes())
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		err = errors.Wrap(err, "failed to compress batch for splunk")
+	}
+
+	return compressed.Bytes(), err
+}
+
+// post sends a request to the HEC and decodes the reply into result.  again reports whether a failure is worth retrying.
+func (s *SplunkSink) post(path string, body []byte, gzipped bool, result interface{}) (again bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create request for %s", s.URL)
+		return false, err
+	}
+
+	req.Header.Set("Authorization", "Splunk "+s.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if s.Channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.Channel)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to post to %s", s.URL)
+		return true, err
+	}
+
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read response from %s", s.URL)
+		return true, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		err = fmt.Errorf("%s responded %s: %s", s.URL, resp.Status, respBody)
+		return true, err
+	case resp.StatusCode >= 300:
+		err = fmt.Errorf("%s rejected request: %s: %s", s.URL, resp.Status, respBody)
+		return false, err
+	}
+
+	err = json.Unmarshal(respBody, result)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse response from %s", s.URL)
+	}
+
+	return false, err
+}
+
+// send makes a single attempt at sending the batch, returning the ack id if Ack is set
+func (s *SplunkSink) send(body []byte) (ackId int64, again bool, err error) {
+	var resp splunkResponse
+
+	again, err = s.post(SPLUNK_EVENT_PATH, body, s.Gzip, &resp)
+	if err != nil {
+		return ackId, again, err
+	}
+
+	if resp.Code != 0 {
+		err = fmt.Errorf("%s rejected events: %s (code %d)", s.URL, resp.Text, resp.Code)
+		return ackId, false, err
+	}
+
+	if !s.Ack {
+		return ackId, false, err
+	}
+
+	if resp.AckId == nil {
+		err = fmt.Errorf("%s didn't return an ack id.  Is indexer acknowledgement enabled for the token?", s.URL)
+		return ackId, false, err
+	}
+
+	return *resp.AckId, false, err
+}
+
+// sendWithRetries sends the batch, retrying with exponential backoff
+func (s *SplunkSink) sendWithRetries(body []byte) (ackId int64, err error) {
+	err = retry(s.Retries, s.batcher.stopping(), func() (again bool, err error) {
+		ackId, again, err = s.send(body)
+		return again, err
+	})
+
+	return ackId, err
+}
+
+// await records that the batch awaits acknowledgement of the ack id, for up to AckTimeout
+func (s *SplunkSink) await(ackId int64, pending *splunkPending) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pending.deadline = time.Now().Add(s.AckTimeout)
+	s.acks[ackId] = pending
+}
+
+// settle records the outcome of a batch that was awaiting acknowledgement
+func (s *SplunkSink) settle(pending *splunkPending, acked bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if acked {
+		s.sent += uint64(len(pending.batch))
+	} else {
+		s.failed += uint64(len(pending.batch))
+		s.ackFailures++
+		s.gaveUp(len(pending.batch))
+	}
+
+	s.awaiting--
+	if s.awaiting == 0 {
+		s.settled.Broadcast()
+	}
+}
+
+// pollAcks checks for acknowledgements every AckPoll until the sink is closed, then gives up on whatever is still awaiting them
+func (s *SplunkSink) pollAcks() {
+	defer close(s.ackDone)
+
+	ticker := time.NewTicker(s.AckPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkAcks()
+
+		case <-s.ackStop:
+			s.mutex.Lock()
+			abandoned := s.acks
+			s.acks = make(map[int64]*splunkPending)
+			s.mutex.Unlock()
+
+			for _, pending := range abandoned {
+				s.settle(pending, false)
+			}
+			return
+		}
+	}
+}
+
+// checkAcks asks Splunk about every ack id awaited in a single request, settling those acknowledged and resending those that have timed out
+func (s *SplunkSink) checkAcks() {
+	s.mutex.Lock()
+	ackIds := make([]int64, 0, len(s.acks))
+	for ackId := range s.acks {
+		ackIds = append(ackIds, ackId)
+	}
+	s.mutex.Unlock()
+
+	if len(ackIds) == 0 {
+		return
+	}
+
+	var resp splunkAckResponse
+
+	body, err := json.Marshal(splunkAckRequest{Acks: ackIds})
+	if err == nil {
+		_, err = s.post(SPLUNK_ACK_PATH+"?channel="+s.Channel, body, false, &resp)
+	}
+
+	now := time.Now()
+	acked := []*splunkPending{}
+	expired := map[int64]*splunkPending{}
+
+	s.mutex.Lock()
+	for _, ackId := range ackIds {
+		pending := s.acks[ackId]
+
+		switch {
+		case err == nil && resp.Acks[strconv.FormatInt(ackId, 10)]:
+			acked = append(acked, pending)
+		case now.After(pending.deadline):
+			expired[ackId] = pending
+		default:
+			continue
+		}
+
+		delete(s.acks, ackId)
+	}
+	s.mutex.Unlock()
+
+	for _, pending := range acked {
+		s.settle(pending, true)
+	}
+
+	for ackId, pending := range expired {
+		s.resend(ackId, pending, err)
+	}
+}
+
+// resend sends a batch again once its acknowledgement has timed out, giving up once it's been resent Retries times
+func (s *SplunkSink) resend(ackId int64, pending *splunkPending, ackErr error) {
+	err := fmt.Errorf("%s didn't acknowledge ack id %d within %s: %v", s.URL, ackId, s.AckTimeout, ackErr)
+
+	if pending.resends < s.Retries {
+		pending.resends++
+
+		var newAckId int64
+		newAckId, err = s.sendWithRetries(pending.body)
+		if err == nil {
+			s.await(newAckId, pending)
+			return
+		}
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "dropping %d events: %s\n", len(pending.batch), err)
+	s.settle(pending, false)
+}
+
+// deliver sends the batch, retrying with exponential backoff.  With Ack, the batch is then left awaiting acknowledgement, so the next can be sent meanwhile.
+func (s *SplunkSink) deliver(batch []OutputEvent) (err error) {
+	var ackId int64
+
+	body, err := s.encode(batch)
+	if err == nil {
+		ackId, err = s.sendWithRetries(body)
+	}
+
+	if err != nil {
+		s.fail(len(batch))
+		_, _ = fmt.Fprintf(os.Stderr, "dropping %d events: %s\n", len(batch), err)
+		return err
+	}
+
+	if s.Ack {
+		s.mutex.Lock()
+		s.awaiting++
+		s.mutex.Unlock()
+
+		s.await(ackId, &splunkPending{batch: batch, body: body})
+		return err
+	}
+
+	s.mutex.Lock()
+	s.sent += uint64(len(batch))
+	s.mutex.Unlock()
+
+	return err
+}
@@ -0,0 +1,338 @@
+package ece
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSplunkToken = "00000000-0000-0000-0000-000000000000"
+
+// testSplunkEnvelope an envelope as the HEC receives it, the event left raw as it may be an object or a string
+type testSplunkEnvelope struct {
+	splunkEnvelope
+	Event json.RawMessage `json:"event"`
+}
+
+// event decodes the envelope's event as one of ours
+func (e testSplunkEnvelope) event() (event OutputEvent) {
+	_ = json.Unmarshal(e.Event, &event)
+
+	return event
+}
+
+// testHEC a fake Splunk HTTP Event Collector.  Every ack id is acknowledged, unless listed in lost.
+type testHEC struct {
+	sync.Mutex
+	server    *httptest.Server
+	status    []int
+	requests  int
+	gzipped   bool
+	channels  []string
+	envelopes []testSplunkEnvelope
+	nextAck   int64
+	lost      map[int64]bool
+}
+
+func newTestHEC() *testHEC {
+	hec := &testHEC{lost: make(map[int64]bool)}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(SPLUNK_EVENT_PATH, func(w http.ResponseWriter, r *http.Request) {
+		hec.Lock()
+		defer hec.Unlock()
+
+		hec.requests++
+
+		if r.Header.Get("Authorization") != "Splunk "+testSplunkToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"text":"Invalid authorization","code":3}`))
+			return
+		}
+
+		if len(hec.status) > 0 {
+			status := hec.status[0]
+			hec.status = hec.status[1:]
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"text":"Server is busy","code":9}`))
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			hec.gzipped = true
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = reader
+		}
+
+		decoder := json.NewDecoder(body)
+		for decoder.More() {
+			var envelope testSplunkEnvelope
+			err := decoder.Decode(&envelope)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"text":"Invalid data format","code":6}`))
+				return
+			}
+			hec.envelopes = append(hec.envelopes, envelope)
+		}
+
+		channel := r.Header.Get("X-Splunk-Request-Channel")
+		if channel == "" {
+			_, _ = w.Write([]byte(`{"text":"Success","code":0}`))
+			return
+		}
+
+		hec.channels = append(hec.channels, channel)
+		_, _ = fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, hec.nextAck)
+		hec.nextAck++
+	})
+
+	mux.HandleFunc(SPLUNK_ACK_PATH, func(w http.ResponseWriter, r *http.Request) {
+		hec.Lock()
+		defer hec.Unlock()
+
+		var req splunkAckRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+
+		resp := splunkAckResponse{Acks: make(map[string]bool)}
+		for _, ackId := range req.Acks {
+			resp.Acks[strconv.FormatInt(ackId, 10)] = !hec.lost[ackId]
+		}
+
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	hec.server = httptest.NewServer(mux)
+
+	return hec
+}
+
+// received returns the request ids received so far
+func (h *testHEC) received() (reqIds []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, envelope := range h.envelopes {
+		reqIds = append(reqIds, envelope.event().RequestId)
+	}
+
+	return reqIds
+}
+
+func TestSplunk(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		t.Run(fmt.Sprintf("gzip-%v", gzipped), func(t *testing.T) {
+			hec := newTestHEC()
+			defer hec.server.Close()
+
+			sink := NewSplunkSink(hec.server.URL, testSplunkToken)
+			sink.Index = "waf"
+			sink.Gzip = gzipped
+			sink.BatchInterval = time.Hour
+
+			err := sink.Start()
+			if err != nil {
+				t.Fatalf("failed starting sink: %s", err)
+			}
+
+			_ = sink.Write(testOutputEvent())
+			_ = sink.Write(OutputEvent{RequestId: "orphan"})
+
+			err = sink.Flush()
+			if err != nil {
+				t.Errorf("failed flushing: %s", err)
+			}
+
+			_ = sink.Close()
+
+			assert.Equal(t, hec.gzipped, gzipped, "Compression meets expectations.")
+			assert.Equal(t, len(hec.envelopes), 2, "Both events received.")
+
+			envelope := hec.envelopes[0]
+			assert.Equal(t, envelope.event(), testOutputEvent(), "Event wrapped whole.")
+			assert.Equal(t, envelope.Time, float64(1521150005), "Time taken from the start time.")
+			assert.Equal(t, envelope.Index, "waf", "Index set.")
+			assert.Equal(t, envelope.Sourcetype, SPLUNK_SOURCETYPE_DEFAULT, "Default sourcetype set.")
+			assert.Equal(t, envelope.Source, SPLUNK_SOURCE_DEFAULT, "Default source set.")
+
+			assert.Equal(t, hec.envelopes[1].Time, float64(0), "No time without a start time, so Splunk uses receipt time.")
+			assert.Equal(t, sink.Sent(), uint64(2), "Sent count meets expectations.")
+		})
+	}
+}
+
+func TestSplunkFormatter(t *testing.T) {
+	hec := newTestHEC()
+	defer hec.server.Close()
+
+	sink := NewSplunkSink(hec.server.URL, testSplunkToken)
+	sink.Formatter = CEFFormatter{}
+	sink.BatchInterval = time.Hour
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+	defer sink.Close()
+
+	_ = sink.Write(testOutputEvent())
+
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("failed flushing: %s", err)
+	}
+
+	want, _ := CEFFormatter{}.Format(testOutputEvent())
+
+	var line string
+	_ = json.Unmarshal(hec.envelopes[0].Event, &line)
+
+	assert.Equal(t, line, string(want), "Formatted line sent as the event string.")
+	assert.Equal(t, hec.envelopes[0].Time, float64(1521150005), "Time still taken from the start time.")
+}
+
+func TestSplunkRetry(t *testing.T) {
+	inputs := []struct {
+		name     string
+		token    string
+		status   []int
+		requests int
+		sent     uint64
+		failed   uint64
+	}{
+		{"busy", testSplunkToken, []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, 1, 0},
+		{"bad token", "wrong", nil, 1, 0, 1},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			hec := newTestHEC()
+			defer hec.server.Close()
+			hec.status = tc.status
+
+			sink := NewSplunkSink(hec.server.URL, tc.token)
+			sink.BatchInterval = time.Hour
+			sink.Retries = 2
+
+			err := sink.Start()
+			if err != nil {
+				t.Fatalf("failed starting sink: %s", err)
+			}
+			defer sink.Close()
+
+			_ = sink.Write(OutputEvent{RequestId: "a"})
+
+			err = sink.Flush()
+			assert.Equal(t, err != nil, tc.failed > 0, fmt.Sprintf("Flush error meets expectations: %v", err))
+
+			assert.Equal(t, hec.requests, tc.requests, "Requests meet expectations.")
+			assert.Equal(t, sink.Sent(), tc.sent, "Sent count meets expectations.")
+			assert.Equal(t, sink.Failed(), tc.failed, "Failed count meets expectations.")
+		})
+	}
+}
+
+// TestSplunkAck sends on an acknowledgement channel, losing the first batch, and checks it's resent once the ack times out
+func TestSplunkAck(t *testing.T) {
+	hec := newTestHEC()
+	defer hec.server.Close()
+	hec.lost[0] = true
+
+	sink := NewSplunkSink(hec.server.URL, testSplunkToken)
+	sink.Ack = true
+	sink.AckTimeout = 50 * time.Millisecond
+	sink.AckPoll = 10 * time.Millisecond
+	sink.BatchInterval = time.Hour
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+	defer sink.Close()
+
+	_ = sink.Write(OutputEvent{RequestId: "a"})
+
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("failed flushing: %s", err)
+	}
+
+	assert.Equal(t, hec.received(), []string{"a", "a"}, "Unacknowledged batch resent.")
+	assert.Equal(t, len(hec.channels), 2, "Sent on a channel.")
+	assert.Equal(t, hec.channels[0], sink.Channel, "Sent on the sink's channel.")
+	assert.Equal(t, len(sink.Channel), 36, "Channel is a UUID.")
+	assert.Equal(t, sink.Sent(), uint64(1), "Sent once acknowledged.")
+}
+
+// TestSplunkAckConcurrent checks that batches keep being sent while earlier ones await acknowledgement, and that Flush waits for every one
+func TestSplunkAckConcurrent(t *testing.T) {
+	hec := newTestHEC()
+	defer hec.server.Close()
+
+	hec.Lock()
+	for ackId := int64(0); ackId < 3; ackId++ {
+		hec.lost[ackId] = true
+	}
+	hec.Unlock()
+
+	sink := NewSplunkSink(hec.server.URL, testSplunkToken)
+	sink.Ack = true
+	sink.AckTimeout = time.Hour
+	sink.AckPoll = 10 * time.Millisecond
+	sink.BatchSize = 1
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+	defer sink.Close()
+
+	for _, reqId := range []string{"a", "b", "c"} {
+		_ = sink.Write(OutputEvent{RequestId: reqId})
+	}
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return len(hec.received()) == 3, fmt.Sprintf("received %v", hec.received())
+	})
+	if !ok {
+		t.Fatalf("batches held up awaiting acknowledgement: %s", message)
+	}
+
+	assert.Equal(t, sink.Sent(), uint64(0), "Nothing counted as sent until acknowledged.")
+
+	hec.Lock()
+	hec.lost = make(map[int64]bool)
+	hec.Unlock()
+
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("failed flushing: %s", err)
+	}
+
+	assert.Equal(t, sink.Sent(), uint64(3), "Every batch acknowledged.")
+	assert.Equal(t, hec.received(), []string{"a", "b", "c"}, "Nothing resent.")
+}
+
+// TestSplunkNotStarted checks that a sink used before Start refuses events rather than panicking
+func TestSplunkNotStarted(t *testing.T) {
+	sink := NewSplunkSink("https://127.0.0.1:8088", testSplunkToken)
+
+	err := sink.Write(testOutputEvent())
+	assert.Equal(t, err != nil, true, "Write refused.")
+	assert.Equal(t, sink.Flush(), nil, "Nothing to flush.")
+	assert.Equal(t, sink.Close(), nil, "Nothing to close.")
+}
@@ -0,0 +1,129 @@
+package ece
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// STORE_SHARDS the number of shards pending events are spread over.  Each shard has its own lock, so messages for different requests rarely contend.
+const STORE_SHARDS = 64
+
+// shard one hash partition of the store
+type shard struct {
+	sync.RWMutex
+	events map[string]*Event
+}
+
+// store the pending events, keyed by request id and hash-sharded to spread lock contention
+type store struct {
+	// accessed atomically, and kept first for alignment
+	count int64
+
+	shards []*shard
+}
+
+// newStore creates a store with n shards
+func newStore(n int) *store {
+	if n < 1 {
+		n = 1
+	}
+
+	s := &store{shards: make([]*shard, n)}
+	for i := range s.shards {
+		s.shards[i] = &shard{events: make(map[string]*Event)}
+	}
+
+	return s
+}
+
+// shard returns the shard holding the request id
+func (s *store) shard(reqId string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(reqId))
+
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Get returns the event for the request id, if it's pending
+func (s *store) Get(reqId string) (event *Event, exists bool) {
+	sh := s.shard(reqId)
+
+	sh.RLock()
+	event, exists = sh.events[reqId]
+	sh.RUnlock()
+
+	return event, exists
+}
+
+// GetOrCreate returns the event for the request id, creating an empty one at the given time if it's not pending.  created reports whether this call created it.
+func (s *store) GetOrCreate(reqId string, now time.Time) (event *Event, created bool) {
+	sh := s.shard(reqId)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	// Double check that someone hasn't inserted the event while the caller didn't hold a lock
+	event, exists := sh.events[reqId]
+	if exists {
+		return event, false
+	}
+
+	event = &Event{created: now}
+	sh.events[reqId] = event
+	atomic.AddInt64(&s.count, 1)
+
+	return event, true
+}
+
+// Remove removes the event for the request id and returns it, or nil if it wasn't pending
+func (s *store) Remove(reqId string) *Event {
+	sh := s.shard(reqId)
+
+	sh.Lock()
+	event, exists := sh.events[reqId]
+	if exists {
+		delete(sh.events, reqId)
+		atomic.AddInt64(&s.count, -1)
+	}
+	sh.Unlock()
+
+	return event
+}
+
+// Discard removes the event for the request id only if it's the one given, reporting whether it was
+func (s *store) Discard(reqId string, event *Event) bool {
+	sh := s.shard(reqId)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	if sh.events[reqId] != event {
+		return false
+	}
+
+	delete(sh.events, reqId)
+	atomic.AddInt64(&s.count, -1)
+
+	return true
+}
+
+// Len returns the number of pending events
+func (s *store) Len() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// Range calls f for each pending event until f returns false.  Each shard is read locked while it's visited, so f must not modify the store.
+func (s *store) Range(f func(reqId string, event *Event) bool) {
+	for _, sh := range s.shards {
+		sh.RLock()
+		for reqId, event := range sh.events {
+			if !f(reqId, event) {
+				sh.RUnlock()
+				return
+			}
+		}
+		sh.RUnlock()
+	}
+}
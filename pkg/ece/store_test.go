@@ -0,0 +1,91 @@
+package ece
+
+import (
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	s := newStore(4)
+
+	event, created := s.GetOrCreate("a", time.Now())
+	assert.Equal(t, created, true, "First retrieval creates the event.")
+
+	again, created := s.GetOrCreate("a", time.Now())
+	assert.Equal(t, created, false, "Second retrieval finds the event.")
+	assert.Equal(t, again == event, true, "Second retrieval returns the same event.")
+
+	_, _ = s.GetOrCreate("b", time.Now())
+	assert.Equal(t, s.Len(), 2, "Both events counted.")
+
+	removed := s.Remove("a")
+	assert.Equal(t, removed == event, true, "Removal returns the event.")
+	assert.Equal(t, s.Remove("a") == nil, true, "Second removal finds nothing.")
+	assert.Equal(t, s.Len(), 1, "Removal uncounted.")
+
+	_, exists := s.Get("a")
+	assert.Equal(t, exists, false, "Removed event is gone.")
+}
+
+// TestConcurrentAdd adds the waf and req entries for many requests from many goroutines at once, and checks that every entry makes it into an event
+func TestConcurrentAdd(t *testing.T) {
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = nil
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 1000; i++ {
+				reqId := fmt.Sprintf("req-%d", i)
+				if w%2 == 0 {
+					_ = ece.AddEvent(testWafEntryMessageFor(reqId))
+				} else {
+					_ = ece.AddEvent(testWebEntryMessageFor(reqId))
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, ece.Pending(), 1000, "One event per request id.")
+
+	ece.events.Range(func(reqId string, event *Event) bool {
+		if len(event.WafEntries) != 4 || len(event.RequestEntries) != 4 {
+			t.Errorf("event %s has %d waf and %d req entries, expected 4 of each", reqId, len(event.WafEntries), len(event.RequestEntries))
+		}
+		return true
+	})
+}
+
+// BenchmarkAddEventParallel adds events from every core at once, comparing a single store and scheduler shard (equivalent to one global lock each) against the default sharding
+func BenchmarkAddEventParallel(b *testing.B) {
+	for _, shards := range []int{1, STORE_SHARDS} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+			ece.Sinks = nil
+			ece.events = newStore(shards)
+			ece.expiries = newScheduler(shards, ece.expire)
+
+			var next int64
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					reqId := fmt.Sprintf("req-%d", atomic.AddInt64(&next, 1)/2)
+					_ = ece.AddEvent(testWafEntryMessageFor(reqId))
+				}
+			})
+		})
+	}
+}
@@ -10,22 +10,69 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
-func testServer() (ece *ECE, logs *strings.Builder) {
-	port, err := freeport.GetFreePort()
+// testSink records written events as JSON lines.  It's safe to read while the ECE is writing.
+type testSink struct {
+	sync.Mutex
+	lines []string
+}
+
+func (s *testSink) Write(event OutputEvent) error {
+	line, err := json.Marshal(event)
 	if err != nil {
-		log.Fatalf("Failed to get a free port on which to run the test server: %s", err)
+		return err
+	}
+
+	s.Lock()
+	s.lines = append(s.lines, string(line))
+	s.Unlock()
+
+	return nil
+}
+
+func (s *testSink) Flush() error {
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+// String returns every event written so far, one per line
+func (s *testSink) String() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return strings.Join(s.lines, "\n")
+}
+
+// Reset forgets the events written so far
+func (s *testSink) Reset() {
+	s.Lock()
+	s.lines = nil
+	s.Unlock()
+}
+
+func testServer() (ece *ECE, logs *testSink) {
+	return testServerWithListeners(nil)
+}
+
+func testServerWithListeners(listeners []Listener) (ece *ECE, logs *testSink) {
+	var address string
+	if len(listeners) == 0 {
+		address = testAddress()
 	}
 
-	address := fmt.Sprintf("127.0.0.1:%d", port)
-	logs = &strings.Builder{}
+	logs = &testSink{}
 	ece = NewECE(500*time.Microsecond, "/dev/null", 0, 0, 0, false, address)
-	ece.logger = log.New(logs, "", 0)
+	ece.Sinks = []Sink{logs}
 	ece.Address = address
+	ece.Listeners = listeners
 	//ece.Debug = true
-	err = ece.Start()
+	err := ece.Start()
 	if err != nil {
 		log.Fatalf("Test Server failed to start: %s", err)
 	}
@@ -33,35 +80,73 @@ func testServer() (ece *ECE, logs *strings.Builder) {
 	return ece, logs
 }
 
+func testAddress() string {
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		log.Fatalf("Failed to get a free port on which to run the test server: %s", err)
+	}
+
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
 func sendSyslog(structuredData string, messages []string, address string, tlsConfig *tls.Config) (err error) {
-	fmt.Printf("Sending data to %s\n", address)
+	if tlsConfig != nil {
+		return sendSyslogListener(structuredData, messages, Listener{Network: LISTENER_TLS, Address: address}, tlsConfig)
+	}
+
+	return sendSyslogListener(structuredData, messages, Listener{Network: LISTENER_TCP, Address: address}, tlsConfig)
+}
+
+func sendSyslogListener(structuredData string, messages []string, listener Listener, tlsConfig *tls.Config) (err error) {
+	if structuredData != "" {
+		structuredData = "[" + structuredData + "]"
+	} else {
+		structuredData = "-"
+	}
+
+	frames := []string{}
+	for _, msg := range messages {
+		frames = append(frames, `<10>1 - - - - test `+structuredData+` `+msg+"\n")
+	}
+
+	return sendFrames(frames, listener, tlsConfig)
+}
+
+// rfc3164Frame wraps the message the way a BSD syslog relay such as rsyslog would
+func rfc3164Frame(msg string) string {
+	return `<13>Mar 15 21:40:05 relay fastly[42]: ` + msg + "\n"
+}
+
+// rfc6587Frame wraps the message as an octet counted RFC5424 frame
+func rfc6587Frame(msg string) string {
+	frame := `<10>1 - - - - test - ` + msg
+	return fmt.Sprintf("%d %s", len(frame), frame)
+}
+
+// sendFrames writes pre-formatted syslog frames to the listener
+func sendFrames(frames []string, listener Listener, tlsConfig *tls.Config) (err error) {
+	fmt.Printf("Sending data to %s\n", listener)
 
 	var conn net.Conn
 
-	if tlsConfig != nil {
-		conn, err = tls.Dial("tcp", address, tlsConfig)
+	if listener.Network == LISTENER_TLS {
+		conn, err = tls.Dial("tcp", listener.Address, tlsConfig)
 		if err != nil {
 			err = errors.Wrap(err, "failed to dial tcp tls")
 			return err
 		}
 
 	} else {
-		conn, err = net.Dial("tcp", address)
+		conn, err = net.Dial(listener.Network, listener.Address)
 		if err != nil {
-			err = errors.Wrap(err, "failed to dial tcp")
+			err = errors.Wrapf(err, "failed to dial %s", listener.Network)
 			return err
 		}
 	}
 
-	if structuredData != "" {
-		structuredData = "[" + structuredData + "]"
-	} else {
-		structuredData = "-"
-	}
-
-	for _, msg := range messages {
+	for _, frame := range frames {
 		fmt.Printf("Writing message ... ")
-		num, err := conn.Write([]byte(`<10>1 - - - - test ` + structuredData + ` ` + msg + "\n"))
+		num, err := conn.Write([]byte(frame))
 		if err != nil {
 			err = errors.Wrapf(err, "failed to write to connection")
 			return err
@@ -0,0 +1,259 @@
+package ece
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS_RELOAD_INTERVAL how often the TLS certs and keys are checked for changes, unless ECE.TLSReloadInterval says otherwise
+const TLS_RELOAD_INTERVAL = 10 * time.Second
+
+// TLSPair a PEM cert and key to serve on the TLS and HTTPS listeners
+type TLSPair struct {
+	CrtPath string
+	KeyPath string
+}
+
+// ParseTLSPair parses a cert and key given as cert.pem:key.pem
+func ParseTLSPair(spec string) (pair TLSPair, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		err = fmt.Errorf("TLS cert %q must be given as cert.pem:key.pem", spec)
+		return pair, err
+	}
+
+	pair = TLSPair{CrtPath: parts[0], KeyPath: parts[1]}
+
+	return pair, err
+}
+
+func (p TLSPair) String() string {
+	return fmt.Sprintf("%s:%s", p.CrtPath, p.KeyPath)
+}
+
+// loadedCert a TLSPair as last loaded from disk
+type loadedCert struct {
+	TLSPair
+	cert    *tls.Certificate
+	names   []string
+	modTime time.Time
+	failure string
+}
+
+// certificates serves the TLS certs to each handshake, picking one by SNI, and reloads them as their files change so renewals take effect without a restart.  The first cert is served to clients asking for a name no cert has, or for none at all.
+type certificates struct {
+	sync.RWMutex
+	certs  []*loadedCert
+	expiry *prometheus.GaugeVec
+	stop   chan struct{}
+	wait   sync.WaitGroup
+}
+
+// modified returns when the pair's cert or key was last changed, whichever is later
+func (p TLSPair) modified() (when time.Time, err error) {
+	for _, path := range []string{p.CrtPath, p.KeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return when, err
+		}
+
+		if info.ModTime().After(when) {
+			when = info.ModTime()
+		}
+	}
+
+	return when, err
+}
+
+// loadCert loads the pair, logging when the cert expires
+func loadCert(pair TLSPair) (loaded *loadedCert, err error) {
+	modified, err := pair.modified()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to read TLS Cert and Key from %s and %s", pair.CrtPath, pair.KeyPath)
+		return loaded, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(pair.CrtPath, pair.KeyPath)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to load TLS Cert and Key from %s and %s", pair.CrtPath, pair.KeyPath)
+		return loaded, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		err = errors.Wrapf(err, "failed to parse TLS Cert %s", pair.CrtPath)
+		return loaded, err
+	}
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "TLS Enabled.  Key: %s  Cert: %s  Names: %s  Expires: %s\n", pair.KeyPath, pair.CrtPath, strings.Join(names, ","), cert.Leaf.NotAfter.Format(time.RFC3339))
+
+	loaded = &loadedCert{
+		TLSPair: pair,
+		cert:    &cert,
+		names:   names,
+		modTime: modified,
+	}
+
+	return loaded, err
+}
+
+// newCertificates loads every pair, failing if any can't be loaded.  Each cert's days until expiry are set on the gauge, labelled by its path.
+func newCertificates(pairs []TLSPair, expiry *prometheus.GaugeVec) (c *certificates, err error) {
+	if len(pairs) == 0 {
+		err = errors.New("TLS listeners require a cert and key, via --tls-crt-path and --tls-key-path (or ECE_TLS_CRT_PATH and ECE_TLS_KEY_PATH), or --tls-cert")
+		return c, err
+	}
+
+	c = &certificates{
+		expiry: expiry,
+	}
+
+	for _, pair := range pairs {
+		loaded, err := loadCert(pair)
+		if err != nil {
+			return c, err
+		}
+
+		c.certs = append(c.certs, loaded)
+	}
+
+	c.observeExpiry()
+
+	return c, err
+}
+
+// observeExpiry sets the days until each cert expires
+func (c *certificates) observeExpiry() {
+	c.RLock()
+	defer c.RUnlock()
+
+	for _, loaded := range c.certs {
+		c.expiry.WithLabelValues(loaded.CrtPath).Set(time.Until(loaded.cert.Leaf.NotAfter).Hours() / 24)
+	}
+}
+
+// reload loads any pair whose files have changed since they were last loaded.  A pair that fails to load, say because the cert has been written but not the key yet, keeps serving what it had, and is tried again next time.
+func (c *certificates) reload() {
+	c.RLock()
+	certs := append([]*loadedCert{}, c.certs...)
+	c.RUnlock()
+
+	for i, current := range certs {
+		modified, err := current.modified()
+		if err == nil && modified.Equal(current.modTime) {
+			continue
+		}
+
+		var loaded *loadedCert
+		if err == nil {
+			loaded, err = loadCert(current.TLSPair)
+		}
+
+		if err != nil {
+			if err.Error() != current.failure {
+				log.Printf("Error reloading TLS cert %s, still serving the one loaded before: %s", current.TLSPair, err)
+			}
+
+			current.failure = err.Error()
+			continue
+		}
+
+		log.Printf("Reloaded TLS cert %s", current.TLSPair)
+
+		c.Lock()
+		c.certs[i] = loaded
+		c.Unlock()
+	}
+
+	c.observeExpiry()
+}
+
+// watch reloads the certs every interval until closed
+func (c *certificates) watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = TLS_RELOAD_INTERVAL
+	}
+
+	stop := make(chan struct{})
+	c.stop = stop
+	c.wait.Add(1)
+
+	go func() {
+		defer c.wait.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.reload()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops watching the certs
+func (c *certificates) close() {
+	if c.stop == nil {
+		return
+	}
+
+	close(c.stop)
+	c.wait.Wait()
+	c.stop = nil
+}
+
+// matches reports whether the cert is for the name, either exactly or by a wildcard standing in for its first label
+func (l *loadedCert) matches(name string, wildcard bool) bool {
+	for _, certName := range l.names {
+		certName = strings.ToLower(certName)
+
+		if !wildcard && certName == name {
+			return true
+		}
+
+		if wildcard && strings.HasPrefix(certName, "*.") {
+			if i := strings.Index(name, "."); i > 0 && name[i:] == certName[1:] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// GetCertificate picks the cert for the name the client asked for by SNI, preferring an exact match to a wildcard, and the first cert if none match.  It's the tls.Config callback.
+func (c *certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if name != "" {
+		for _, wildcard := range []bool{false, true} {
+			for _, loaded := range c.certs {
+				if loaded.matches(name, wildcard) {
+					return loaded.cert, nil
+				}
+			}
+		}
+	}
+
+	return c.certs[0].cert, nil
+}
@@ -0,0 +1,219 @@
+package ece
+
+import (
+	"crypto/tls"
+	"github.com/magiconair/properties/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testTLSPair makes a cert and key for the comma separated hosts in the dir, named for name
+func testTLSPair(t *testing.T, dir string, name string, hosts string) TLSPair {
+	pair := TLSPair{
+		CrtPath: filepath.Join(dir, name+".crt"),
+		KeyPath: filepath.Join(dir, name+".key"),
+	}
+
+	err := makeTestCert(hosts, pair.CrtPath, pair.KeyPath)
+	if err != nil {
+		t.Fatalf("failed to make cert: %s", err)
+	}
+
+	return pair
+}
+
+// testRenew replaces the pair's cert and key, dating them later than before so the change is seen however coarse the file system's clock
+func testRenew(t *testing.T, pair TLSPair, hosts string) {
+	err := makeTestCert(hosts, pair.CrtPath, pair.KeyPath)
+	if err != nil {
+		t.Fatalf("failed to renew cert: %s", err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(pair.CrtPath, later, later)
+	_ = os.Chtimes(pair.KeyPath, later, later)
+}
+
+// testSerial the serial number of the cert served for the name
+func testSerial(t *testing.T, c *certificates, name string) *big.Int {
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	if err != nil {
+		t.Fatalf("failed to get cert for %q: %s", name, err)
+	}
+
+	return cert.Leaf.SerialNumber
+}
+
+// testExpiryGauge a gauge like ECE's own
+func testExpiryGauge() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "tls_cert_expiry_days"}, []string{"cert"})
+}
+
+func TestParseTLSPair(t *testing.T) {
+	inputs := []struct {
+		name string
+		spec string
+		pair TLSPair
+		ok   bool
+	}{
+		{"pair", "/etc/ece/a.crt:/etc/ece/a.key", TLSPair{CrtPath: "/etc/ece/a.crt", KeyPath: "/etc/ece/a.key"}, true},
+		{"no key", "/etc/ece/a.crt", TLSPair{}, false},
+		{"empty key", "/etc/ece/a.crt:", TLSPair{}, false},
+		{"empty cert", ":/etc/ece/a.key", TLSPair{}, false},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			pair, err := ParseTLSPair(tc.spec)
+			assert.Equal(t, err == nil, tc.ok, "Error meets expectations.")
+			assert.Equal(t, pair, tc.pair, "Pair meets expectations.")
+		})
+	}
+}
+
+func TestCertificatesSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-certs")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := testTLSPair(t, dir, "default", "ece.example.com")
+	exact := testTLSPair(t, dir, "exact", "a.example.com,b.example.com")
+	wildcard := testTLSPair(t, dir, "wildcard", "*.example.com")
+
+	c, err := newCertificates([]TLSPair{def, wildcard, exact}, testExpiryGauge())
+	if err != nil {
+		t.Fatalf("failed to load certs: %s", err)
+	}
+
+	serials := map[TLSPair]*big.Int{}
+	for _, loaded := range c.certs {
+		serials[loaded.TLSPair] = loaded.cert.Leaf.SerialNumber
+	}
+
+	inputs := []struct {
+		name       string
+		serverName string
+		pair       TLSPair
+	}{
+		{"no sni", "", def},
+		{"default", "ece.example.com", def},
+		{"exact beats wildcard", "B.example.com.", exact},
+		{"wildcard", "c.example.com", wildcard},
+		{"wildcard covers one label", "a.b.example.com", def},
+		{"unknown", "example.org", def},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, testSerial(t, c, tc.serverName), serials[tc.pair], "Cert meets expectations.")
+		})
+	}
+
+	_, err = newCertificates([]TLSPair{def, {CrtPath: filepath.Join(dir, "missing.crt"), KeyPath: def.KeyPath}}, testExpiryGauge())
+	assert.Equal(t, err != nil, true, "Missing cert refused.")
+
+	_, err = newCertificates(nil, testExpiryGauge())
+	assert.Equal(t, err != nil, true, "No certs refused.")
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-certs")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pair := testTLSPair(t, dir, "ece", "ece.example.com")
+	expiry := testExpiryGauge()
+
+	c, err := newCertificates([]TLSPair{pair}, expiry)
+	if err != nil {
+		t.Fatalf("failed to load certs: %s", err)
+	}
+
+	days := testutil.ToFloat64(expiry.WithLabelValues(pair.CrtPath))
+	assert.Equal(t, days > 0 && days < 1, true, "Days until expiry gauged.")
+
+	before := testSerial(t, c, "ece.example.com")
+
+	c.reload()
+	assert.Equal(t, testSerial(t, c, "ece.example.com"), before, "Unchanged cert kept.")
+
+	testRenew(t, pair, "ece.example.com")
+	c.reload()
+
+	renewed := testSerial(t, c, "ece.example.com")
+	assert.Equal(t, renewed.Cmp(before) != 0, true, "Renewed cert served.")
+
+	err = ioutil.WriteFile(pair.KeyPath, []byte("half written"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write key: %s", err)
+	}
+	later := time.Now().Add(2 * time.Minute)
+	_ = os.Chtimes(pair.KeyPath, later, later)
+
+	c.reload()
+	assert.Equal(t, testSerial(t, c, "ece.example.com"), renewed, "Broken pair doesn't replace the working one.")
+}
+
+func TestTLSCertHotReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ece-certs")
+	if err != nil {
+		t.Fatalf("failed creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := testTLSPair(t, dir, "default", "ece.example.com")
+	other := testTLSPair(t, dir, "other", "other.example.com")
+
+	ece := NewECE(time.Hour, "/dev/null", 0, 0, 0, false, "")
+	ece.Sinks = []Sink{&testSink{}}
+	ece.Listeners = []Listener{{Network: LISTENER_HTTPS, Address: testAddress()}}
+	ece.TLSCrtPath = def.CrtPath
+	ece.TLSKeyPath = def.KeyPath
+	ece.TLSCerts = []TLSPair{other}
+	ece.TLSReloadInterval = 10 * time.Millisecond
+
+	err = ece.Start()
+	if err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+
+	defer func() {
+		_ = ece.Shutdown()
+		ece.Wait()
+	}()
+
+	served := func(serverName string) *big.Int {
+		conn, err := tls.Dial("tcp", ece.Listeners[0].Address, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err)
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber
+	}
+
+	before := served("ece.example.com")
+	otherSerial := served("other.example.com")
+	assert.Equal(t, before.Cmp(otherSerial) != 0, true, "Cert picked by SNI.")
+
+	testRenew(t, def, "ece.example.com")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for served("ece.example.com").Cmp(before) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, served("ece.example.com").Cmp(before) != 0, true, "Renewed cert served without a restart.")
+	assert.Equal(t, served("other.example.com"), otherSerial, "Other cert untouched.")
+	assert.Equal(t, testutil.ToFloat64(ece.metrics.certExpiry.WithLabelValues(other.CrtPath)) > 0, true, "Expiry gauged per cert.")
+}
@@ -0,0 +1,195 @@
+package ece
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+const FORMAT_TYPED = "typed"
+
+// TypedOutputEvent is OutputEvent with its fields as the types they hold, rather than strings as Fastly logs them: scores, byte counts and the response status are numbers, the WAF flags booleans, and the start time an RFC3339 timestamp.  A field that's missing is null.  A field that doesn't parse is null too, and the reason is given in ParseErrors, keyed by the field's JSON name, so one bad field never costs the whole event.
+type TypedOutputEvent struct {
+	ServiceId            string           `json:"service_id"`
+	RequestId            string           `json:"request_id"`
+	StartTime            *time.Time       `json:"start_time"`
+	FastlyInfo           string           `json:"fastly_info"`
+	Datacenter           string           `json:"datacenter"`
+	ClientIp             string           `json:"client_ip"`
+	ReqMethod            string           `json:"req_method"`
+	ReqURI               string           `json:"req_uri"`
+	ReqHHost             string           `json:"req_h_host"`
+	ReqHUserAgent        string           `json:"req_h_user_agent"`
+	ReqHAcceptEncoding   string           `json:"req_h_accept_encoding"`
+	ReqHeaderBytes       *int             `json:"req_header_bytes"`
+	ReqBodyBytes         *int             `json:"req_body_bytes"`
+	RuleIds              []int            `json:"rule_ids"`
+	InvalidRuleIds       []string         `json:"invalid_rule_ids,omitempty"`
+	WafLogged            *bool            `json:"waf_logged"`
+	WafBlocked           *bool            `json:"waf_blocked"`
+	WafFailures          *int             `json:"waf_failures"`
+	WafExecuted          *bool            `json:"waf_executed"`
+	AnomalyScore         *int             `json:"anomaly_score"`
+	SqlInjectionScore    *int             `json:"sql_injection_score"`
+	RfiScore             *int             `json:"rfi_score"`
+	LfiScore             *int             `json:"lfi_score"`
+	RceScore             *int             `json:"rce_score"`
+	PhpInjectionScore    *int             `json:"php_injection_score"`
+	SessionFixationScore *int             `json:"session_fixation_score"`
+	HTTPViolationScore   *int             `json:"http_violation_score"`
+	XSSScore             *int             `json:"xss_score"`
+	RespStatus           *int             `json:"resp_status"`
+	RespBytes            *int             `json:"resp_bytes"`
+	RespHeaderBytes      *int             `json:"resp_header_bytes"`
+	RespBodyBytes        *int             `json:"resp_body_bytes"`
+	WafEvents            []TypedOutputWaf `json:"waf_events"`
+	ThrottlingRule       string           `json:"throttling_rule"`
+	Throttled            int              `json:"throttled"`
+	TlsProtocol          string           `json:"tls_protocol"`
+	TlsCipher            string           `json:"tls_cipher"`
+
+	Originals    map[string]string `json:"originals,omitempty"`
+	DecodeErrors map[string]string `json:"decode_errors,omitempty"`
+
+	ParseErrors map[string]string `json:"parse_errors,omitempty"`
+}
+
+// TypedOutputWaf is OutputWaf with its severity and score as numbers
+type TypedOutputWaf struct {
+	RuleId       string `json:"rule_id"`
+	Severity     *int   `json:"severity"`
+	AnomalyScore *int   `json:"anomaly_score"`
+	LogData      string `json:"logdata"`
+	WafMessage   string `json:"waf_message"`
+}
+
+// typer converts string fields, collecting an error for each that doesn't parse
+type typer struct {
+	errors map[string]string
+}
+
+func (p *typer) fail(field string, value string, kind string) {
+	if p.errors == nil {
+		p.errors = make(map[string]string)
+	}
+
+	p.errors[field] = fmt.Sprintf("%q is not %s", value, kind)
+}
+
+func (p *typer) int(field string, value string) *int {
+	if value == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		p.fail(field, value, "an integer")
+		return nil
+	}
+
+	return &n
+}
+
+func (p *typer) bool(field string, value string) *bool {
+	if value == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.fail(field, value, "a boolean")
+		return nil
+	}
+
+	return &b
+}
+
+func (p *typer) time(field string, value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+
+	when, ok := startTime(OutputEvent{StartTime: value})
+	if !ok {
+		p.fail(field, value, "epoch seconds or an RFC3339 timestamp")
+		return nil
+	}
+
+	when = when.UTC()
+
+	return &when
+}
+
+// Typed converts the event to a TypedOutputEvent
+func Typed(event OutputEvent) TypedOutputEvent {
+	p := &typer{}
+
+	typed := TypedOutputEvent{
+		ServiceId:            event.ServiceId,
+		RequestId:            event.RequestId,
+		StartTime:            p.time("start_time", event.StartTime),
+		FastlyInfo:           event.FastlyInfo,
+		Datacenter:           event.Datacenter,
+		ClientIp:             event.ClientIp,
+		ReqMethod:            event.ReqMethod,
+		ReqURI:               event.ReqURI,
+		ReqHHost:             event.ReqHHost,
+		ReqHUserAgent:        event.ReqHUserAgent,
+		ReqHAcceptEncoding:   event.ReqHAcceptEncoding,
+		ReqHeaderBytes:       p.int("req_header_bytes", event.ReqHeaderBytes),
+		ReqBodyBytes:         p.int("req_body_bytes", event.ReqBodyBytes),
+		RuleIds:              event.RuleIds,
+		InvalidRuleIds:       event.InvalidRuleIds,
+		WafLogged:            p.bool("waf_logged", event.WafLogged),
+		WafBlocked:           p.bool("waf_blocked", event.WafBlocked),
+		WafFailures:          p.int("waf_failures", event.WafFailures),
+		WafExecuted:          p.bool("waf_executed", event.WafExecuted),
+		AnomalyScore:         p.int("anomaly_score", event.AnomalyScore),
+		SqlInjectionScore:    p.int("sql_injection_score", event.SqlInjectionScore),
+		RfiScore:             p.int("rfi_score", event.RfiScore),
+		LfiScore:             p.int("lfi_score", event.LfiScore),
+		RceScore:             p.int("rce_score", event.RceScore),
+		PhpInjectionScore:    p.int("php_injection_score", event.PhpInjectionScore),
+		SessionFixationScore: p.int("session_fixation_score", event.SessionFixationScore),
+		HTTPViolationScore:   p.int("http_violation_score", event.HTTPViolationScore),
+		XSSScore:             p.int("xss_score", event.XSSScore),
+		RespStatus:           p.int("resp_status", event.RespStatus),
+		RespBytes:            p.int("resp_bytes", event.RespBytes),
+		RespHeaderBytes:      p.int("resp_header_bytes", event.RespHeaderBytes),
+		RespBodyBytes:        p.int("resp_body_bytes", event.RespBodyBytes),
+		ThrottlingRule:       event.ThrottlingRule,
+		Throttled:            event.Throttled,
+		TlsProtocol:          event.TlsProtocol,
+		TlsCipher:            event.TlsCipher,
+		Originals:            event.Originals,
+		DecodeErrors:         event.DecodeErrors,
+	}
+
+	for i, waf := range event.WafEvents {
+		typed.WafEvents = append(typed.WafEvents, TypedOutputWaf{
+			RuleId:       waf.RuleId,
+			Severity:     p.int(fmt.Sprintf("waf_events[%d].severity", i), waf.Severity),
+			AnomalyScore: p.int(fmt.Sprintf("waf_events[%d].anomaly_score", i), waf.AnomalyScore),
+			LogData:      waf.LogData,
+			WafMessage:   waf.WafMessage,
+		})
+	}
+
+	typed.ParseErrors = p.errors
+
+	return typed
+}
+
+// TypedFormatter renders events as JSON with typed fields.  See TypedOutputEvent.
+type TypedFormatter struct{}
+
+func (f TypedFormatter) Format(event OutputEvent) (line []byte, err error) {
+	line, err = json.Marshal(Typed(event))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshall typed output for req id %q", event.RequestId)
+	}
+
+	return line, err
+}
@@ -0,0 +1,63 @@
+package ece
+
+import (
+	"encoding/json"
+	"github.com/magiconair/properties/assert"
+	"testing"
+	"time"
+)
+
+func TestTyped(t *testing.T) {
+	typed := Typed(testOutputEvent())
+
+	assert.Equal(t, typed.StartTime.Format(time.RFC3339), "2018-03-15T21:40:05Z", "Start time converted from epoch seconds.")
+	assert.Equal(t, *typed.AnomalyScore, 0, "Score is a number.")
+	assert.Equal(t, *typed.ReqBodyBytes, 852, "Byte count is a number.")
+	assert.Equal(t, *typed.RespStatus, 200, "Status is a number.")
+	assert.Equal(t, *typed.WafBlocked, false, "Blocked is a boolean.")
+	assert.Equal(t, *typed.WafExecuted, true, "Executed is a boolean.")
+	assert.Equal(t, *typed.WafEvents[0].Severity, 99, "WAF severity is a number.")
+	assert.Equal(t, len(typed.ParseErrors), 0, "No parse errors.")
+}
+
+// TestTypedParseErrors checks that fields that don't parse are nulled and reported, without losing the rest of the event
+func TestTypedParseErrors(t *testing.T) {
+	event := testOutputEvent()
+	event.StartTime = "yesterday"
+	event.RespStatus = "OK"
+	event.WafBlocked = "maybe"
+	event.WafEvents[0].AnomalyScore = "high"
+
+	typed := Typed(event)
+
+	assert.Equal(t, typed.ParseErrors, map[string]string{
+		"start_time":                  `"yesterday" is not epoch seconds or an RFC3339 timestamp`,
+		"resp_status":                 `"OK" is not an integer`,
+		"waf_blocked":                 `"maybe" is not a boolean`,
+		"waf_events[0].anomaly_score": `"high" is not an integer`,
+	}, "Each bad field reported.")
+
+	assert.Equal(t, typed.StartTime == nil, true, "Bad start time nulled.")
+	assert.Equal(t, typed.RespStatus == nil, true, "Bad status nulled.")
+	assert.Equal(t, typed.WafBlocked == nil, true, "Bad flag nulled.")
+	assert.Equal(t, *typed.RespBytes, 697, "Good fields still converted.")
+	assert.Equal(t, typed.RequestId, event.RequestId, "Strings kept.")
+}
+
+func TestTypedFormatter(t *testing.T) {
+	line, err := TypedFormatter{}.Format(OutputEvent{RequestId: "orphan", AnomalyScore: "5", WafLogged: "1"})
+	if err != nil {
+		t.Fatalf("failed formatting: %s", err)
+	}
+
+	var fields map[string]interface{}
+	_ = json.Unmarshal(line, &fields)
+
+	assert.Equal(t, fields["anomaly_score"], float64(5), "Score rendered as a number.")
+	assert.Equal(t, fields["waf_logged"], true, "Flag rendered as a boolean.")
+	assert.Equal(t, fields["start_time"], nil, "Missing start time is null.")
+	assert.Equal(t, fields["resp_status"], nil, "Missing status is null.")
+
+	_, reported := fields["parse_errors"]
+	assert.Equal(t, reported, false, "Missing fields aren't errors.")
+}
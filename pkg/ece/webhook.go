@@ -0,0 +1,395 @@
+package ece
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WEBHOOK_FORMAT_JSON posts each batch as a JSON array of events
+const WEBHOOK_FORMAT_JSON = "json"
+
+// WEBHOOK_FORMAT_NDJSON posts each batch as newline delimited JSON, one event per line
+const WEBHOOK_FORMAT_NDJSON = "ndjson"
+
+const WEBHOOK_BATCH_SIZE_DEFAULT = 100
+const WEBHOOK_BATCH_INTERVAL_DEFAULT = time.Second
+const WEBHOOK_RETRIES_DEFAULT = 5
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+const WEBHOOK_SPILL_SUFFIX = ".batch"
+
+// WebhookSink POSTs events to an HTTP endpoint in batches.  A batch is sent once it has BatchSize events, or after BatchInterval.  Batches that fail with a 5xx or a network error are retried with exponential backoff, and if they still fail, spilled to SpillDir to be sent once the endpoint recovers.  Batches rejected with a 4xx are dropped, as retrying won't help.
+type WebhookSink struct {
+	URL string
+
+	// Format one of WEBHOOK_FORMAT_JSON (the default) or WEBHOOK_FORMAT_NDJSON
+	Format string
+
+	// Formatter renders each event.  JSON if unset.  Under WEBHOOK_FORMAT_NDJSON it may render any line, e.g. CEFFormatter, but under WEBHOOK_FORMAT_JSON it must render JSON objects, e.g. ECSFormatter.
+	Formatter Formatter
+
+	// Header extra headers sent with every request
+	Header http.Header
+
+	// BearerToken if set, sent as an Authorization: Bearer header
+	BearerToken string
+
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// Retries how many times to retry a failing batch before spilling it
+	Retries int
+
+	// SpillDir where failed batches are queued on disk.  If empty, they're dropped.
+	SpillDir string
+
+	// Client the HTTP client to post with.  Defaults to one with a WEBHOOK_TIMEOUT timeout.
+	Client *http.Client
+
+	batcher *batcher
+	mutex   sync.Mutex
+	spilled int
+	seq     uint64
+
+	// unspilling whether spilled batches are being sent, on the goroutine unspillWait waits for
+	unspilling  bool
+	unspillWait sync.WaitGroup
+
+	failureReporter
+}
+
+// NewWebhookSink creates a WebhookSink posting to url, with default settings.  Adjust them, then call Start.
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		URL:           url,
+		Format:        WEBHOOK_FORMAT_JSON,
+		Header:        make(http.Header),
+		BatchSize:     WEBHOOK_BATCH_SIZE_DEFAULT,
+		BatchInterval: WEBHOOK_BATCH_INTERVAL_DEFAULT,
+		Retries:       WEBHOOK_RETRIES_DEFAULT,
+	}
+}
+
+// ParseWebhookHeader parses a header given as "Name: value"
+func ParseWebhookHeader(spec string) (name string, value string, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		err = fmt.Errorf("header %q must be given as 'Name: value'", spec)
+		return name, value, err
+	}
+
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), err
+}
+
+// Start validates the settings and starts sending.  Batches spilled by a previous run are sent along with new ones.
+func (s *WebhookSink) Start() (err error) {
+	switch s.Format {
+	case WEBHOOK_FORMAT_JSON, WEBHOOK_FORMAT_NDJSON:
+	default:
+		err = fmt.Errorf("unsupported webhook format %q.  Must be one of json or ndjson", s.Format)
+		return err
+	}
+
+	if s.BatchInterval <= 0 {
+		s.BatchInterval = WEBHOOK_BATCH_INTERVAL_DEFAULT
+	}
+
+	if s.Client == nil {
+		s.Client = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	}
+
+	if s.SpillDir != "" {
+		err = os.MkdirAll(s.SpillDir, 0755)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to create webhook spill dir %s", s.SpillDir)
+			return err
+		}
+	}
+
+	s.batcher = newBatcher(s.BatchSize, s.BatchInterval, s.deliver)
+	s.batcher.shelve = s.shelve
+	s.batcher.idle = s.catchUp
+	s.batcher.start()
+
+	return err
+}
+
+// Write adds the event to the current batch.  It never waits on the endpoint, but fails if the sink hasn't been started.
+func (s *WebhookSink) Write(event OutputEvent) (err error) {
+	if s.batcher == nil {
+		err = fmt.Errorf("webhook %s not started, req id %q not written", s.URL, event.RequestId)
+		return err
+	}
+
+	s.batcher.add(event)
+
+	return err
+}
+
+// Flush sends the current batch and everything queued behind it.  It returns an error if any batch couldn't be sent, whether or not it was spilled.
+func (s *WebhookSink) Flush() (err error) {
+	if s.batcher == nil {
+		return err
+	}
+
+	err = s.batcher.flush()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to flush webhook %s", s.URL)
+	}
+
+	return err
+}
+
+// Close stops sending.  Anything unsent is spilled if possible, so Flush first.  Spilled batches not yet sent are left for the next sink to use the SpillDir.
+func (s *WebhookSink) Close() error {
+	if s.batcher == nil {
+		return nil
+	}
+
+	s.batcher.close()
+	s.unspillWait.Wait()
+
+	return nil
+}
+
+// Spilled returns the number of batches spilled to disk, or dropped if there's no SpillDir
+func (s *WebhookSink) Spilled() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.spilled
+}
+
+// encode renders the batch in the sink's format
+func (s *WebhookSink) encode(batch []OutputEvent) (body []byte, err error) {
+	lines := make([]json.RawMessage, 0, len(batch))
+	for _, event := range batch {
+		var line []byte
+		line, err = formatOrJSON(s.Formatter, event)
+		if err != nil {
+			break
+		}
+
+		lines = append(lines, line)
+	}
+
+	switch {
+	case err != nil:
+	case s.Format == WEBHOOK_FORMAT_NDJSON:
+		buf := &bytes.Buffer{}
+		for _, line := range lines {
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		body = buf.Bytes()
+	default:
+		body, err = json.Marshal(lines)
+	}
+
+	if err != nil {
+		err = errors.Wrapf(err, "failed to marshall batch of %d events", len(batch))
+	}
+
+	return body, err
+}
+
+// contentType the content type of the sink's batches
+func (s *WebhookSink) contentType() string {
+	if s.Format != WEBHOOK_FORMAT_NDJSON {
+		return "application/json"
+	}
+
+	switch s.Formatter.(type) {
+	case CEFFormatter, LEEFFormatter:
+		return "text/plain"
+	}
+
+	return "application/x-ndjson"
+}
+
+// spill writes the batch to the spill dir, or drops it if there isn't one
+func (s *WebhookSink) spill(body []byte) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.spilled++
+
+	if s.SpillDir == "" {
+		err = fmt.Errorf("dropped webhook batch of %d bytes", len(body))
+		return err
+	}
+
+	s.seq++
+	path := filepath.Join(s.SpillDir, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq%1000000, WEBHOOK_SPILL_SUFFIX))
+
+	err = ioutil.WriteFile(path, body, 0644)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to spill webhook batch to %s", path)
+	}
+
+	return err
+}
+
+// shelve spills a batch that can't be sent now
+func (s *WebhookSink) shelve(batch []OutputEvent) {
+	s.gaveUp(len(batch))
+
+	body, err := s.encode(batch)
+	if err == nil {
+		err = s.spill(body)
+	}
+
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+}
+
+// post makes a single attempt at sending the body.  retry reports whether the failure is worth retrying.
+func (s *WebhookSink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		err = errors.Wrapf(err, "failed to create request for %s", s.URL)
+		return false, err
+	}
+
+	for name, values := range s.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	req.Header.Set("Content-Type", s.contentType())
+
+	if s.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.BearerToken)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to post to %s", s.URL)
+		return true, err
+	}
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		err = fmt.Errorf("%s responded %s", s.URL, resp.Status)
+		return true, err
+	case resp.StatusCode >= 300:
+		err = fmt.Errorf("%s rejected batch: %s", s.URL, resp.Status)
+		return false, err
+	}
+
+	return false, err
+}
+
+// deliver sends the batch, retrying with exponential backoff, and spills it if it still can't be sent
+func (s *WebhookSink) deliver(batch []OutputEvent) (err error) {
+	body, err := s.encode(batch)
+	if err != nil {
+		s.gaveUp(len(batch))
+		return err
+	}
+
+	var again bool
+	err = retry(s.Retries, s.batcher.stopping(), func() (bool, error) {
+		again, err = s.post(body)
+		return again, err
+	})
+
+	switch {
+	case err == nil:
+		// The endpoint is up, so catch up on anything spilled
+		s.catchUp()
+		return err
+	case !again:
+		_, _ = fmt.Fprintf(os.Stderr, "dropping webhook batch: %s\n", err)
+		s.gaveUp(len(batch))
+		return err
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "giving up on webhook batch: %s\n", err)
+	s.gaveUp(len(batch))
+
+	spillErr := s.spill(body)
+	if spillErr != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s\n", spillErr)
+	}
+
+	return err
+}
+
+// catchUp starts sending spilled batches on a goroutine of its own, so the batcher carries on with new ones meanwhile, unless that's already under way.  It's only called from the batcher's goroutine, so never once Close is waiting.
+func (s *WebhookSink) catchUp() {
+	if s.SpillDir == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.unspilling {
+		return
+	}
+
+	s.unspilling = true
+	s.unspillWait.Add(1)
+
+	go func() {
+		defer s.unspillWait.Done()
+
+		s.unspill()
+
+		s.mutex.Lock()
+		s.unspilling = false
+		s.mutex.Unlock()
+	}()
+}
+
+// unspill sends spilled batches oldest first, stopping at the first that fails, or once the sink is closing
+func (s *WebhookSink) unspill() {
+	paths, err := filepath.Glob(filepath.Join(s.SpillDir, "*"+WEBHOOK_SPILL_SUFFIX))
+	if err != nil || len(paths) == 0 {
+		return
+	}
+
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		select {
+		case <-s.batcher.stopping():
+			return
+		default:
+		}
+
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "failed to read spilled webhook batch %s: %s\n", path, err)
+			continue
+		}
+
+		retry, err := s.post(body)
+		if err != nil && retry {
+			return
+		}
+
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "dropping spilled webhook batch %s: %s\n", path, err)
+		}
+
+		_ = os.Remove(path)
+	}
+}
@@ -0,0 +1,425 @@
+package ece
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook an endpoint recording the events posted to it, answering with whatever status is set
+type testWebhook struct {
+	sync.Mutex
+	server   *httptest.Server
+	status   int
+	attempts int
+	requests []*http.Request
+	events   []OutputEvent
+	lines    []string
+}
+
+func newTestWebhook() *testWebhook {
+	hook := &testWebhook{status: http.StatusOK}
+
+	hook.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook.Lock()
+		defer hook.Unlock()
+
+		hook.attempts++
+		if hook.status != http.StatusOK {
+			w.WriteHeader(hook.status)
+			return
+		}
+
+		var events []OutputEvent
+		if r.Header.Get("Content-Type") == "text/plain" {
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				hook.lines = append(hook.lines, scanner.Text())
+			}
+		} else if r.Header.Get("Content-Type") == "application/x-ndjson" {
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var event OutputEvent
+				_ = json.Unmarshal(scanner.Bytes(), &event)
+				events = append(events, event)
+			}
+		} else {
+			_ = json.NewDecoder(r.Body).Decode(&events)
+		}
+
+		hook.requests = append(hook.requests, r)
+		hook.events = append(hook.events, events...)
+	}))
+
+	return hook
+}
+
+func (h *testWebhook) setStatus(status int) {
+	h.Lock()
+	h.status = status
+	h.Unlock()
+}
+
+// received returns the request ids received so far
+func (h *testWebhook) received() (reqIds []string) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, event := range h.events {
+		reqIds = append(reqIds, event.RequestId)
+	}
+
+	return reqIds
+}
+
+func testEvents(n int) (events []OutputEvent, reqIds []string) {
+	for i := 0; i < n; i++ {
+		reqId := fmt.Sprintf("req-%d", i)
+		events = append(events, OutputEvent{RequestId: reqId})
+		reqIds = append(reqIds, reqId)
+	}
+
+	return events, reqIds
+}
+
+func TestWebhook(t *testing.T) {
+	inputs := []struct {
+		format      string
+		contentType string
+	}{
+		{WEBHOOK_FORMAT_JSON, "application/json"},
+		{WEBHOOK_FORMAT_NDJSON, "application/x-ndjson"},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.format, func(t *testing.T) {
+			hook := newTestWebhook()
+			defer hook.server.Close()
+
+			sink := NewWebhookSink(hook.server.URL)
+			sink.Format = tc.format
+			sink.BatchSize = 2
+			sink.BatchInterval = time.Hour
+			sink.BearerToken = "s3cret"
+			sink.Header.Set("X-Team", "security")
+
+			err := sink.Write(OutputEvent{RequestId: "early"})
+			assert.Equal(t, err != nil, true, "Write before Start refused.")
+
+			err = sink.Start()
+			if err != nil {
+				t.Fatalf("failed starting sink: %s", err)
+			}
+
+			events, reqIds := testEvents(3)
+			for _, event := range events {
+				err = sink.Write(event)
+				if err != nil {
+					t.Errorf("failed writing: %s", err)
+				}
+			}
+
+			err = sink.Flush()
+			if err != nil {
+				t.Errorf("failed flushing: %s", err)
+			}
+
+			_ = sink.Close()
+
+			assert.Equal(t, hook.received(), reqIds, "Every event posted, in order.")
+			assert.Equal(t, len(hook.requests), 2, "Events posted in batches.")
+
+			for _, r := range hook.requests {
+				assert.Equal(t, r.Header.Get("Content-Type"), tc.contentType, "Content type matches format.")
+				assert.Equal(t, r.Header.Get("Authorization"), "Bearer s3cret", "Bearer token sent.")
+				assert.Equal(t, r.Header.Get("X-Team"), "security", "Custom header sent.")
+			}
+		})
+	}
+}
+
+func TestWebhookFormatter(t *testing.T) {
+	inputs := []struct {
+		name      string
+		format    string
+		formatter Formatter
+	}{
+		{"cef", WEBHOOK_FORMAT_NDJSON, CEFFormatter{}},
+		{"ecs", WEBHOOK_FORMAT_JSON, ECSFormatter{}},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			hook := newTestWebhook()
+			defer hook.server.Close()
+
+			sink := NewWebhookSink(hook.server.URL)
+			sink.Format = tc.format
+			sink.Formatter = tc.formatter
+			sink.BatchInterval = time.Hour
+
+			err := sink.Start()
+			if err != nil {
+				t.Fatalf("failed starting sink: %s", err)
+			}
+			defer sink.Close()
+
+			_ = sink.Write(testOutputEvent())
+			_ = sink.Write(OutputEvent{RequestId: "orphan"})
+
+			err = sink.Flush()
+			if err != nil {
+				t.Errorf("failed flushing: %s", err)
+			}
+
+			body, err := sink.encode([]OutputEvent{testOutputEvent(), {RequestId: "orphan"}})
+			if err != nil {
+				t.Fatalf("failed encoding: %s", err)
+			}
+
+			first, _ := tc.formatter.Format(testOutputEvent())
+
+			if tc.format == WEBHOOK_FORMAT_NDJSON {
+				assert.Equal(t, len(hook.lines), 2, "One line per event.")
+				assert.Equal(t, hook.lines[0], string(first), "Lines formatted.")
+				assert.Equal(t, hook.requests[0].Header.Get("Content-Type"), "text/plain", "Sent as text.")
+				return
+			}
+
+			var docs []json.RawMessage
+			_ = json.Unmarshal(body, &docs)
+
+			assert.Equal(t, len(docs), 2, "Array of formatted documents.")
+			assert.Equal(t, string(docs[0]), string(first), "Documents formatted.")
+		})
+	}
+}
+
+func TestWebhookInterval(t *testing.T) {
+	hook := newTestWebhook()
+	defer hook.server.Close()
+
+	sink := NewWebhookSink(hook.server.URL)
+	sink.BatchInterval = 10 * time.Millisecond
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+	defer sink.Close()
+
+	_ = sink.Write(OutputEvent{RequestId: "lonely"})
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return len(hook.received()) == 1, fmt.Sprintf("received %v", hook.received())
+	})
+	if !ok {
+		t.Errorf("partial batch not sent after the interval: %s", message)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	inputs := []struct {
+		name     string
+		status   int
+		attempts int
+		spilled  int
+	}{
+		{"5xx retried", http.StatusServiceUnavailable, 3, 1},
+		{"4xx dropped", http.StatusBadRequest, 1, 0},
+	}
+
+	for _, tc := range inputs {
+		t.Run(tc.name, func(t *testing.T) {
+			hook := newTestWebhook()
+			defer hook.server.Close()
+			hook.setStatus(tc.status)
+
+			sink := NewWebhookSink(hook.server.URL)
+			sink.Retries = 2
+			sink.BatchInterval = time.Hour
+
+			err := sink.Start()
+			if err != nil {
+				t.Fatalf("failed starting sink: %s", err)
+			}
+			defer sink.Close()
+
+			_ = sink.Write(OutputEvent{RequestId: "a"})
+
+			err = sink.Flush()
+			if err == nil {
+				t.Error("failed batch not reported")
+			}
+
+			hook.Lock()
+			assert.Equal(t, hook.attempts, tc.attempts, "Attempts meet expectations.")
+			hook.Unlock()
+
+			assert.Equal(t, sink.Spilled(), tc.spilled, "Spilled batches meet expectations.")
+		})
+	}
+}
+
+// TestWebhookSpill takes the endpoint down, checks batches spill to disk, then that they're sent once it recovers
+func TestWebhookSpill(t *testing.T) {
+	hook := newTestWebhook()
+	defer hook.server.Close()
+	hook.setStatus(http.StatusBadGateway)
+
+	spillDir := filepath.Join(tmpDir, "webhook-spill")
+	defer os.RemoveAll(spillDir)
+
+	sink := NewWebhookSink(hook.server.URL)
+	sink.Retries = 1
+	sink.BatchSize = 2
+	sink.BatchInterval = time.Hour
+	sink.SpillDir = spillDir
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+
+	events, reqIds := testEvents(5)
+	for _, event := range events[:4] {
+		_ = sink.Write(event)
+	}
+
+	// Full batches may be sent before the flush, so whether it reports them varies
+	_ = sink.Flush()
+
+	spilled, _ := ioutil.ReadDir(spillDir)
+	assert.Equal(t, len(spilled), 2, "Failed batches spilled to disk.")
+
+	hook.setStatus(http.StatusOK)
+
+	_ = sink.Write(events[4])
+
+	err = sink.Flush()
+	if err != nil {
+		t.Errorf("failed flushing: %s", err)
+	}
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return len(hook.received()) == 5, fmt.Sprintf("received %v", hook.received())
+	})
+	if !ok {
+		t.Errorf("spilled batches not sent: %s", message)
+	}
+
+	_ = sink.Close()
+
+	assert.Equal(t, hook.received(), append(reqIds[4:], reqIds[:4]...), "Spilled batches sent once the endpoint recovered.")
+
+	spilled, _ = ioutil.ReadDir(spillDir)
+	assert.Equal(t, len(spilled), 0, "Sent batches removed from disk.")
+}
+
+// TestWebhookClose checks that events still held on close are spilled, and sent by the next sink to use the spill dir
+func TestWebhookClose(t *testing.T) {
+	hook := newTestWebhook()
+	defer hook.server.Close()
+
+	spillDir := filepath.Join(tmpDir, "webhook-close")
+	defer os.RemoveAll(spillDir)
+
+	sink := NewWebhookSink(hook.server.URL)
+	sink.BatchInterval = time.Hour
+	sink.SpillDir = spillDir
+
+	err := sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+
+	_ = sink.Write(OutputEvent{RequestId: "a"})
+	_ = sink.Close()
+
+	assert.Equal(t, len(hook.received()), 0, "Nothing sent without a flush.")
+
+	sink = NewWebhookSink(hook.server.URL)
+	sink.BatchInterval = 10 * time.Millisecond
+	sink.SpillDir = spillDir
+
+	err = sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+	defer sink.Close()
+
+	ok, message := within(time.Second, func() (bool, string) {
+		return len(hook.received()) == 1, fmt.Sprintf("received %v", hook.received())
+	})
+	if !ok {
+		t.Errorf("spilled batch not sent by the next sink: %s", message)
+	}
+}
+
+// TestWebhookUnspillBlocking checks that new batches are sent while spilled ones are stuck on a slow endpoint
+func TestWebhookUnspillBlocking(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan string, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var events []OutputEvent
+		_ = json.NewDecoder(r.Body).Decode(&events)
+
+		for _, event := range events {
+			if event.RequestId == "spilled" {
+				<-release
+			}
+
+			received <- event.RequestId
+		}
+	}))
+	defer server.Close()
+
+	spillDir := filepath.Join(tmpDir, "webhook-unspill")
+	defer os.RemoveAll(spillDir)
+
+	err := os.MkdirAll(spillDir, 0755)
+	if err != nil {
+		t.Fatalf("failed creating spill dir: %s", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(spillDir, "1"+WEBHOOK_SPILL_SUFFIX), []byte(`[{"request_id":"spilled"}]`), 0644)
+	if err != nil {
+		t.Fatalf("failed spilling batch: %s", err)
+	}
+
+	sink := NewWebhookSink(server.URL)
+	sink.BatchInterval = 10 * time.Millisecond
+	sink.SpillDir = spillDir
+
+	err = sink.Start()
+	if err != nil {
+		t.Fatalf("failed starting sink: %s", err)
+	}
+
+	// Give the first idle tick time to start on the spilled batch
+	time.Sleep(50 * time.Millisecond)
+
+	_ = sink.Write(OutputEvent{RequestId: "new"})
+
+	select {
+	case reqId := <-received:
+		assert.Equal(t, reqId, "new", "New batch sent first.")
+	case <-time.After(time.Second):
+		t.Error("new batch held up by the spilled one")
+	}
+
+	close(release)
+	assert.Equal(t, <-received, "spilled", "Spilled batch sent once the endpoint answered.")
+
+	_ = sink.Close()
+}